@@ -0,0 +1,497 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// How many rows the lists on the admin page show.
+const adminListLimit = 50
+
+// Actions recorded in the audit trail,
+const (
+	auditDeletePaste    = "delete paste"
+	auditQuarantine     = "quarantine paste"
+	auditRestore        = "restore paste"
+	auditDismissReports = "dismiss reports"
+	auditDisableUser    = "disable user"
+	auditEnableUser     = "enable user"
+	auditSetRole        = "set role"
+	auditReset2FA       = "reset 2fa"
+	auditUnlockUser     = "unlock user"
+	auditDeleteSpam     = "delete spam"
+	auditConfirmSpam    = "confirm spam"
+	auditNotSpam        = "not spam"
+)
+
+// AdminPaste is a paste as listed on the admin page.
+type AdminPaste struct {
+	Id          string
+	Title       string
+	Size        int
+	CreatedAt   int64
+	Owner       string
+	Team        string
+	Quarantined bool
+	Reports     int
+}
+
+// AdminUser is a user as listed on the admin page.
+type AdminUser struct {
+	User
+	Pastes int
+	Locked bool
+}
+
+// Report is an abuse report about a paste.
+type Report struct {
+	Id        int64
+	PasteId   string
+	Reporter  string
+	IP        string
+	Reason    string
+	CreatedAt int64
+}
+
+// AuditEntry is an admin action in the audit trail.
+type AuditEntry struct {
+	Id        int64
+	CreatedAt int64
+	Admin     string
+	Action    string
+	Target    string
+	Detail    string
+}
+
+// StorageStats are the totals shown on the admin page.
+type StorageStats struct {
+	Pastes      int64
+	Bytes       int64
+	Quarantined int64
+	Users       int64
+	Disabled    int64
+	Teams       int64
+	Sessions    int64
+}
+
+// AdminPage is used for generating the admin page.
+type AdminPage struct {
+	Title   string
+	User    *User
+	Stats   StorageStats
+	Pastes  []AdminPaste
+	Users   []AdminUser
+	Reports []Report
+	Audit   []AuditEntry
+	Spam    []SpamEntry
+	Roles   []string
+	Query   string
+	Message string
+
+	CSRFToken   string
+	CSPNonce    string
+	Theme       Theme
+	TrainedSpam int // Spam pastes the classifier was trained with
+	TrainedHam  int // Other pastes the classifier was trained with
+}
+
+// CreatedAtStr returns when the paste was created in a human friendly format.
+func (p AdminPaste) CreatedAtStr() string {
+	if p.CreatedAt == 0 {
+		return "Unknown"
+	}
+	return time.Unix(p.CreatedAt, 0).Format("2006-01-02 15:04:05")
+}
+
+// CreatedAtStr returns when the report was made in a human friendly format.
+func (r Report) CreatedAtStr() string {
+	return time.Unix(r.CreatedAt, 0).Format("2006-01-02 15:04:05")
+}
+
+// CreatedAtStr returns when the action was taken in a human friendly format.
+func (a AuditEntry) CreatedAtStr() string {
+	return time.Unix(a.CreatedAt, 0).Format("2006-01-02 15:04:05")
+}
+
+// MegaBytes returns the size of all pastes in megabytes.
+func (s StorageStats) MegaBytes() string {
+	return fmt.Sprintf("%.2f", float64(s.Bytes)/1024/1024)
+}
+
+// isAdmin returns true if the user is an admin. Requests made with a team
+// token never get admin rights.
+func isAdmin(u *User) bool {
+	return u != nil && u.Role == roleAdmin && u.Team == 0
+}
+
+// pasteExists returns true if there is a paste with the given id.
+func pasteExists(pasteId string) bool {
+
+	var count int
+	err := dbHandle.QueryRow("select count(*) from "+configuration.DBTable+
+		" where id="+configuration.DBPlaceHolder[0], pasteId).Scan(&count)
+	checkErr(err)
+
+	return count > 0
+}
+
+// setPasteQuarantined hides a paste from everyone but admins, or shows it
+// again.
+func setPasteQuarantined(pasteId string, quarantined bool) {
+
+	value := 0
+	if quarantined {
+		value = 1
+	}
+
+	stmt, err := dbHandle.Prepare("UPDATE " + configuration.DBTable +
+		" SET quarantined=" + configuration.DBPlaceHolder[0] +
+		" WHERE id=" + configuration.DBPlaceHolder[1])
+	checkErr(err)
+
+	_, err = stmt.Exec(value, pasteId)
+	checkErr(err)
+	stmt.Close()
+}
+
+// delPasteReports removes the abuse reports about a paste.
+func delPasteReports(pasteId string) {
+
+	stmt, err := dbHandle.Prepare("DELETE FROM " + configuration.DBReportsTable +
+		" WHERE pasteid=" + configuration.DBPlaceHolder[0])
+	checkErr(err)
+
+	_, err = stmt.Exec(pasteId)
+	checkErr(err)
+	stmt.Close()
+}
+
+// logAdminAction adds an action to the audit trail.
+func logAdminAction(adminId int64, action string, target string, detail string) {
+
+	stmt, err := dbHandle.Prepare("INSERT INTO " + configuration.DBAuditTable +
+		" (created_at,adminid,action,target,detail)values(" + dbPlaceHolders(5) + ")")
+	checkErr(err)
+
+	_, err = stmt.Exec(time.Now().Unix(), adminId, action, target, detail)
+	checkErr(err)
+	stmt.Close()
+
+	loggy(fmt.Sprintf("Admin %d : %s %s %s", adminId, action, target, detail))
+}
+
+// getStorageStats counts the pastes, users and everything else stored.
+func getStorageStats() StorageStats {
+
+	var s StorageStats
+
+	err := dbHandle.QueryRow("select count(*), coalesce(sum(length(data)), 0), "+
+		"coalesce(sum(quarantined), 0) from "+configuration.DBTable).Scan(&s.Pastes,
+		&s.Bytes, &s.Quarantined)
+	checkErr(err)
+
+	err = dbHandle.QueryRow("select count(*), coalesce(sum(disabled), 0) from "+
+		configuration.DBUsersTable).Scan(&s.Users, &s.Disabled)
+	checkErr(err)
+
+	err = dbHandle.QueryRow("select count(*) from " +
+		configuration.DBTeamsTable).Scan(&s.Teams)
+	checkErr(err)
+
+	err = dbHandle.QueryRow("select count(*) from "+configuration.DBSessionsTable+
+		" where expires_at>"+configuration.DBPlaceHolder[0],
+		time.Now().Unix()).Scan(&s.Sessions)
+	checkErr(err)
+
+	return s
+}
+
+// getRecentPastes lists the newest pastes, or the paste with the given id.
+func getRecentPastes(pasteId string) []AdminPaste {
+
+	pastes := []AdminPaste{}
+
+	query := "select p.id, p.title, length(p.data), p.created_at, p.quarantined, " +
+		"u.email, t.name, (select count(*) from " + configuration.DBReportsTable +
+		" r where r.pasteid=p.id) from " + configuration.DBTable + " p left join " +
+		configuration.DBUsersTable + " u on u.id=p.ownerid left join " +
+		configuration.DBTeamsTable + " t on t.id=p.teamid"
+
+	var rows *sql.Rows
+	var err error
+	if pasteId != "" {
+		rows, err = dbHandle.Query(query+" where p.id="+
+			configuration.DBPlaceHolder[0], pasteId)
+	} else {
+		rows, err = dbHandle.Query(query + " order by coalesce(p.created_at, 0) desc" +
+			" limit " + strconv.Itoa(adminListLimit))
+	}
+	checkErr(err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var p AdminPaste
+		var createdAt sql.NullInt64
+		var owner, team sql.NullString
+		var quarantined int
+
+		err := rows.Scan(&p.Id, &p.Title, &p.Size, &createdAt, &quarantined,
+			&owner, &team, &p.Reports)
+		checkErr(err)
+
+		p.CreatedAt = createdAt.Int64
+		p.Owner = owner.String
+		p.Team = team.String
+		p.Quarantined = quarantined != 0
+		pastes = append(pastes, p)
+	}
+
+	return pastes
+}
+
+// getRecentUsers lists the newest users, or the users with an email containing
+// the query.
+func getRecentUsers(query string) []AdminUser {
+
+	users := []AdminUser{}
+
+	rows, err := dbHandle.Query("select u.id, u.email, u.displayname, u.created_at, "+
+		"u.disabled, u.verified, u.role, (select count(*) from "+configuration.DBTable+
+		" p where p.ownerid=u.id) from "+configuration.DBUsersTable+
+		" u where u.email like "+configuration.DBPlaceHolder[0]+
+		" order by u.created_at desc limit "+strconv.Itoa(adminListLimit),
+		"%"+query+"%")
+	checkErr(err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var u AdminUser
+		var displayName sql.NullString
+		var disabled, verified int
+
+		err := rows.Scan(&u.Id, &u.Email, &displayName, &u.CreatedAt, &disabled,
+			&verified, &u.Role, &u.Pastes)
+		checkErr(err)
+
+		u.DisplayName = displayName.String
+		u.Disabled = disabled != 0
+		u.Verified = verified != 0
+		u.Locked = isLockedOut(u.Email)
+		users = append(users, u)
+	}
+
+	return users
+}
+
+// getRecentReports lists the newest abuse reports.
+func getRecentReports() []Report {
+
+	reports := []Report{}
+
+	rows, err := dbHandle.Query("select r.id, r.pasteid, u.email, r.ip, r.reason, " +
+		"r.created_at from " + configuration.DBReportsTable + " r left join " +
+		configuration.DBUsersTable + " u on u.id=r.userid" +
+		" order by r.created_at desc limit " + strconv.Itoa(adminListLimit))
+	checkErr(err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Report
+		var reporter, ip sql.NullString
+
+		err := rows.Scan(&r.Id, &r.PasteId, &reporter, &ip, &r.Reason, &r.CreatedAt)
+		checkErr(err)
+
+		r.Reporter = reporter.String
+		r.IP = ip.String
+		reports = append(reports, r)
+	}
+
+	return reports
+}
+
+// getAuditTrail lists the newest admin actions.
+func getAuditTrail() []AuditEntry {
+
+	entries := []AuditEntry{}
+
+	rows, err := dbHandle.Query("select a.id, a.created_at, u.email, a.action, " +
+		"a.target, a.detail from " + configuration.DBAuditTable + " a left join " +
+		configuration.DBUsersTable + " u on u.id=a.adminid" +
+		" order by a.id desc limit " + strconv.Itoa(adminListLimit))
+	checkErr(err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var a AuditEntry
+		var admin, detail sql.NullString
+
+		err := rows.Scan(&a.Id, &a.CreatedAt, &admin, &a.Action, &a.Target, &detail)
+		checkErr(err)
+
+		a.Admin = admin.String
+		a.Detail = detail.String
+		entries = append(entries, a)
+	}
+
+	return entries
+}
+
+// adminHandler shows the moderation dashboard and handles the moderation
+// actions on POST. Every action is recorded in the audit trail. Everyone but
+// admins gets a 404.
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+
+	u := currentUser(r)
+	if !isAdmin(u) {
+		notFoundHandler(w, r)
+		return
+	}
+
+	if r.Method == "POST" {
+		pasteId := html.EscapeString(r.FormValue("paste"))
+		userId, _ := strconv.ParseInt(r.FormValue("user"), 10, 64)
+		target := getUserById(userId)
+		message := ""
+
+		switch action := r.FormValue("action"); action {
+		case "delete", "spam", "quarantine", "restore", "dismiss":
+			if !pasteExists(pasteId) {
+				message = tr(r, "There is no paste with id %s.", pasteId)
+				break
+			}
+			switch action {
+			case "delete":
+				delPaste(pasteId)
+				delPasteReports(pasteId)
+				logAdminAction(u.Id, auditDeletePaste, pasteId, "")
+			case "spam":
+				trainBayes(pasteText(pasteId, u), true)
+				delPaste(pasteId)
+				delPasteReports(pasteId)
+				logAdminAction(u.Id, auditDeleteSpam, pasteId, "")
+			case "quarantine":
+				setPasteQuarantined(pasteId, true)
+				logAdminAction(u.Id, auditQuarantine, pasteId, "")
+			case "restore":
+				trainBayes(pasteText(pasteId, u), false)
+				setPasteQuarantined(pasteId, false)
+				delPasteReports(pasteId)
+				logAdminAction(u.Id, auditRestore, pasteId, "")
+			case "dismiss":
+				trainBayes(pasteText(pasteId, u), false)
+				delPasteReports(pasteId)
+				logAdminAction(u.Id, auditDismissReports, pasteId, "")
+			}
+
+		case "confirm", "ham":
+			entryId, _ := strconv.ParseInt(r.FormValue("entry"), 10, 64)
+			e := getSpamEntry(entryId)
+			if e == nil {
+				message = tr(r, "There is no such rejected submission.")
+				break
+			}
+			trainBayes(e.Title+"\n"+e.Paste, action == "confirm")
+			delSpamEntry(e.Id)
+			if action == "confirm" {
+				logAdminAction(u.Id, auditConfirmSpam, e.Title, "")
+			} else {
+				logAdminAction(u.Id, auditNotSpam, e.Title, "")
+			}
+
+		case "disable", "enable", "role", "reset2fa", "unlock":
+			if target == nil {
+				message = tr(r, "There is no such user.")
+				break
+			}
+			if target.Id == u.Id && action != "reset2fa" && action != "unlock" {
+				message = tr(r, "You can't change your own account here.")
+				break
+			}
+			switch action {
+			case "disable":
+				setUserDisabled(target.Id, true)
+				logAdminAction(u.Id, auditDisableUser, target.Email, "")
+			case "enable":
+				setUserDisabled(target.Id, false)
+				logAdminAction(u.Id, auditEnableUser, target.Email, "")
+			case "role":
+				role := r.FormValue("role")
+				if rolePriority(role) < 0 {
+					break
+				}
+				setUserRole(target.Id, role)
+				logAdminAction(u.Id, auditSetRole, target.Email,
+					target.Role+" -> "+role)
+			case "reset2fa":
+				resetUserTOTP(target.Id)
+				logAdminAction(u.Id, auditReset2FA, target.Email, "")
+			case "unlock":
+				clearLoginFailures(accountSubject(html.UnescapeString(target.Email)))
+				logAdminAction(u.Id, auditUnlockUser, target.Email, "")
+			}
+		}
+
+		if message == "" {
+			http.Redirect(w, r, "/admin", 302)
+			return
+		}
+		renderAdmin(w, r, u, message)
+		return
+	}
+
+	renderAdmin(w, r, u, "")
+}
+
+// renderAdmin generates the admin page. The lists can be narrowed down with
+// the paste and q query parameters.
+func renderAdmin(w http.ResponseWriter, r *http.Request, u *User, message string) {
+
+	page := &AdminPage{
+		CSRFToken: csrfToken(w, r),
+		CSPNonce:  cspNonce(r),
+		Theme:     siteTheme,
+		Title:     tr(r, "Admin"),
+		User:      u,
+		Stats:     getStorageStats(),
+		Pastes:    getRecentPastes(html.EscapeString(r.URL.Query().Get("paste"))),
+		Users:     getRecentUsers(html.EscapeString(r.URL.Query().Get("q"))),
+		Reports:   getRecentReports(),
+		Audit:     getAuditTrail(),
+		Spam:      getSpamLog(),
+		Roles:     roles,
+		Query:     r.URL.Query().Get("q"),
+		Message:   message,
+	}
+
+	page.TrainedSpam, page.TrainedHam = trainedPastes()
+
+	renderPage(w, r, "admin.html", page)
+}
+
+// pasteText returns the title and text of a paste, for training the spam
+// classifier.
+func pasteText(pasteId string, u *User) string {
+	p, _ := getPaste(pasteId, u)
+	return p.Title + "\n" + p.Paste
+}
+
+// makeAdmin gives the user with the given email the admin role. It's run from
+// the command line to set up the first admin.
+func makeAdmin(email string) {
+
+	u := getUserByEmail(html.EscapeString(email))
+	if u == nil {
+		debugLogger.Println("   No account with email '" + email + "'.")
+		os.Exit(1)
+	}
+
+	setUserRole(u.Id, roleAdmin)
+	logAdminAction(0, auditSetRole, u.Email, u.Role+" -> "+roleAdmin+" from the command line")
+	debugLogger.Println("   Made '" + email + "' an admin.")
+}
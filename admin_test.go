@@ -0,0 +1,154 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// adminPost runs the admin handler with a POST of the form as the user.
+func adminPost(u *User, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/admin", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	adminHandler(w, loggedIn(r, u))
+	return w
+}
+
+func TestAdminPageIsOnlyShownToAdmins(t *testing.T) {
+
+	setupTest(t)
+
+	admin := createUser("admin@example.com", "", []byte(""))
+	setUserRole(admin.Id, roleAdmin)
+	user := createUser("user@example.com", "", []byte(""))
+
+	for _, tc := range []struct {
+		name   string
+		user   *User
+		status int
+	}{
+		{"anonymous", nil, http.StatusNotFound},
+		{"user", user, http.StatusNotFound},
+		{"admin", admin, http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/admin", nil)
+		if tc.user != nil {
+			r = loggedIn(r, tc.user)
+		}
+		w := httptest.NewRecorder()
+		adminHandler(w, r)
+		if w.Code != tc.status {
+			t.Errorf("the %s got %d instead of %d", tc.name, w.Code, tc.status)
+		}
+	}
+
+	// Team tokens never act as admin,
+	if isAdmin(&User{Role: roleAdmin, Team: 1}) {
+		t.Error("an admin with a team token is an admin")
+	}
+
+	// and a user posting actions changes nothing,
+	p := savePaste("", "data", 0, 0, 0, false)
+	adminPost(user, url.Values{"action": {"delete"}, "paste": {p.Id}})
+	if !pasteExists(p.Id) {
+		t.Error("a user deleted a paste")
+	}
+}
+
+func TestAdminActionsAreAudited(t *testing.T) {
+
+	setupTest(t)
+
+	admin := createUser("admin@example.com", "", []byte(""))
+	setUserRole(admin.Id, roleAdmin)
+	admin = getUserById(admin.Id)
+	user := createUser("user@example.com", "", []byte(""))
+	id := strconv.FormatInt(user.Id, 10)
+
+	deleted := savePaste("", "delete me", 0, 0, 0, false)
+	hidden := savePaste("", "hide me", 0, 0, 0, false)
+
+	for _, tc := range []struct {
+		form    url.Values
+		audit   string
+		message string
+		check   func() bool
+	}{
+		{url.Values{"action": {"quarantine"}, "paste": {hidden.Id}}, auditQuarantine, "",
+			func() bool { p, _ := getPaste(hidden.Id, admin); return p.Quarantined }},
+		{url.Values{"action": {"restore"}, "paste": {hidden.Id}}, auditRestore, "",
+			func() bool { p, _ := getPaste(hidden.Id, admin); return !p.Quarantined }},
+		{url.Values{"action": {"delete"}, "paste": {deleted.Id}}, auditDeletePaste, "",
+			func() bool { return !pasteExists(deleted.Id) }},
+		{url.Values{"action": {"delete"}, "paste": {"missing"}}, "", "There is no paste",
+			func() bool { return true }},
+		{url.Values{"action": {"disable"}, "user": {id}}, auditDisableUser, "",
+			func() bool { return getUserById(user.Id).Disabled }},
+		{url.Values{"action": {"enable"}, "user": {id}}, auditEnableUser, "",
+			func() bool { return !getUserById(user.Id).Disabled }},
+		{url.Values{"action": {"role"}, "user": {id}, "role": {"owner"}}, "", "",
+			func() bool { return getUserById(user.Id).Role == roleUser }},
+		{url.Values{"action": {"role"}, "user": {id}, "role": {roleAdmin}}, auditSetRole, "",
+			func() bool { return getUserById(user.Id).Role == roleAdmin }},
+		{url.Values{"action": {"disable"}, "user": {"0"}}, "", "There is no such user",
+			func() bool { return true }},
+		{url.Values{"action": {"disable"}, "user": {strconv.FormatInt(admin.Id, 10)}}, "",
+			"You can't change your own account", func() bool { return !getUserById(admin.Id).Disabled }},
+	} {
+		before := len(getAuditTrail())
+		w := adminPost(admin, tc.form)
+
+		if tc.message != "" && !strings.Contains(w.Body.String(), template.HTMLEscapeString(tc.message)) {
+			t.Errorf("%v didn't answer %q", tc.form, tc.message)
+		}
+		if !tc.check() {
+			t.Errorf("%v didn't do its job", tc.form)
+		}
+
+		trail := getAuditTrail()
+		switch {
+		case tc.audit == "" && len(trail) != before:
+			t.Errorf("%v was audited", tc.form)
+		case tc.audit != "" && (len(trail) != before+1 || trail[0].Action != tc.audit ||
+			trail[0].Admin != admin.Email):
+			t.Errorf("%v wasn't audited as %q", tc.form, tc.audit)
+		}
+	}
+}
+
+func TestQuarantinedPastesAreOnlyShownToAdmins(t *testing.T) {
+
+	setupTest(t)
+
+	admin := createUser("admin@example.com", "", []byte(""))
+	setUserRole(admin.Id, roleAdmin)
+	admin = getUserById(admin.Id)
+	user := createUser("user@example.com", "", []byte(""))
+
+	p := savePaste("", "data", 0, user.Id, 0, false)
+	setPasteQuarantined(p.Id, true)
+
+	for _, tc := range []struct {
+		name   string
+		user   *User
+		status int
+	}{
+		{"anonymous", nil, http.StatusForbidden},
+		{"owner", user, http.StatusForbidden},
+		{"admin", admin, 0},
+	} {
+		_, err := getPaste(p.Id, tc.user)
+		status := 0
+		if e, ok := err.(*RequestError); ok {
+			status = e.Status
+		}
+		if status != tc.status {
+			t.Errorf("the %s got %d instead of %d", tc.name, status, tc.status)
+		}
+	}
+}
@@ -0,0 +1,692 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The header carrying the delkey of a paste in the v2 api,
+const deleteKeyHeader = "X-Delete-Key"
+
+// A paste in the v2 api.
+type APIPaste struct {
+	Id          string `json:"id"`
+	Title       string `json:"title"`
+	Content     string `json:"content,omitempty"`     // Left out of lists
+	Size        int    `json:"size"`                  // Length of the content in bytes
+	Url         string `json:"url"`                   // The page of the paste
+	RawUrl      string `json:"raw_url"`               // The content as text/plain
+	Team        int64  `json:"team,omitempty"`        // The team the paste is private to
+	Revision    int    `json:"revision"`              // Number of the current version, from 1
+	CreatedAt   int64  `json:"created_at"`            // Unix time
+	UpdatedAt   int64  `json:"updated_at,omitempty"`  // Unix time of the last change
+	ExpiresAt   int64  `json:"expires_at,omitempty"`  // Unix time, left out for pastes kept forever
+	DeleteKey   string `json:"delete_key,omitempty"`  // Only given when the paste is created
+	Quarantined bool   `json:"quarantined,omitempty"` // Only shown to admins
+	Burn        bool   `json:"burn_after_reading,omitempty"`
+	Warning     string `json:"warning,omitempty"` // Secrets found in the content
+}
+
+// This struct is used for indata when a paste is created.
+type APIPasteInput struct {
+	Title     string `json:"title"`
+	Content   string `json:"content"`
+	ExpiresIn int64  `json:"expires_in"`         // Seconds, 0 to keep the paste forever
+	Team      int64  `json:"team"`               // The team to save the paste into, 0 for a public paste
+	Burn      bool   `json:"burn_after_reading"` // Delete the paste once anyone but the owner reads it
+}
+
+// This struct is used for indata when a paste is changed, fields left out
+// are kept.
+type APIPasteUpdate struct {
+	Title   *string `json:"title"`
+	Content *string `json:"content"`
+}
+
+// A list of pastes in the v2 api.
+type APIPasteList struct {
+	Items []APIPaste `json:"items"`
+}
+
+// A paste run through the highlighter.
+type APIHighlight struct {
+	Html    string `json:"html"`
+	Lang    string `json:"lang"`
+	Style   string `json:"style"`
+	Message string `json:"message,omitempty"` // Extra output of the highlighter
+}
+
+// A version of a paste in the v2 api.
+type APIRevision struct {
+	Revision  int    `json:"revision"`
+	Title     string `json:"title"`
+	Content   string `json:"content,omitempty"` // Left out of lists
+	Size      int    `json:"size"`
+	CreatedAt int64  `json:"created_at"`
+	Current   bool   `json:"current,omitempty"` // The version the paste has now
+}
+
+// A list of versions of a paste in the v2 api.
+type APIRevisionList struct {
+	Items []APIRevision `json:"items"`
+}
+
+// A team of the user in the v2 api.
+type APITeam struct {
+	Id   int64  `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"` // The role of the user in the team
+}
+
+// The user of the request in the v2 api.
+type APIUser struct {
+	Id        int64     `json:"id"`
+	Email     string    `json:"email"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	Locale    string    `json:"locale,omitempty"`
+	CreatedAt int64     `json:"created_at"`
+	Team      int64     `json:"team,omitempty"` // The team of the token, for team tokens
+	Teams     []APITeam `json:"teams"`
+}
+
+// An api token in the v2 api.
+type APIToken struct {
+	Id         int64    `json:"id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	Team       int64    `json:"team,omitempty"`
+	CreatedAt  int64    `json:"created_at"`
+	LastUsedAt int64    `json:"last_used_at,omitempty"`
+	Token      string   `json:"token,omitempty"` // Only given when the token is created
+}
+
+// This struct is used for indata when a token is created.
+type APITokenInput struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	Team   int64    `json:"team"` // Limit the token to a team, 0 for the personal pastes
+}
+
+// A list of api tokens in the v2 api.
+type APITokenList struct {
+	Items []APIToken `json:"items"`
+}
+
+// A request to the v2 api, as handed to the handlers.
+type apiCall struct {
+	w     http.ResponseWriter
+	r     *http.Request
+	user  *User             // nil for anonymous requests
+	token *Token            // nil for requests without a bearer token
+	vars  map[string]string // The variables of the path
+	body  interface{}       // The decoded body, a pointer to the Request of the route
+}
+
+// apiHandler handles a request to the v2 api.
+// Returns the body of the answer, nil for none, or an error.
+type apiHandler func(c *apiCall) (interface{}, error)
+
+// A parameter of a route besides the variables of the path.
+type apiParam struct {
+	Name        string
+	In          string // query or header
+	Description string
+}
+
+// An endpoint of the v2 api. Both the routes and the openapi document are set
+// up from apiRoutes, so they can't disagree.
+type apiRoute struct {
+	Name     string // Operation id in the openapi document
+	Method   string
+	Path     string // Below /api/v2, with the variables in braces
+	Summary  string
+	Scope    string // The scope tokens need
+	Login    bool   // Refuse anonymous requests
+	Rate     string // The rate limit class
+	Params   []apiParam
+	Request  interface{} // Zero value of the body, nil for none
+	Response interface{} // Zero value of the answer, nil for none
+	Status   int         // Status of successful requests
+	Handler  apiHandler
+}
+
+// The delkey lets anyone change or delete a paste,
+var deleteKeyParam = apiParam{Name: deleteKeyHeader, In: "header",
+	Description: "The delete key of the paste, not needed by the owner and team editors"}
+
+// The endpoints of the v2 api,
+var apiRoutes = []apiRoute{
+	{Name: "createPaste", Method: "POST", Path: "/pastes", Summary: "Create a paste",
+		Scope: scopeWrite, Rate: rateCreate, Request: APIPasteInput{}, Response: APIPaste{},
+		Status: http.StatusCreated, Handler: apiCreatePaste},
+	{Name: "listPastes", Method: "GET", Path: "/pastes",
+		Summary: "List the pastes of the user, or of a team",
+		Scope:   scopeRead, Login: true, Rate: rateRead,
+		Params: []apiParam{{Name: "team", In: "query",
+			Description: "Id of the team to list the pastes of"}},
+		Response: APIPasteList{}, Status: http.StatusOK, Handler: apiListPastes},
+	{Name: "getPaste", Method: "GET", Path: "/pastes/{pasteId}", Summary: "Get a paste",
+		Scope: scopeRead, Rate: rateRead, Response: APIPaste{}, Status: http.StatusOK,
+		Handler: apiGetPaste},
+	{Name: "updatePaste", Method: "PATCH", Path: "/pastes/{pasteId}",
+		Summary: "Change the title or content of a paste, keeping the former version as a revision",
+		Scope:   scopeWrite, Rate: rateCreate, Params: []apiParam{deleteKeyParam},
+		Request: APIPasteUpdate{}, Response: APIPaste{}, Status: http.StatusOK,
+		Handler: apiUpdatePaste},
+	{Name: "deletePaste", Method: "DELETE", Path: "/pastes/{pasteId}", Summary: "Delete a paste",
+		Scope: scopeDelete, Rate: rateCreate, Params: []apiParam{deleteKeyParam},
+		Status: http.StatusNoContent, Handler: apiDeletePaste},
+	{Name: "highlightPaste", Method: "GET", Path: "/pastes/{pasteId}/highlighted",
+		Summary: "Get a paste run through the highlighter",
+		Scope:   scopeRead, Rate: rateRender,
+		Params: []apiParam{
+			{Name: "lang", In: "query", Description: "Lexer to use, autodetected if left out"},
+			{Name: "style", In: "query", Description: "Style to use"}},
+		Response: APIHighlight{}, Status: http.StatusOK, Handler: apiHighlightPaste},
+	{Name: "reportPaste", Method: "POST", Path: "/pastes/{pasteId}/reports",
+		Summary: "Report a paste to the admins",
+		Scope:   scopeRead, Rate: rateCreate, Request: ReportRequest{},
+		Status: http.StatusNoContent, Handler: apiReportPaste},
+	{Name: "listRevisions", Method: "GET", Path: "/pastes/{pasteId}/revisions",
+		Summary: "List the versions of a paste, oldest first",
+		Scope:   scopeRead, Rate: rateRead, Response: APIRevisionList{}, Status: http.StatusOK,
+		Handler: apiListRevisions},
+	{Name: "getRevision", Method: "GET", Path: "/pastes/{pasteId}/revisions/{revision}",
+		Summary: "Get a version of a paste",
+		Scope:   scopeRead, Rate: rateRead, Response: APIRevision{}, Status: http.StatusOK,
+		Handler: apiGetRevision},
+	{Name: "getCurrentUser", Method: "GET", Path: "/users/me", Summary: "Get the user of the request",
+		Scope: scopeRead, Login: true, Rate: rateRead, Response: APIUser{}, Status: http.StatusOK,
+		Handler: apiGetCurrentUser},
+	{Name: "listTokens", Method: "GET", Path: "/tokens", Summary: "List the api tokens of the user",
+		Scope: scopeTokens, Login: true, Rate: rateRead, Response: APITokenList{},
+		Status: http.StatusOK, Handler: apiListTokens},
+	{Name: "createToken", Method: "POST", Path: "/tokens",
+		Summary: "Create an api token, tokens can only create tokens with their own scopes and team",
+		Scope:   scopeTokens, Login: true, Rate: rateCreate, Request: APITokenInput{},
+		Response: APIToken{}, Status: http.StatusCreated, Handler: apiCreateToken},
+	{Name: "revokeToken", Method: "DELETE", Path: "/tokens/{tokenId}", Summary: "Revoke an api token",
+		Scope: scopeTokens, Login: true, Rate: rateCreate, Status: http.StatusNoContent,
+		Handler: apiRevokeToken},
+}
+
+// registerAPIv2 adds the routes of the v2 api and its openapi document to the
+// router.
+func registerAPIv2(router *mux.Router) {
+
+	doc, err := json.MarshalIndent(openAPIDocument(), "", "  ")
+	checkErr(err)
+
+	api := router.PathPrefix("/api/v2").Subrouter()
+	api.HandleFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc)
+	}).Methods("GET")
+
+	for _, route := range apiRoutes {
+		api.HandleFunc(route.Path, rateLimited(route.Rate, route.serve)).Methods(route.Method)
+	}
+}
+
+// serve authenticates a request to the route, decodes its body and answers it
+// with the result of the handler.
+func (route apiRoute) serve(w http.ResponseWriter, r *http.Request) {
+
+	u, t, err := requestUser(r, route.Scope)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	if route.Login && u == nil {
+		sendError(w, r, newError(http.StatusUnauthorized, codeAuthRequired))
+		return
+	}
+
+	c := &apiCall{w: w, r: r, user: u, token: t, vars: mux.Vars(r)}
+	if route.Request != nil {
+		c.body = reflect.New(reflect.TypeOf(route.Request)).Interface()
+		err := json.NewDecoder(r.Body).Decode(c.body)
+		if err != nil {
+			sendError(w, r, newError(http.StatusBadRequest, codeInvalidRequest, err.Error()))
+			return
+		}
+	}
+
+	body, err := route.Handler(c)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	if body == nil {
+		w.WriteHeader(route.Status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(route.Status)
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		loggy("Could not send json : " + err.Error())
+	}
+}
+
+// deprecatedAPI marks the answers of the v1 api as deprecated, pointing at
+// the v2 api.
+func deprecatedAPI(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "</api/v2/openapi.json>; rel=\"successor-version\"")
+		h(w, r)
+	}
+}
+
+// apiPasteColumns are the columns scanned by scanAPIPaste, in order.
+const apiPasteColumns = "id, title, data, teamid, created_at, updated_at, expiry, quarantined, burn"
+
+// scanAPIPaste scans a row selected with apiPasteColumns into an APIPaste,
+// with the content if content is true.
+func scanAPIPaste(scan func(dest ...interface{}) error, content bool) APIPaste {
+
+	var p APIPaste
+	var data string
+	var teamId, createdAt, updatedAt sql.NullInt64
+	var expiry int64
+	var quarantined, burn int
+
+	err := scan(&p.Id, &p.Title, &data, &teamId, &createdAt, &updatedAt, &expiry, &quarantined,
+		&burn)
+	checkErr(err)
+
+	data = html.UnescapeString(data)
+	p.Title = html.UnescapeString(p.Title)
+	if content {
+		p.Content = data
+	}
+	p.Size = len(data)
+	p.Url = configuration.Address + "/p/" + p.Id
+	p.RawUrl = configuration.Address + "/raw/" + p.Id
+	p.Team = teamId.Int64
+	p.CreatedAt = createdAt.Int64
+	p.UpdatedAt = updatedAt.Int64
+	p.ExpiresAt = expiry
+	p.Quarantined = quarantined != 0
+	p.Burn = burn != 0
+	p.Revision = countRevisions(p.Id) + 1
+
+	return p
+}
+
+// getAPIPaste gets a paste the user can see, with its content.
+// Returns an error if the paste doesn't exist or can't be seen by the user.
+func getAPIPaste(pasteId string, u *User) (*APIPaste, error) {
+
+	// getPaste decides who can see the paste,
+	_, err := getPaste(pasteId, u)
+	if err != nil {
+		return nil, err
+	}
+
+	row := dbHandle.QueryRow("select "+apiPasteColumns+" from "+configuration.DBTable+
+		" where id="+configuration.DBPlaceHolder[0], pasteId)
+	p := scanAPIPaste(row.Scan, true)
+
+	if !isAdmin(u) {
+		p.Quarantined = false
+	}
+	return &p, nil
+}
+
+// apiCreatePaste creates a paste owned by the user of the request.
+func apiCreatePaste(c *apiCall) (interface{}, error) {
+
+	in := c.body.(*APIPasteInput)
+	res, err := submitPaste(c.w, c.r, Request{
+		Title:  in.Title,
+		Paste:  in.Content,
+		Expiry: in.ExpiresIn,
+		Team:   in.Team,
+		Burn:   in.Burn,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := getAPIPaste(res.Id, c.user)
+	if err != nil {
+		return nil, err
+	}
+
+	p.DeleteKey = res.DelKey
+	if res.Code == codeSecretsFound || res.Code == codeSecretsRedacted {
+		p.Warning = res.Status
+	}
+
+	c.w.Header().Set("Location", configuration.Address+"/api/v2/pastes/"+p.Id)
+	return p, nil
+}
+
+// apiListPastes lists the personal pastes of the user, or the pastes of a team
+// the user is in. Team tokens list the pastes of their team.
+func apiListPastes(c *apiCall) (interface{}, error) {
+
+	teamId := c.user.Team
+	if teamId == 0 && c.r.URL.Query().Get("team") != "" {
+		var err error
+		teamId, err = strconv.ParseInt(c.r.URL.Query().Get("team"), 10, 64)
+		if err != nil {
+			return nil, newError(http.StatusBadRequest, codeInvalidField, "team")
+		}
+	}
+
+	var rows *sql.Rows
+	var err error
+	if teamId != 0 {
+		if !hasTeamRole(c.user, teamId, teamViewer) {
+			return nil, newError(http.StatusForbidden, codeNotTeamMember)
+		}
+		rows, err = dbHandle.Query("select "+apiPasteColumns+" from "+configuration.DBTable+
+			" where teamid="+configuration.DBPlaceHolder[0]+" and quarantined=0 and "+
+			"(expiry is NULL or expiry=0 or expiry>"+configuration.DBPlaceHolder[1]+
+			") order by created_at desc", teamId, time.Now().Unix())
+	} else {
+		rows, err = dbHandle.Query("select "+apiPasteColumns+" from "+configuration.DBTable+
+			" where ownerid="+configuration.DBPlaceHolder[0]+
+			" and teamid is NULL order by created_at desc", c.user.Id)
+	}
+	checkErr(err)
+	defer rows.Close()
+
+	list := APIPasteList{Items: []APIPaste{}}
+	for rows.Next() {
+		list.Items = append(list.Items, scanAPIPaste(rows.Scan, false))
+	}
+
+	return list, nil
+}
+
+// apiGetPaste gets a paste with its content.
+func apiGetPaste(c *apiCall) (interface{}, error) {
+
+	p, err := getAPIPaste(c.vars["pasteId"], c.user)
+	if err != nil {
+		return nil, err
+	}
+	burnAfterReading(p.Id, Response{Burn: p.Burn}, c.user)
+
+	return p, nil
+}
+
+// apiUpdatePaste changes the title or the content of a paste. The former
+// version is kept as a revision.
+func apiUpdatePaste(c *apiCall) (interface{}, error) {
+
+	pasteId := c.vars["pasteId"]
+	in := c.body.(*APIPasteUpdate)
+
+	err := checkPasteChange(c.r, c.user, pasteId, c.r.Header.Get(deleteKeyHeader),
+		"change this paste")
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := getAPIPaste(pasteId, c.user)
+	if err != nil {
+		return nil, err
+	}
+
+	title, content := p.Title, p.Content
+	if in.Title != nil {
+		title = *in.Title
+	}
+	if in.Content != nil {
+		content = *in.Content
+	}
+
+	// Nothing changed, no need for a revision,
+	if title == p.Title && content == p.Content {
+		return p, nil
+	}
+
+	content, code, names, err := checkPasteContent(remoteIP(c.r), c.user, title, content, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if title == "" {
+		title = pasteId
+	}
+	updatePaste(pasteId, title, content)
+
+	p, err = getAPIPaste(pasteId, c.user)
+	if err != nil {
+		return nil, err
+	}
+	if code != codePasteSaved {
+		p.Warning = statusText(c.r, code, names)
+	}
+
+	return p, nil
+}
+
+// apiDeletePaste deletes a paste.
+func apiDeletePaste(c *apiCall) (interface{}, error) {
+	return nil, removePaste(c.r, c.user, c.vars["pasteId"], c.r.Header.Get(deleteKeyHeader))
+}
+
+// apiHighlightPaste runs a paste through the highlighter.
+func apiHighlightPaste(c *apiCall) (interface{}, error) {
+
+	p, err := getPaste(c.vars["pasteId"], c.user)
+	if err != nil {
+		return nil, err
+	}
+
+	burnAfterReading(c.vars["pasteId"], p, c.user)
+
+	var h APIHighlight
+	h.Html, h.Message, h.Lang, h.Style = high(p.Paste, c.r.URL.Query().Get("lang"),
+		c.r.URL.Query().Get("style"))
+
+	return h, nil
+}
+
+// apiReportPaste reports a paste.
+func apiReportPaste(c *apiCall) (interface{}, error) {
+	return nil, reportPaste(c.r, c.user, c.vars["pasteId"], *c.body.(*ReportRequest))
+}
+
+// apiRevisions lists the versions of a paste the user can see, the current
+// version last.
+func apiRevisions(pasteId string, u *User) ([]APIRevision, error) {
+
+	p, err := getAPIPaste(pasteId, u)
+	if err != nil {
+		return nil, err
+	}
+
+	// The versions of a paste that burns after reading would give it away
+	// without burning it, so only its owner sees them,
+	if p.Burn && !isPasteOwner(pasteId, u) {
+		loggy("Requested paste burns after reading, not showing its revisions.")
+		return nil, newError(http.StatusNotFound, codeNotFound)
+	}
+
+	var revisions []APIRevision
+	for _, v := range getRevisions(pasteId) {
+		revisions = append(revisions, APIRevision{
+			Revision:  v.Revision,
+			Title:     v.Title,
+			Content:   v.Paste,
+			Size:      len(v.Paste),
+			CreatedAt: v.CreatedAt,
+		})
+	}
+
+	current := APIRevision{
+		Revision:  p.Revision,
+		Title:     p.Title,
+		Content:   p.Content,
+		Size:      p.Size,
+		CreatedAt: p.CreatedAt,
+		Current:   true,
+	}
+	if p.UpdatedAt != 0 {
+		current.CreatedAt = p.UpdatedAt
+	}
+
+	return append(revisions, current), nil
+}
+
+// apiListRevisions lists the versions of a paste, without their content.
+func apiListRevisions(c *apiCall) (interface{}, error) {
+
+	revisions, err := apiRevisions(c.vars["pasteId"], c.user)
+	if err != nil {
+		return nil, err
+	}
+
+	list := APIRevisionList{Items: []APIRevision{}}
+	for _, v := range revisions {
+		v.Content = ""
+		list.Items = append(list.Items, v)
+	}
+
+	return list, nil
+}
+
+// apiGetRevision gets a version of a paste with its content.
+func apiGetRevision(c *apiCall) (interface{}, error) {
+
+	revision, err := strconv.Atoi(c.vars["revision"])
+	if err != nil {
+		return nil, newError(http.StatusNotFound, codeNoSuchRevision)
+	}
+
+	revisions, err := apiRevisions(c.vars["pasteId"], c.user)
+	if err != nil {
+		return nil, err
+	}
+
+	if revision < 1 || revision > len(revisions) {
+		return nil, newError(http.StatusNotFound, codeNoSuchRevision)
+	}
+
+	return revisions[revision-1], nil
+}
+
+// apiGetCurrentUser gets the user of the request with the teams of the user.
+func apiGetCurrentUser(c *apiCall) (interface{}, error) {
+
+	u := c.user
+	res := APIUser{
+		Id:        u.Id,
+		Email:     u.Email,
+		Name:      u.Name(),
+		Role:      u.Role,
+		Locale:    u.Locale,
+		CreatedAt: u.CreatedAt,
+		Team:      u.Team,
+		Teams:     []APITeam{},
+	}
+
+	for _, t := range getUserTeams(u.Id) {
+		res.Teams = append(res.Teams, APITeam{Id: t.Id, Name: t.Name, Role: t.Role})
+	}
+
+	return res, nil
+}
+
+// newAPIToken returns the api view of a token.
+func newAPIToken(t Token) APIToken {
+	return APIToken{
+		Id:         t.Id,
+		Name:       html.UnescapeString(t.Name),
+		Scopes:     t.Scopes,
+		Team:       t.TeamId,
+		CreatedAt:  t.CreatedAt,
+		LastUsedAt: t.LastUsed,
+	}
+}
+
+// apiListTokens lists the api tokens of the user.
+func apiListTokens(c *apiCall) (interface{}, error) {
+
+	list := APITokenList{Items: []APIToken{}}
+	for _, t := range getUserTokens(c.user.Id) {
+		list.Items = append(list.Items, newAPIToken(t))
+	}
+
+	return list, nil
+}
+
+// apiCreateToken creates an api token for the user. A token can't create
+// tokens with scopes it hasn't got, or for another team than its own.
+func apiCreateToken(c *apiCall) (interface{}, error) {
+
+	in := c.body.(*APITokenInput)
+
+	name := html.EscapeString(strings.TrimSpace(in.Name))
+	if name == "" || len(name) > 255 {
+		return nil, newError(http.StatusBadRequest, codeInvalidField, "name")
+	}
+
+	scopes := parseScopes(in.Scopes)
+	if len(scopes) == 0 || len(scopes) != len(in.Scopes) {
+		return nil, newError(http.StatusBadRequest, codeInvalidField, "scopes")
+	}
+
+	if in.Team != 0 && getTeamRole(in.Team, c.user.Id) == "" {
+		return nil, newError(http.StatusForbidden, codeNotTeamMember)
+	}
+
+	if c.token != nil {
+		for _, s := range scopes {
+			if !c.token.HasScope(s) {
+				return nil, newError(http.StatusForbidden, codeMissingScope, s)
+			}
+		}
+		if c.token.TeamId != 0 && in.Team != c.token.TeamId {
+			return nil, newError(http.StatusForbidden, codeNotTeamMember)
+		}
+	}
+
+	raw := createToken(c.user.Id, name, scopes, in.Team)
+
+	// Not looked up with getToken, which would mark it as used,
+	t := Token{UserId: c.user.Id, TeamId: in.Team, Name: name, Scopes: scopes}
+	err := dbHandle.QueryRow("select id, created_at from "+configuration.DBTokensTable+
+		" where hash="+configuration.DBPlaceHolder[0], hashToken(raw)).Scan(&t.Id,
+		&t.CreatedAt)
+	checkErr(err)
+
+	res := newAPIToken(t)
+	res.Token = raw
+	c.w.Header().Set("Location", configuration.Address+"/api/v2/tokens/"+
+		strconv.FormatInt(t.Id, 10))
+
+	return res, nil
+}
+
+// apiRevokeToken revokes an api token of the user.
+func apiRevokeToken(c *apiCall) (interface{}, error) {
+
+	tokenId, err := strconv.ParseInt(c.vars["tokenId"], 10, 64)
+	if err != nil || !delUserToken(c.user.Id, tokenId) {
+		return nil, newError(http.StatusNotFound, codeNoSuchToken)
+	}
+
+	loggy(fmt.Sprintf("Revoked token %d of user %d at %s.", tokenId, c.user.Id,
+		time.Now().Format("2006-01-02 15:04:05")))
+	return nil, nil
+}
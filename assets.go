@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The templates, stylesheet, prioritized lexers and the front-end libraries
+// (fetched with make vendor), built into the binary so it runs from anywhere.
+//
+//go:embed assets
+var embeddedFS embed.FS
+
+// Hashes of the assets, computed the first time they are linked or served,
+var assetHashes = make(map[string]string)
+var assetHashesLock sync.Mutex
+
+// The assets are cached for a year when the url carries their hash,
+const assetMaxAge = 365 * 24 * time.Hour
+
+// overrideFS looks up files in the assets directory of the configuration
+// first, and falls back to the embedded ones.
+type overrideFS struct {
+	dir      string
+	embedded fs.FS
+}
+
+// Open opens the overriding file if there is one, the embedded one if not.
+func (o overrideFS) Open(name string) (fs.File, error) {
+	if o.dir != "" {
+		f, err := os.DirFS(o.dir).Open(name)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return o.embedded.Open(name)
+}
+
+// assetsFS returns the assets, with the files in assetsdir replacing the
+// embedded ones.
+func assetsFS() fs.FS {
+	embedded, err := fs.Sub(embeddedFS, "assets")
+	checkErr(err)
+	return overrideFS{dir: configuration.AssetsDir, embedded: embedded}
+}
+
+// loadTemplates parses the embedded templates, then the template set of the
+// theme and the ones in assetsdir so they replace the embedded templates with
+// the same name.
+func loadTemplates() *template.Template {
+
+	t := template.Must(template.New("").Funcs(template.FuncMap{
+		"asset": assetUrl,
+	}).Funcs(templateFuncs(sourceLocale)).ParseFS(embeddedFS, "assets/*.html"))
+
+	// The template set of the theme replaces the built-in templates, those
+	// it lacks are kept,
+	if pattern := themeTemplates(); pattern != "" {
+		var err error
+		t, err = t.ParseFS(assetsFS(), pattern)
+		if err != nil {
+			debugLogger.Println("   Config error : theme " + configuration.Theme + " : " + err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if configuration.AssetsDir != "" {
+		files, err := filepath.Glob(filepath.Join(configuration.AssetsDir, "*.html"))
+		checkErr(err)
+		if len(files) > 0 {
+			loggy("Overriding templates " + strings.Join(files, ", "))
+			t = template.Must(t.ParseFiles(files...))
+		}
+	}
+
+	return t
+}
+
+// checkVendoredAssets tells about the front-end libraries of
+// vendor/files.txt that weren't fetched with make vendor before building,
+// the pages don't work without them.
+func checkVendoredAssets() {
+
+	f, err := assetsFS().Open("vendor/files.txt")
+	if err != nil {
+		debugLogger.Println("   Warning : vendor/files.txt is missing from the assets")
+		return
+	}
+	defer f.Close()
+
+	var missing []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if _, err := fs.Stat(assetsFS(), "vendor/"+fields[0]); err != nil {
+			missing = append(missing, fields[0])
+		}
+	}
+	checkErr(scanner.Err())
+
+	if len(missing) > 0 {
+		debugLogger.Println("   Warning : the front-end libraries " + strings.Join(missing, ", ") +
+			" are missing, run make vendor and build again")
+	}
+}
+
+// assetHash returns a short hash of the content of an asset.
+// Returns an empty string if there is no such asset.
+func assetHash(name string) string {
+
+	assetHashesLock.Lock()
+	defer assetHashesLock.Unlock()
+
+	if hash, ok := assetHashes[name]; ok {
+		return hash
+	}
+
+	f, err := assetsFS().Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return ""
+	}
+
+	assetHashes[name] = hex.EncodeToString(h.Sum(nil))[:12]
+	return assetHashes[name]
+}
+
+// assetUrl returns the url of an asset, carrying its hash so browsers fetch it
+// again when it changes. Used as asset in the templates.
+func assetUrl(name string) string {
+
+	hash := assetHash(name)
+	if hash == "" {
+		loggy("Linking to missing asset " + name)
+		return "/assets/" + name
+	}
+
+	return "/assets/" + name + "?v=" + hash
+}
+
+// serveAsset serves the stylesheet and the front-end libraries. Urls with the
+// current hash of the asset are cached for good, others have to be checked
+// with the etag.
+func serveAsset(w http.ResponseWriter, r *http.Request) {
+
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/assets/")
+
+	// The templates and the lexer list are no business of browsers,
+	if !fs.ValidPath(name) || strings.HasSuffix(name, ".html") || name == "prio-lexers" {
+		notFoundHandler(w, r)
+		return
+	}
+
+	f, err := assetsFS().Open(name)
+	if err != nil {
+		notFoundHandler(w, r)
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil || stat.IsDir() {
+		notFoundHandler(w, r)
+		return
+	}
+
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		sendError(w, r, internalError(errors.New("asset "+name+" can't be served")))
+		return
+	}
+
+	hash := assetHash(name)
+	w.Header().Set("ETag", `"`+hash+`"`)
+	if r.URL.Query().Get("v") == hash {
+		w.Header().Set("Cache-Control", "public, max-age="+
+			strconv.FormatInt(int64(assetMaxAge.Seconds()), 10)+", immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+
+	http.ServeContent(w, r, name, stat.ModTime(), content)
+}
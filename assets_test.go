@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServeAssetCachesHashedUrls(t *testing.T) {
+
+	setupTest(t)
+
+	hash := assetHash("pastebin.css")
+	if len(hash) != 12 || assetUrl("pastebin.css") != "/assets/pastebin.css?v="+hash {
+		t.Fatalf("pastebin.css is linked as %s", assetUrl("pastebin.css"))
+	}
+	if url := assetUrl("missing.js"); url != "/assets/missing.js" {
+		t.Errorf("a missing asset is linked as %s", url)
+	}
+
+	for _, tc := range []struct {
+		target string
+		etag   string
+		status int
+		cache  string
+	}{
+		{"/assets/pastebin.css?v=" + hash, "", 200, "public, max-age=31536000, immutable"},
+		{"/assets/pastebin.css", "", 200, "no-cache"},
+		{"/assets/pastebin.css?v=old", "", 200, "no-cache"},
+		{"/assets/pastebin.css", `"` + hash + `"`, 304, "no-cache"},
+		{"/assets/index.html", "", 404, ""},
+		{"/assets/prio-lexers", "", 404, ""},
+		{"/assets/locales", "", 404, ""},
+		{"/assets/missing.js", "", 404, ""},
+		{"/assets/../pastebin.go", "", 404, ""},
+	} {
+		r := httptest.NewRequest("GET", tc.target, nil)
+		if tc.etag != "" {
+			r.Header.Set("If-None-Match", tc.etag)
+		}
+		w := httptest.NewRecorder()
+		serveAsset(w, r)
+
+		if w.Code != tc.status || w.Header().Get("Cache-Control") != tc.cache {
+			t.Errorf("%s answered %d with Cache-Control %q", tc.target, w.Code,
+				w.Header().Get("Cache-Control"))
+		}
+	}
+}
+
+func TestAssetsDirReplacesEmbeddedAssets(t *testing.T) {
+
+	setupTest(t)
+	configuration.AssetsDir = t.TempDir()
+
+	css := "body { color: red }\n"
+	err := ioutil.WriteFile(filepath.Join(configuration.AssetsDir, "pastebin.css"), []byte(css), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(css))
+
+	for _, tc := range []struct {
+		name string
+		want string
+	}{
+		{"pastebin.css", css},
+		{"prio-lexers", ""},
+	} {
+		f, err := assetsFS().Open(tc.name)
+		if err != nil {
+			t.Fatalf("%s : %v", tc.name, err)
+		}
+		data, _ := ioutil.ReadAll(f)
+		f.Close()
+
+		if tc.want != "" && string(data) != tc.want || tc.want == "" && len(data) == 0 {
+			t.Errorf("%s wasn't taken from the right place", tc.name)
+		}
+	}
+
+	if url := assetUrl("pastebin.css"); !strings.HasSuffix(url, "?v="+hex.EncodeToString(sum[:])[:12]) {
+		t.Errorf("the overriding stylesheet is linked as %s", url)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authenticator checks the credentials entered in the login form.
+// Returns the user if the credentials are valid, nil if they aren't and an
+// error if the authenticator itself failed.
+type Authenticator interface {
+	Authenticate(login string, password string) (*User, error)
+}
+
+// localAuthenticator checks the bcrypt password in the users table.
+type localAuthenticator struct{}
+
+// The authenticators tried in order by loginHandler, set up in main.
+var authenticators []Authenticator
+
+// newAuthenticators creates the authenticators selected in the configuration.
+func newAuthenticators() []Authenticator {
+
+	names := configuration.Authenticators
+	if len(names) == 0 {
+		names = []string{"local"}
+	}
+
+	var list []Authenticator
+	for _, name := range names {
+		switch name {
+		case "local":
+			list = append(list, localAuthenticator{})
+		case "ldap":
+			list = append(list, newLDAPAuthenticator())
+		default:
+			debugLogger.Println("   Config error : Specified authenticator (" +
+				name + ") not supported.")
+			os.Exit(1)
+		}
+		loggy("Using authenticator " + name)
+	}
+
+	return list
+}
+
+// authenticate tries the authenticators in order until one accepts the
+// credentials. A failing authenticator is logged and skipped.
+// Returns nil if no authenticator accepted the credentials.
+func authenticate(login string, password string) *User {
+
+	for _, a := range authenticators {
+		u, err := a.Authenticate(login, password)
+		if err != nil {
+			debugLogger.Println(fmt.Sprintf("   Authenticator error : %T : %s", a, err))
+			continue
+		}
+		if u != nil {
+			return u
+		}
+	}
+
+	return nil
+}
+
+// Authenticate compares the bcrypt hash to the password.
+func (localAuthenticator) Authenticate(login string, password string) (*User, error) {
+
+	u := getUserByEmail(html.EscapeString(login))
+	if u == nil {
+		loggy(fmt.Sprintf("Account '%s' does not exist.", login))
+		return nil, nil
+	}
+
+	err := bcrypt.CompareHashAndPassword(getUserPassword(u.Id), []byte(password))
+	if err != nil {
+		loggy(fmt.Sprintf("Wrong password for account '%s'.", login))
+		return nil, nil
+	}
+
+	return u, nil
+}
+
+// confirmPassword checks the password of the user before a sensitive action.
+// The directory checks the password of its accounts, and accounts of the
+// identity provider don't have one, they sign in there again instead.
+func confirmPassword(r *http.Request, u *User, password string) bool {
+
+	switch u.AuthSource {
+	case authOIDC:
+		return oidcReauthenticated(r, u)
+	case authLDAP:
+		for _, a := range authenticators {
+			if l, ok := a.(*ldapAuthenticator); ok {
+				ok, err := l.checkPassword(u, password)
+				if err != nil {
+					debugLogger.Println(fmt.Sprintf("   Authenticator error : %T : %s", l, err))
+				}
+				return ok
+			}
+		}
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword(getUserPassword(u.Id), []byte(password)) == nil
+}
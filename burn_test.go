@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// setupBurn saves a paste of alice that burns after reading, with a
+// highlighter that returns the paste as it is.
+// Returns the paste and alice.
+func setupBurn(t *testing.T) (Response, *User) {
+
+	setupTest(t)
+
+	configuration.Highlighter = filepath.Join(t.TempDir(), "highlighter")
+	err := ioutil.WriteFile(configuration.Highlighter, []byte("#!/bin/sh\ncat\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := createUser("alice@example.com", "", []byte(""))
+	return savePaste("secret", "read me once", 0, alice.Id, 0, true), alice
+}
+
+// serveWeb runs a handler of the web interface for the paste.
+func serveWeb(h http.HandlerFunc, method, pasteId string) *httptest.ResponseRecorder {
+	r := mux.SetURLVars(httptest.NewRequest(method, "/p/"+pasteId, nil),
+		map[string]string{"pasteId": pasteId})
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+// serveAPIv2 runs a request to the v2 api.
+func serveAPIv2(path string) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	registerAPIv2(router)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v2"+path, nil))
+	return w
+}
+
+// burned returns true if the paste is gone.
+func burned(pasteId string) bool {
+	_, err := getPaste(pasteId, nil)
+	e, ok := err.(*RequestError)
+	return ok && e.Code == codeNotFound
+}
+
+func TestBurnAfterReadingOnEveryReadPath(t *testing.T) {
+
+	reads := map[string]func(pasteId string) *httptest.ResponseRecorder{
+		"page": func(id string) *httptest.ResponseRecorder {
+			return serveWeb(pasteHandler, "GET", id)
+		},
+		"raw": func(id string) *httptest.ResponseRecorder {
+			return serveWeb(RawHandler, "GET", id)
+		},
+		"download": func(id string) *httptest.ResponseRecorder {
+			return serveWeb(DownloadHandler, "GET", id)
+		},
+		"clone": func(id string) *httptest.ResponseRecorder {
+			return serveWeb(CloneHandler, "GET", id)
+		},
+		"api v1": func(id string) *httptest.ResponseRecorder {
+			return serveWeb(APIHandler, "POST", id)
+		},
+		"api v2": func(id string) *httptest.ResponseRecorder {
+			return serveAPIv2("/pastes/" + id)
+		},
+		"api v2 highlighted": func(id string) *httptest.ResponseRecorder {
+			return serveAPIv2("/pastes/" + id + "/highlighted")
+		},
+	}
+
+	for name, read := range reads {
+		t.Run(name, func(t *testing.T) {
+
+			p, _ := setupBurn(t)
+
+			w := read(p.Id)
+			if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "read me once") {
+				t.Fatalf("the first read answered %d : %s", w.Code, w.Body.String())
+			}
+			if !burned(p.Id) {
+				t.Fatal("the paste is still there after being read")
+			}
+
+			if w = read(p.Id); w.Code != http.StatusNotFound {
+				t.Errorf("the second read answered %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestBurnAfterReadingHidesRevisions(t *testing.T) {
+
+	p, alice := setupBurn(t)
+
+	for _, path := range []string{"/revisions", "/revisions/1"} {
+		w := serveAPIv2("/pastes/" + p.Id + path)
+		if w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "read me once") {
+			t.Errorf("%s answered %d : %s", path, w.Code, w.Body.String())
+		}
+	}
+	if burned(p.Id) {
+		t.Fatal("listing the revisions burned the paste")
+	}
+
+	// The owner sees them, and reads without burning the paste,
+	revisions, err := apiRevisions(p.Id, alice)
+	if err != nil || len(revisions) != 1 || revisions[0].Content != "read me once" {
+		t.Fatalf("the owner got the revisions %+v, %v", revisions, err)
+	}
+
+	read, err := getPaste(p.Id, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	burnAfterReading(p.Id, read, alice)
+	if burned(p.Id) {
+		t.Error("reading its own paste burned it")
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The subcommands of the client mode,
+var clientCommands = map[string]func(c *Client, args []string) error{
+	"put": clientPut,
+	"get": clientGet,
+	"rm":  clientRm,
+	"ls":  clientLs,
+}
+
+// ClientConfig is the config file of the client mode, in the config
+// directory of the user.
+type ClientConfig struct {
+	Server string `json:"server"` // Address of the pastebin, like https://paste.example.com
+	Token  string `json:"token"`  // Api token, empty to paste anonymously
+}
+
+// HistoryEntry is a paste created with the client, kept in the history file
+// so it can be deleted later.
+type HistoryEntry struct {
+	Id        string `json:"id"`
+	Url       string `json:"url"`
+	Title     string `json:"title"`
+	DeleteKey string `json:"delete_key"`
+	Server    string `json:"server"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// Client talks to the v2 api of a pastebin.
+type Client struct {
+	Config  ClientConfig
+	History string // Path of the history file
+	http    *http.Client
+}
+
+// isClientCommand returns true if the program is run as a client, with one of
+// the client subcommands.
+func isClientCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	_, ok := clientCommands[args[0]]
+	return ok
+}
+
+// runClient runs a client subcommand and exits, with 1 if it failed.
+func runClient(args []string) {
+
+	c, err := newClient()
+	if err == nil {
+		err = clientCommands[args[0]](c, args[1:])
+	}
+
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "pastebin : "+err.Error())
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// newClient reads the config file of the client. PASTEBIN_SERVER and
+// PASTEBIN_TOKEN override the file, and PASTEBIN_CONFIG points at another one.
+// Returns an error if the config file can't be read or no server is set.
+func newClient() (*Client, error) {
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Join(dir, "pastebin")
+
+	file := os.Getenv("PASTEBIN_CONFIG")
+	if file == "" {
+		file = filepath.Join(dir, "client.json")
+	}
+
+	c := &Client{
+		History: filepath.Join(dir, "history.json"),
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}
+
+	data, err := ioutil.ReadFile(file)
+	switch {
+	case err == nil:
+		err = json.Unmarshal(data, &c.Config)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse %s : %s", file, err)
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	if server := os.Getenv("PASTEBIN_SERVER"); server != "" {
+		c.Config.Server = server
+	}
+	if token := os.Getenv("PASTEBIN_TOKEN"); token != "" {
+		c.Config.Token = token
+	}
+
+	c.Config.Server = strings.TrimRight(c.Config.Server, "/")
+	if c.Config.Server == "" {
+		return nil, fmt.Errorf("no server set, add it to %s or set PASTEBIN_SERVER", file)
+	}
+
+	return c, nil
+}
+
+// do sends a request to the v2 api, with the token if there is one, and
+// decodes the json answer into out unless it's nil.
+// Returns the message of the api if the request failed.
+func (c *Client) do(method string, path string, header http.Header, in interface{}, out interface{}) error {
+
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.Config.Server+"/api/v2"+path, body)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Config.Token)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		var e APIError
+		if json.NewDecoder(res.Body).Decode(&e) != nil || e.Message == "" {
+			return fmt.Errorf("%s", res.Status)
+		}
+		return fmt.Errorf("%s", e.Message)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// readHistory reads the pastes created with the client, oldest first.
+func (c *Client) readHistory() ([]HistoryEntry, error) {
+
+	entries := []HistoryEntry{}
+
+	data, err := ioutil.ReadFile(c.History)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse %s : %s", c.History, err)
+	}
+
+	return entries, nil
+}
+
+// writeHistory replaces the history file, which is only readable by the user
+// since it holds the delete keys.
+func (c *Client) writeHistory(entries []HistoryEntry) error {
+
+	err := os.MkdirAll(filepath.Dir(c.History), 0700)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(c.History, data, 0600)
+}
+
+// pasteIdArg returns the id of a paste given as an id or as its url.
+func pasteIdArg(arg string) string {
+
+	u, err := url.Parse(arg)
+	if err != nil || u.Host == "" {
+		return arg
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i := 0; i < len(parts)-1; i++ {
+		if parts[i] == "p" || parts[i] == "raw" || parts[i] == "pastes" {
+			return parts[i+1]
+		}
+	}
+	return parts[len(parts)-1]
+}
+
+// clientPut creates a paste from each file given, or from stdin, and prints
+// the urls.
+func clientPut(c *Client, args []string) error {
+
+	fs := flag.NewFlagSet("put", flag.ContinueOnError)
+	title := fs.String("title", "", "title of the paste, the file name by default")
+	lang := fs.String("lang", "", "language to highlight the paste as, in the printed url")
+	expiry := fs.String("expiry", "", "delete the paste after this many seconds, or a duration like 90m")
+	burn := fs.Bool("burn", false, "delete the paste once it's read")
+	team := fs.Int64("team", 0, "id of the team to save the paste into")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : pastebin put [options] [file ...]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	expiresIn, err := parseExpiry(*expiry)
+	if err != nil {
+		return err
+	}
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	history, err := c.readHistory()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		var data []byte
+		name := ""
+		if file == "-" {
+			data, err = ioutil.ReadAll(bufio.NewReader(os.Stdin))
+		} else {
+			data, err = ioutil.ReadFile(file)
+			name = filepath.Base(file)
+		}
+		if err != nil {
+			return err
+		}
+
+		in := APIPasteInput{
+			Title:     *title,
+			Content:   string(data),
+			ExpiresIn: expiresIn,
+			Team:      *team,
+			Burn:      *burn,
+		}
+		if in.Title == "" && len(name) <= 50 {
+			in.Title = name
+		}
+
+		var p APIPaste
+		err = c.do("POST", "/pastes", nil, in, &p)
+		if err != nil {
+			return err
+		}
+
+		link := p.Url
+		if *lang != "" {
+			link += "/" + url.PathEscape(*lang)
+		}
+		fmt.Println(link)
+		if p.Warning != "" {
+			fmt.Fprintln(os.Stderr, p.Warning)
+		}
+
+		history = append(history, HistoryEntry{
+			Id:        p.Id,
+			Url:       p.Url,
+			Title:     p.Title,
+			DeleteKey: p.DeleteKey,
+			Server:    c.Config.Server,
+			CreatedAt: p.CreatedAt,
+		})
+	}
+
+	return c.writeHistory(history)
+}
+
+// clientGet prints the pastes given by id or url.
+func clientGet(c *Client, args []string) error {
+
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : pastebin get id|url ...")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no paste given")
+	}
+
+	for _, arg := range fs.Args() {
+		var p APIPaste
+		err := c.do("GET", "/pastes/"+url.PathEscape(pasteIdArg(arg)), nil, nil, &p)
+		if err != nil {
+			return err
+		}
+
+		fmt.Print(p.Content)
+		if !strings.HasSuffix(p.Content, "\n") {
+			fmt.Println()
+		}
+	}
+
+	return nil
+}
+
+// clientRm deletes the pastes given by id or url, with the delete key from the
+// history if there is one, and drops them from the history.
+func clientRm(c *Client, args []string) error {
+
+	fs := flag.NewFlagSet("rm", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : pastebin rm id|url ...")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no paste given")
+	}
+
+	history, err := c.readHistory()
+	if err != nil {
+		return err
+	}
+
+	for _, arg := range fs.Args() {
+		id := pasteIdArg(arg)
+
+		header := http.Header{}
+		for _, e := range history {
+			if e.Id == id && e.Server == c.Config.Server && e.DeleteKey != "" {
+				header.Set(deleteKeyHeader, e.DeleteKey)
+			}
+		}
+
+		err := c.do("DELETE", "/pastes/"+url.PathEscape(id), header, nil, nil)
+		if err != nil {
+			return fmt.Errorf("%s : %s", id, err)
+		}
+		fmt.Println("Deleted " + id)
+
+		kept := history[:0]
+		for _, e := range history {
+			if e.Id != id || e.Server != c.Config.Server {
+				kept = append(kept, e)
+			}
+		}
+		history = kept
+	}
+
+	return c.writeHistory(history)
+}
+
+// clientLs lists the pastes in the history, or the pastes of the user of the
+// token on the server.
+func clientLs(c *Client, args []string) error {
+
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	remote := fs.Bool("remote", false, "list the pastes of the token on the server instead of the history")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : pastebin ls [-remote]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	if *remote {
+		var list APIPasteList
+		err := c.do("GET", "/pastes", nil, nil, &list)
+		if err != nil {
+			return err
+		}
+		for _, p := range list.Items {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.Id,
+				time.Unix(p.CreatedAt, 0).Format("2006-01-02 15:04"), p.Url, p.Title)
+		}
+		return nil
+	}
+
+	history, err := c.readHistory()
+	if err != nil {
+		return err
+	}
+	for _, e := range history {
+		if e.Server != c.Config.Server {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.Id,
+			time.Unix(e.CreatedAt, 0).Format("2006-01-02 15:04"), e.Url, e.Title)
+	}
+	return nil
+}
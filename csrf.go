@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/subtle"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/dchest/uniuri"
+	"github.com/gorilla/securecookie"
+)
+
+// Where the csrf token is kept and sent back,
+const (
+	csrfCookie = "csrf"         // Signed cookie holding the token
+	csrfField  = "csrf_token"   // Hidden field of the forms
+	csrfHeader = "X-CSRF-Token" // Header of the ajax calls
+)
+
+// secureCookies returns true if the pastebin is served over https, so cookies
+// are only sent over https.
+func secureCookies() bool {
+	return strings.HasPrefix(configuration.Address, "https://")
+}
+
+// newCookie returns a cookie hidden from javascript and not sent along with
+// requests from other sites, apart from following links.
+func newCookie(name string, value string, path string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// csrfToken returns the csrf token of the browser, setting the csrf cookie if
+// it doesn't have one yet. Pages with forms pass it on to the template.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+
+	if token := getCSRFCookie(r); token != "" {
+		return token
+	}
+
+	token := uniuri.NewLen(32)
+	encoded, err := securecookie.EncodeMulti(csrfCookie, token, cookieCodecs...)
+	checkErr(err)
+
+	http.SetCookie(w, newCookie(csrfCookie, encoded, "/", int(sessionLifetime())))
+
+	// Later calls in the same request see the new token,
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: encoded})
+	return token
+}
+
+// getCSRFCookie decodes the csrf cookie of the request.
+// Returns an empty string if there is no valid cookie.
+func getCSRFCookie(r *http.Request) string {
+
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil {
+		return ""
+	}
+
+	var token string
+	err = securecookie.DecodeMulti(csrfCookie, cookie.Value, &token, cookieCodecs...)
+	if err != nil {
+		return ""
+	}
+
+	return token
+}
+
+// sameOrigin returns false if the request says it comes from another site.
+func sameOrigin(r *http.Request) bool {
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return true
+	}
+
+	o, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	if o.Host == r.Host {
+		return true
+	}
+	a, err := url.Parse(configuration.Address)
+	return err == nil && o.Host == a.Host
+}
+
+// csrfFormToken returns the token of a urlencoded form, the body being limited
+// by limitBody already. Other bodies aren't parsed, the pages send the header
+// with everything but their plain forms.
+func csrfFormToken(r *http.Request) string {
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/x-www-form-urlencoded" {
+		return ""
+	}
+
+	return r.PostFormValue(csrfField)
+}
+
+// csrfProtect makes sure requests changing something come from the pages of
+// the pastebin. Requests authenticated with an api token are exempt, as are
+// requests without any of our cookies since they can't act on behalf of a
+// user.
+func csrfProtect(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS", "TRACE":
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if getBearerToken(r) != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if !sameOrigin(r) {
+			loggy("Refused " + r.Method + " " + r.URL.Path + " from another site.")
+			sendError(w, r, newError(http.StatusForbidden, codeCrossSite))
+			return
+		}
+
+		_, errSession := r.Cookie("session")
+		_, errCSRF := r.Cookie(csrfCookie)
+		if errSession != nil && errCSRF != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		token := r.Header.Get(csrfHeader)
+		if token == "" {
+			token = csrfFormToken(r)
+		}
+
+		expected := getCSRFCookie(r)
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			loggy("Invalid csrf token for " + r.Method + " " + r.URL.Path + ".")
+			sendError(w, r, newError(http.StatusForbidden, codeInvalidCSRF))
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFProtection(t *testing.T) {
+
+	setupTest(t)
+
+	w := httptest.NewRecorder()
+	token := csrfToken(w, httptest.NewRequest("GET", "/", nil))
+	cookie := w.Result().Cookies()[0]
+	session := &http.Cookie{Name: "session", Value: "anything"}
+	form := url.Values{csrfField: {token}}.Encode()
+
+	for _, tc := range []struct {
+		name        string
+		method      string
+		cookies     []*http.Cookie
+		header      string
+		contentType string
+		body        string
+		origin      string
+		bearer      string
+		status      int
+	}{
+		{"get", "GET", []*http.Cookie{session}, "", "", "", "http://evil.example", "", 200},
+		{"no cookies", "POST", nil, "", "", "", "", "", 200},
+		{"header", "POST", []*http.Cookie{cookie}, token, "", "", "", "", 200},
+		{"form", "POST", []*http.Cookie{cookie}, "", "application/x-www-form-urlencoded", form, "", "", 200},
+		{"form with charset", "POST", []*http.Cookie{cookie}, "", "application/x-www-form-urlencoded; charset=utf-8", form, "", "", 200},
+		{"same origin", "POST", []*http.Cookie{cookie}, token, "", "", "http://pastebin.test", "", 200},
+		{"no token", "POST", []*http.Cookie{cookie}, "", "", "", "", "", 403},
+		{"wrong token", "DELETE", []*http.Cookie{cookie}, "wrong", "", "", "", "", 403},
+		{"session without csrf cookie", "POST", []*http.Cookie{session}, token, "", "", "", "", 403},
+		{"token in a multipart body", "POST", []*http.Cookie{cookie}, "", "multipart/form-data; boundary=x",
+			"--x\r\nContent-Disposition: form-data; name=\"csrf_token\"\r\n\r\n" + token + "\r\n--x--\r\n", "", "", 403},
+		{"token in a json body", "POST", []*http.Cookie{cookie}, "", "application/json", `{"csrf_token":"` + token + `"}`, "", "", 403},
+		{"other site", "POST", nil, "", "", "", "http://evil.example", "", 403},
+		{"other site with a token", "POST", []*http.Cookie{cookie}, token, "", "", "http://evil.example", "", 403},
+		{"other site by referer", "POST", nil, "", "", "", "referer http://evil.example/page", "", 403},
+		{"multipart with the header", "POST", []*http.Cookie{cookie}, token, "multipart/form-data; boundary=x",
+			"--x\r\nContent-Disposition: form-data; name=\"paste\"\r\n\r\ndata\r\n--x--\r\n", "", "", 200},
+		{"api token", "POST", []*http.Cookie{session}, "", "", "", "http://evil.example", "secret", 200},
+	} {
+		r := httptest.NewRequest(tc.method, "/save", strings.NewReader(tc.body))
+		for _, c := range tc.cookies {
+			r.AddCookie(c)
+		}
+		if tc.header != "" {
+			r.Header.Set(csrfHeader, tc.header)
+		}
+		if tc.contentType != "" {
+			r.Header.Set("Content-Type", tc.contentType)
+		}
+		if strings.HasPrefix(tc.origin, "referer ") {
+			r.Header.Set("Referer", strings.TrimPrefix(tc.origin, "referer "))
+		} else if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if tc.bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.bearer)
+		}
+
+		body := ""
+		w := httptest.NewRecorder()
+		csrfProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			data, _ := ioutil.ReadAll(r.Body)
+			body = string(data)
+		})).ServeHTTP(w, r)
+
+		if w.Code != tc.status {
+			t.Errorf("%s answered %d instead of %d", tc.name, w.Code, tc.status)
+		}
+
+		// Bodies other than forms reach the handler untouched,
+		if w.Code == 200 && tc.contentType != "application/x-www-form-urlencoded" &&
+			!strings.HasPrefix(tc.contentType, "application/x-www-form-urlencoded;") && body != tc.body {
+			t.Errorf("%s handed on the body %q", tc.name, body)
+		}
+	}
+}
@@ -5,13 +5,155 @@ CREATE TABLE `pastebin` (
   `data` longtext,
   `delkey` char(40) default NULL,
   `expiry` int,
-  `userid` varchar(255),
+  `ownerid` integer default NULL,
+  `teamid` integer default NULL,
+  `created_at` int default NULL,
+  `quarantined` int NOT NULL default 0,
+  `updated_at` int default NULL,
+  `burn` int NOT NULL default 0,
   PRIMARY KEY (`id`)
 );
 
-CREATE TABLE `accounts` (
+CREATE TABLE `revisions` (
+  `pasteid` varchar(30) NOT NULL,
+  `revision` integer NOT NULL,
+  `title` varchar(50) default NULL,
+  `data` longtext,
+  `created_at` int NOT NULL,
+  PRIMARY KEY (`pasteid`, `revision`)
+);
+
+CREATE TABLE `users` (
+  `id` integer NOT NULL AUTO_INCREMENT,
   `email` varchar(255) NOT NULL,
   `password` varchar(255) NOT NULL,
-  `key` varchar(255) NOT NULL,
-  PRIMARY KEY (`key`)
+  `displayname` varchar(255) default NULL,
+  `apikey` varchar(255) NOT NULL,
+  `created_at` int NOT NULL,
+  `disabled` int NOT NULL default 0,
+  `verified` int NOT NULL default 0,
+  `totp_secret` varchar(64) default NULL,
+  `totp_last` int default NULL,
+  `role` varchar(32) NOT NULL default 'user',
+  `oidc_subject` varchar(255) default NULL,
+  `locale` varchar(16) default NULL,
+  `auth_source` varchar(16) NOT NULL default 'local',
+  PRIMARY KEY (`id`),
+  UNIQUE (`email`),
+  UNIQUE (`apikey`),
+  UNIQUE (`oidc_subject`)
+);
+
+CREATE TABLE `sessions` (
+  `id` char(40) NOT NULL,
+  `userid` integer NOT NULL,
+  `created_at` int NOT NULL,
+  `expires_at` int NOT NULL,
+  `last_seen` int NOT NULL,
+  `ip` varchar(45) default NULL,
+  `useragent` varchar(255) default NULL,
+  PRIMARY KEY (`id`)
+);
+
+CREATE TABLE `tokens` (
+  `id` integer NOT NULL AUTO_INCREMENT,
+  `userid` integer NOT NULL,
+  `teamid` integer default NULL,
+  `name` varchar(255) NOT NULL,
+  `hash` char(64) NOT NULL,
+  `scopes` varchar(255) NOT NULL,
+  `created_at` int NOT NULL,
+  `last_used` int default NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE (`hash`)
+);
+
+CREATE TABLE `sshkeys` (
+  `id` integer NOT NULL AUTO_INCREMENT,
+  `userid` integer NOT NULL,
+  `name` varchar(255) NOT NULL,
+  `fingerprint` varchar(64) NOT NULL,
+  `keytype` varchar(64) NOT NULL,
+  `publickey` text NOT NULL,
+  `created_at` int NOT NULL,
+  `last_used` int default NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE (`fingerprint`)
+);
+
+CREATE TABLE `recoverycodes` (
+  `userid` integer NOT NULL,
+  `hash` char(64) NOT NULL,
+  PRIMARY KEY (`userid`, `hash`)
+);
+
+CREATE TABLE `teams` (
+  `id` integer NOT NULL AUTO_INCREMENT,
+  `name` varchar(255) NOT NULL,
+  `created_at` int NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE (`name`)
+);
+
+CREATE TABLE `teammembers` (
+  `teamid` integer NOT NULL,
+  `userid` integer NOT NULL,
+  `role` varchar(32) NOT NULL,
+  `created_at` int NOT NULL,
+  PRIMARY KEY (`teamid`, `userid`)
+);
+
+CREATE TABLE `reports` (
+  `id` integer NOT NULL AUTO_INCREMENT,
+  `pasteid` varchar(30) NOT NULL,
+  `userid` integer default NULL,
+  `ip` varchar(45) default NULL,
+  `reason` varchar(255) NOT NULL,
+  `created_at` int NOT NULL,
+  PRIMARY KEY (`id`)
+);
+
+CREATE TABLE `audit` (
+  `id` integer NOT NULL AUTO_INCREMENT,
+  `created_at` int NOT NULL,
+  `adminid` integer NOT NULL,
+  `action` varchar(64) NOT NULL,
+  `target` varchar(255) NOT NULL,
+  `detail` varchar(255) default NULL,
+  PRIMARY KEY (`id`)
+);
+
+CREATE TABLE `spam` (
+  `id` integer NOT NULL AUTO_INCREMENT,
+  `created_at` int NOT NULL,
+  `ip` varchar(45) NOT NULL,
+  `userid` integer default NULL,
+  `filter` varchar(32) NOT NULL,
+  `score` float NOT NULL,
+  `reason` varchar(255) NOT NULL,
+  `title` varchar(50) NOT NULL,
+  `paste` text NOT NULL,
+  PRIMARY KEY (`id`)
+);
+
+CREATE TABLE `bayes` (
+  `token` varchar(32) NOT NULL,
+  `spam` integer NOT NULL default 0,
+  `ham` integer NOT NULL default 0,
+  PRIMARY KEY (`token`)
+);
+
+CREATE TABLE `ratelimits` (
+  `bucket` varchar(100) NOT NULL,
+  `tokens` float NOT NULL,
+  `updated_at` bigint NOT NULL,
+  PRIMARY KEY (`bucket`)
+);
+
+CREATE TABLE `loginfailures` (
+  `subject` varchar(300) NOT NULL,
+  `failures` int NOT NULL,
+  `last_failure` int NOT NULL,
+  `locked_until` int NOT NULL default 0,
+  PRIMARY KEY (`subject`)
 );
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// A request that failed, answered with the http status and the api code of
+// the error. The cause of internal errors is logged but never shown.
+type RequestError struct {
+	Status int           // Http status of the response
+	Code   string        // Api code, the message is looked up in statusMessages
+	Args   []interface{} // Arguments of the message
+	Err    error         // What went wrong, for internal errors
+}
+
+// The body of api errors, in the locale of the request.
+type APIError struct {
+	Code    string `json:"code"`    // Machine readable code of the error
+	Message string `json:"message"` // What went wrong, for people
+}
+
+// Error returns the cause of internal errors and the English message of
+// the others.
+func (e *RequestError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return translate(sourceLocale, statusMessages[e.Code], e.Args...)
+}
+
+// Unwrap returns the cause of the error.
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// newError returns an error answered with the status and the api code.
+func newError(status int, code string, args ...interface{}) *RequestError {
+	return &RequestError{Status: status, Code: code, Args: args}
+}
+
+// internalError returns an error answered with 500 for a failure the user
+// can't do anything about, like a database error.
+func internalError(err error) *RequestError {
+	return &RequestError{Status: http.StatusInternalServerError, Code: codeInternal, Err: err}
+}
+
+// checkErr simply checks if passed error is anything but nil.
+// If an error exists the request fails with an internal error, at startup
+// it's printed and the program terminates.
+func checkErr(err error) {
+	if err != nil {
+		panic(internalError(err))
+	}
+}
+
+// exitOnError prints the error that stopped the startup and terminates the
+// program. Deferred in main.
+func exitOnError() {
+	if v := recover(); v != nil {
+		debugLogger.Println(fmt.Sprintf("   %v", v))
+		os.Exit(1)
+	}
+}
+
+// recoverErrors answers requests aborted by checkErr, or by a bug, with an
+// internal error instead of dropping the connection.
+func recoverErrors(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			err, ok := v.(error)
+			if !ok {
+				err = fmt.Errorf("%v", v)
+			}
+			sendError(w, r, err)
+		}()
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// wantsJSON returns true for requests to the api and from clients asking for
+// json.
+func wantsJSON(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api") ||
+		strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// sendError answers a request with an error, as json for the api, as an error
+// page for browsers and as plain text for everything else. Errors that aren't
+// a RequestError are internal errors.
+func sendError(w http.ResponseWriter, r *http.Request, err error) {
+
+	e, message := logError(r, err)
+
+	switch {
+	case wantsJSON(r):
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(e.Status)
+		err = json.NewEncoder(w).Encode(APIError{Code: e.Code, Message: message})
+		if err != nil {
+			loggy("Could not send api error : " + err.Error())
+		}
+
+	case strings.Contains(r.Header.Get("Accept"), "text/html"):
+		errorPage(w, r, e, message)
+
+	default:
+		http.Error(w, message, e.Status)
+	}
+}
+
+// sendPlainError answers a request with the message of an error as plain
+// text, whatever the client accepts.
+func sendPlainError(w http.ResponseWriter, r *http.Request, err error) {
+	e, message := logError(r, err)
+	http.Error(w, message, e.Status)
+}
+
+// logError logs an error of a request, with the cause for internal errors.
+// Returns the error as a RequestError and its message in the locale of the
+// request.
+func logError(r *http.Request, err error) (*RequestError, string) {
+
+	var e *RequestError
+	if !errors.As(err, &e) {
+		e = internalError(err)
+	}
+
+	if e.Status >= 500 {
+		debugLogger.Println(fmt.Sprintf("   Internal error on %s %s : %s", r.Method,
+			r.URL.Path, e.Error()))
+	} else {
+		loggy(fmt.Sprintf("Answering %s %s with %d : %s", r.Method, r.URL.Path,
+			e.Status, e.Error()))
+	}
+
+	return e, statusText(r, e.Code, e.Args...)
+}
+
+// errorText returns the message of an error in a locale, for clients that
+// aren't answered over http.
+func errorText(locale string, err error) string {
+
+	var e *RequestError
+	if !errors.As(err, &e) {
+		e = internalError(err)
+	}
+
+	return translate(locale, statusMessages[e.Code], e.Args...)
+}
+
+// errorPage renders the error page, or the review page for pastes under
+// review.
+func errorPage(w http.ResponseWriter, r *http.Request, e *RequestError, message string) {
+
+	name := "error.html"
+	title := tr(r, http.StatusText(e.Status))
+	if e.Code == codeUnderReview {
+		name = "review.html"
+		title = tr(r, "Under review")
+	}
+
+	page := &Page{
+		Title:    title,
+		Message:  message,
+		UrlHome:  configuration.Address,
+		CSPNonce: cspNonce(r),
+		Theme:    siteTheme,
+	}
+
+	var buf bytes.Buffer
+	err := pageTemplates(r).ExecuteTemplate(&buf, name, page)
+	if err != nil {
+		debugLogger.Println("   Could not render the error page : " + err.Error())
+		http.Error(w, message, e.Status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(e.Status)
+	buf.WriteTo(w)
+}
+
+// renderPage executes a template of the pages in the locale of the request.
+// The page is rendered before anything is sent, so a failing template ends
+// in an error page instead of half a page.
+func renderPage(w http.ResponseWriter, r *http.Request, name string, data interface{}) {
+
+	var buf bytes.Buffer
+	err := pageTemplates(r).ExecuteTemplate(&buf, name, data)
+	if err != nil {
+		sendError(w, r, internalError(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+// notFoundHandler answers requests to unknown routes.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	sendError(w, r, newError(http.StatusNotFound, codeNoSuchPage))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestErrorsAnswerInTheFormatOfTheClient(t *testing.T) {
+
+	setupTest(t)
+
+	tooLarge := newError(http.StatusRequestEntityTooLarge, codePasteTooLarge, 100)
+	secret := errors.New("database password is hunter2")
+
+	for _, tc := range []struct {
+		name        string
+		target      string
+		accept      string
+		language    string
+		err         error
+		status      int
+		contentType string
+		code        string
+		message     string
+	}{
+		{"api", "/api/v2/pastes", "", "", tooLarge, 413, "application/json", codePasteTooLarge,
+			"Paste is larger than 100 bytes."},
+		{"api in german", "/api/v2/pastes", "", "de", tooLarge, 413, "application/json", codePasteTooLarge,
+			translate("de", statusMessages[codePasteTooLarge], 100)},
+		{"json client", "/p/abc", "application/json", "", newError(http.StatusNotFound, codeNotFound), 404,
+			"application/json", codeNotFound, "Requested paste doesn't exist."},
+		{"wrapped", "/api/v2/pastes", "", "", wrapped{tooLarge}, 413, "application/json", codePasteTooLarge,
+			"Paste is larger than 100 bytes."},
+		{"internal", "/api/v2/pastes", "", "", secret, 500, "application/json", codeInternal,
+			statusMessages[codeInternal]},
+		{"internal with a cause", "/api/v2/pastes", "", "", internalError(secret), 500, "application/json",
+			codeInternal, statusMessages[codeInternal]},
+		{"browser", "/p/abc", "text/html,application/xhtml+xml", "", newError(http.StatusNotFound, codeNotFound),
+			404, "text/html; charset=utf-8", "", "Requested paste doesn&#39;t exist."},
+		{"browser under review", "/p/abc", "text/html", "", newError(http.StatusForbidden, codeUnderReview),
+			403, "text/html; charset=utf-8", "", "Under review"},
+		{"curl", "/p/abc", "*/*", "", newError(http.StatusNotFound, codeNotFound), 404,
+			"text/plain; charset=utf-8", "", "Requested paste doesn't exist."},
+	} {
+		r := httptest.NewRequest("GET", tc.target, nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept", tc.accept)
+		}
+		if tc.language != "" {
+			r.Header.Set("Accept-Language", tc.language)
+		}
+		w := httptest.NewRecorder()
+		sendError(w, r, tc.err)
+
+		if w.Code != tc.status || w.Header().Get("Content-Type") != tc.contentType {
+			t.Errorf("%s answered %d as %s", tc.name, w.Code, w.Header().Get("Content-Type"))
+		}
+		if strings.Contains(w.Body.String(), "hunter2") {
+			t.Errorf("%s showed the cause of the error", tc.name)
+		}
+
+		if tc.code == "" {
+			if !strings.Contains(w.Body.String(), tc.message) {
+				t.Errorf("%s doesn't say %q", tc.name, tc.message)
+			}
+			continue
+		}
+		var e APIError
+		if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+			t.Fatalf("%s : %v", tc.name, err)
+		}
+		if e.Code != tc.code || e.Message != tc.message {
+			t.Errorf("%s answered %+v", tc.name, e)
+		}
+	}
+}
+
+// wrapped is an error wrapping another one.
+type wrapped struct{ err error }
+
+func (w wrapped) Error() string { return "wrapped : " + w.err.Error() }
+func (w wrapped) Unwrap() error { return w.err }
+
+func TestRecoverErrorsAnswersPanics(t *testing.T) {
+
+	setupTest(t)
+
+	for _, tc := range []struct {
+		name   string
+		panic  interface{}
+		status int
+		code   string
+	}{
+		{"checkErr", internalError(errors.New("disk full")), 500, codeInternal},
+		{"request error", newError(http.StatusGone, codePasteExpired), 410, codePasteExpired},
+		{"bug", "index out of range", 500, codeInternal},
+	} {
+		w := httptest.NewRecorder()
+		recoverErrors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic(tc.panic)
+		})).ServeHTTP(w, httptest.NewRequest("GET", "/api/v2/pastes", nil))
+
+		var e APIError
+		if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil || w.Code != tc.status || e.Code != tc.code {
+			t.Errorf("the %s panic answered %d with %s", tc.name, w.Code, w.Body.String())
+		}
+	}
+
+	// Aborted handlers are left alone,
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("the abort was turned into %v", v)
+		}
+	}()
+	recoverErrors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func TestEveryErrorCodeHasAMessage(t *testing.T) {
+
+	data, err := ioutil.ReadFile("i18n.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codes := regexp.MustCompile(`(?m)^\s+code[A-Z]\w*\s*= "([a-z_]+)"`).FindAllStringSubmatch(string(data), -1)
+	if len(codes) != len(statusMessages) {
+		t.Errorf("%d codes for %d messages", len(codes), len(statusMessages))
+	}
+	for _, code := range codes {
+		if statusMessages[code[1]] == "" {
+			t.Errorf("the code %s has no message", code[1])
+		}
+	}
+}
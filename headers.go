@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+)
+
+// The request context key of the csp nonce.
+type cspNonceKey struct{}
+
+// cspNonce returns the nonce inline scripts and styles of the response need.
+func cspNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(cspNonceKey{}).(string)
+	return nonce
+}
+
+// contentSecurityPolicy returns the policy of a response. Everything is
+// loaded from the pastebin itself, and inline scripts and styles only apply
+// with the nonce. The url shortener is the only other site the pages talk to.
+func contentSecurityPolicy(nonce string) string {
+
+	policy := "default-src 'self'; " +
+		"script-src 'self' 'nonce-" + nonce + "'; " +
+		"style-src 'self' 'nonce-" + nonce + "'; " +
+		"font-src 'self'; " +
+		"object-src 'none'; " +
+		"base-uri 'none'; " +
+		"frame-ancestors 'none'"
+	if configuration.GoogleAPIKey != "" {
+		policy += "; connect-src 'self' https://www.googleapis.com"
+	}
+
+	return policy
+}
+
+// securityHeaders sets the security headers of every response, with a new
+// csp nonce for every request.
+func securityHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		b := make([]byte, 16)
+		_, err := rand.Read(b)
+		checkErr(err)
+		nonce := base64.RawURLEncoding.EncodeToString(b)
+
+		w.Header().Set("Content-Security-Policy", contentSecurityPolicy(nonce))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Referrer-Policy", "same-origin")
+		if secureCookies() {
+			w.Header().Set("Strict-Transport-Security", "max-age=31536000")
+		}
+
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), cspNonceKey{}, nonce)))
+	})
+}
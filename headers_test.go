@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestPagesOnlyRunInlineCodeWithTheNonce(t *testing.T) {
+
+	setupTest(t)
+	configuration.GoogleAPIKey = ""
+
+	for name, h := range map[string]http.HandlerFunc{
+		"index": RootHandler,
+		"login": loginHandler,
+	} {
+		w := httptest.NewRecorder()
+		securityHeaders(h).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		policy := w.Header().Get("Content-Security-Policy")
+		nonce := regexp.MustCompile(`'nonce-([^']+)'`).FindStringSubmatch(policy)
+		if nonce == nil {
+			t.Fatalf("the %s page has no nonce in %q", name, policy)
+		}
+		want := "default-src 'self'; script-src 'self' 'nonce-" + nonce[1] + "'; " +
+			"style-src 'self' 'nonce-" + nonce[1] + "'; font-src 'self'; object-src 'none'; " +
+			"base-uri 'none'; frame-ancestors 'none'"
+		if policy != want {
+			t.Errorf("the %s page sent the policy %q", name, policy)
+		}
+
+		body := w.Body.String()
+		for _, tag := range regexp.MustCompile(`<(script|style)[^>]*>`).FindAllString(body, -1) {
+			if !strings.Contains(tag, "src=") && !strings.Contains(tag, `nonce="`+nonce[1]+`"`) {
+				t.Errorf("the %s page has %s without the nonce", name, tag)
+			}
+		}
+		if regexp.MustCompile(`\sstyle=|\son[a-z]+=`).MatchString(body) {
+			t.Errorf("the %s page has inline styles or handlers", name)
+		}
+	}
+
+	// The url shortener is reached with an api key,
+	configuration.GoogleAPIKey = "key"
+	if policy := contentSecurityPolicy("n"); !strings.HasSuffix(policy, "; connect-src 'self' https://www.googleapis.com") {
+		t.Errorf("the policy with an api key is %q", policy)
+	}
+
+	// Every response gets a new nonce,
+	first, second := httptest.NewRecorder(), httptest.NewRecorder()
+	securityHeaders(http.HandlerFunc(RootHandler)).ServeHTTP(first, httptest.NewRequest("GET", "/", nil))
+	securityHeaders(http.HandlerFunc(RootHandler)).ServeHTTP(second, httptest.NewRequest("GET", "/", nil))
+	if first.Header().Get("Content-Security-Policy") == second.Header().Get("Content-Security-Policy") {
+		t.Error("two responses got the same nonce")
+	}
+}
@@ -29,7 +29,7 @@ def render(code, lang, theme):
                 out = "Given language was not found :: '"+lang+"' (returning plain text).\n"
 
             lexer = get_lexer_by_name("text")
-            html_format = HtmlFormatter(style=theme, noclasses="true", linenos="true", encoding="utf-8")
+            html_format = HtmlFormatter(style=theme, linenos="true", encoding="utf-8")
             return highlight(code, lexer, html_format),out
 
     if guess:
@@ -40,9 +40,9 @@ def render(code, lang, theme):
         out = "Successfully used lexer for given language :: "+lang
 
     try:
-        html_format = HtmlFormatter(style=theme, noclasses="true", linenos="true", encoding="utf-8")
+        html_format = HtmlFormatter(style=theme, linenos="true", encoding="utf-8")
     except:
-        html_format = HtmlFormatter(noclasses="true", linenos="true", encoding="utf-8")
+        html_format = HtmlFormatter(linenos="true", encoding="utf-8")
 
     return highlight(code, lexer, html_format),out
 
@@ -57,12 +57,14 @@ def usage(err=0):
     print("    - %s [lang] [style] < FILE" % sys.argv[0])
     print("    - %s getlexers" % sys.argv[0])
     print("    - %s getstyles" % sys.argv[0])
+    print("    - %s getcss [style]" % sys.argv[0])
 
     print("\n Where, \n")
     print("    - lang is the language of your code")
     print("    - style is the 'theme' for the formatter")
     print("    - getlexers will print available lexers (displayname;lexer-name)")
-    print("    - getstyles will print available styles \n")
+    print("    - getstyles will print available styles")
+    print("    - getcss will print the stylesheet of a style \n")
 
     sys.exit(err)
 
@@ -72,6 +74,14 @@ def get_styles():
         print(items)
     sys.exit(0)
 
+def get_css(theme):
+    try:
+        html_format = HtmlFormatter(style=theme)
+    except:
+        html_format = HtmlFormatter()
+    print(html_format.get_style_defs(".highlight"))
+    sys.exit(0)
+
 def get_lexers():
     item = pygments.lexers.get_all_lexers()
     for items in item:
@@ -91,6 +101,8 @@ if len(sys.argv) >= 2:
           get_lexers()
       if arg == 'getstyles':
           get_styles()
+      if arg == 'getcss' and len(sys.argv) == 3:
+          get_css(sys.argv[2])
 
 if len(sys.argv) == 3:
     lang  = sys.argv[1]
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The messages of the pastebin are written in English, other locales come from
+// the catalogs in assets/locales,
+const sourceLocale = "en"
+
+// The cookie remembering the locale chosen on the account page,
+const localeCookie = "locale"
+
+// A catalog of translations, read from locales/<locale>.json of the assets.
+type Catalog struct {
+	Name     string            `json:"name"`     // Name of the language, in the language
+	Messages map[string]string `json:"messages"` // English messages and their translation
+}
+
+// A locale the user can choose on the account page.
+type Locale struct {
+	Code string
+	Name string
+}
+
+// Codes of the api statuses, which don't change with the locale,
+const (
+	codeSuccess         = "success"
+	codePasteSaved      = "paste_saved"
+	codePasteExists     = "paste_exists"
+	codePasteDeleted    = "paste_deleted"
+	codePasteReported   = "paste_reported"
+	codeNotFound        = "paste_not_found"
+	codeUnderReview     = "paste_under_review"
+	codeSecretsFound    = "secrets_found"
+	codeSecretsRedacted = "secrets_redacted"
+	codeSecretsRejected = "secrets_rejected"
+	codeSpam            = "spam"
+	codeInvalidRequest  = "invalid_request"
+	codeEmptyPaste      = "empty_paste"
+	codeTitleTooLong    = "title_too_long"
+	codeUnknownReason   = "unknown_reason"
+	codeAuthRequired    = "authentication_required"
+	codeInvalidToken    = "invalid_token"
+	codeMissingScope    = "missing_scope"
+	codeForbidden       = "forbidden"
+	codeNotTeamMember   = "not_team_member"
+	codePasteExpired    = "paste_expired"
+	codePasteTooLarge   = "paste_too_large"
+	codeRateLimited     = "rate_limited"
+	codeCrossSite       = "cross_site_request"
+	codeInvalidCSRF     = "invalid_csrf_token"
+	codeNoSuchPage      = "page_not_found"
+	codeProviderDown    = "provider_unavailable"
+	codeAccountRefused  = "account_refused"
+	codeInternal        = "internal_error"
+	codeInvalidField    = "invalid_field"
+	codeNoSuchRevision  = "revision_not_found"
+	codeNoSuchToken     = "token_not_found"
+	codeAlreadyReported = "already_reported"
+)
+
+// The English text of the api statuses,
+var statusMessages = map[string]string{
+	codeSuccess:         "Success",
+	codePasteSaved:      "Successfully saved paste.",
+	codePasteExists:     "Paste data already exists ...",
+	codePasteDeleted:    "Deleted paste %s",
+	codePasteReported:   "Thank you, the paste has been reported.",
+	codeNotFound:        "Requested paste doesn't exist.",
+	codeUnderReview:     "Requested paste is under review.",
+	codeSecretsFound:    "Successfully saved paste. Warning : the paste looks like it contains secrets (%s).",
+	codeSecretsRedacted: "Successfully saved paste. Redacted secrets (%s).",
+	codeSecretsRejected: "The paste looks like it contains secrets (%s), it was not saved.",
+	codeSpam:            "The paste looks like spam, it was not saved.",
+	codeInvalidRequest:  "The request is not valid json : %s",
+	codeEmptyPaste:      "Empty paste.",
+	codeTitleTooLong:    "Title to long.",
+	codeUnknownReason:   "Unknown reason, use one of : %s",
+	codeAuthRequired:    "Authentication required.",
+	codeInvalidToken:    "Invalid token.",
+	codeMissingScope:    "Token is missing the '%s' scope.",
+	codeForbidden:       "Not allowed to %s.",
+	codeNotTeamMember:   "Not a member of this team.",
+	codePasteExpired:    "Requested paste has expired.",
+	codePasteTooLarge:   "Paste is larger than %d bytes.",
+	codeRateLimited:     "Too many requests, try again in %d seconds.",
+	codeCrossSite:       "Cross-site request refused.",
+	codeInvalidCSRF:     "Invalid or missing csrf token, reload the page and try again.",
+	codeNoSuchPage:      "There is no such page.",
+	codeProviderDown:    "The identity provider is not available.",
+	codeAccountRefused:  "Your account could not be created.",
+	codeInternal:        "Something went wrong, try again later.",
+	codeInvalidField:    "Invalid value for the '%s' field.",
+	codeNoSuchRevision:  "Requested revision doesn't exist.",
+	codeNoSuchToken:     "Requested token doesn't exist.",
+	codeAlreadyReported: "You have already reported this paste.",
+}
+
+// The catalogs and the templates of every locale but English, set up at
+// startup,
+var catalogs = make(map[string]Catalog)
+var localeTemplates = make(map[string]*template.Template)
+
+// loadCatalogs reads the catalogs of the assets and sets up the templates of
+// every locale. Exits if a catalog can't be read or the default locale is
+// unknown.
+func loadCatalogs() {
+
+	assets := assetsFS()
+	files, err := fs.Glob(assets, "locales/*.json")
+	checkErr(err)
+
+	for _, file := range files {
+		data, err := fs.ReadFile(assets, file)
+		checkErr(err)
+
+		var c Catalog
+		err = json.Unmarshal(data, &c)
+		if err != nil {
+			debugLogger.Println("   Config error : catalog " + file + " : " + err.Error())
+			os.Exit(1)
+		}
+
+		locale := strings.ToLower(strings.TrimSuffix(path.Base(file), ".json"))
+		catalogs[locale] = c
+		localeTemplates[locale] = localizeTemplates(locale)
+		loggy(fmt.Sprintf("Loaded the %s catalog with %d messages.", locale,
+			len(c.Messages)))
+	}
+
+	if !supportedLocale(defaultLocale()) {
+		debugLogger.Println("   Config error : no catalog for the default locale " +
+			configuration.DefaultLocale)
+		os.Exit(1)
+	}
+}
+
+// templateFuncs returns the functions translating the templates to a locale.
+func templateFuncs(locale string) template.FuncMap {
+	return template.FuncMap{
+		"t": func(msg string, args ...interface{}) string {
+			return translate(locale, msg, args...)
+		},
+		"locale": func() string {
+			return locale
+		},
+	}
+}
+
+// localizeTemplates returns a copy of the templates translated to a locale.
+func localizeTemplates(locale string) *template.Template {
+	t := template.Must(templates.Clone())
+	return t.Funcs(templateFuncs(locale))
+}
+
+// pageTemplates returns the templates in the locale of the request.
+func pageTemplates(r *http.Request) *template.Template {
+	if t, ok := localeTemplates[requestLocale(r)]; ok {
+		return t
+	}
+	return templates
+}
+
+// defaultLocale returns the locale of requests not asking for a known one.
+func defaultLocale() string {
+	if configuration.DefaultLocale != "" {
+		return strings.ToLower(configuration.DefaultLocale)
+	}
+	return sourceLocale
+}
+
+// supportedLocale returns true if there are messages for the locale.
+func supportedLocale(locale string) bool {
+	_, ok := catalogs[locale]
+	return ok || locale == sourceLocale
+}
+
+// getLocales lists the locales users can choose from.
+func getLocales() []Locale {
+
+	locales := []Locale{{Code: sourceLocale, Name: "English"}}
+	for code, c := range catalogs {
+		locales = append(locales, Locale{Code: code, Name: c.Name})
+	}
+
+	sort.Slice(locales, func(i, j int) bool {
+		return locales[i].Code < locales[j].Code
+	})
+	return locales
+}
+
+// matchLocale returns the supported locale for a language tag, trying the
+// language without its region as well.
+// Returns an empty string if there is none.
+func matchLocale(tag string) string {
+
+	tag = strings.ToLower(strings.TrimSpace(strings.Replace(tag, "_", "-", -1)))
+	if supportedLocale(tag) {
+		return tag
+	}
+
+	if i := strings.Index(tag, "-"); i > 0 && supportedLocale(tag[:i]) {
+		return tag[:i]
+	}
+
+	return ""
+}
+
+// negotiateLocale picks the supported locale the Accept-Language header likes
+// best.
+// Returns an empty string if it doesn't like any of them.
+func negotiateLocale(header string) string {
+
+	type weighted struct {
+		tag string
+		q   float64
+	}
+
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		w := weighted{tag: strings.TrimSpace(fields[0]), q: 1}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					w.q = q
+				}
+			}
+		}
+		if w.tag != "" && w.q > 0 {
+			tags = append(tags, w)
+		}
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].q > tags[j].q
+	})
+
+	for _, w := range tags {
+		if w.tag == "*" {
+			return defaultLocale()
+		}
+		if locale := matchLocale(w.tag); locale != "" {
+			return locale
+		}
+	}
+
+	return ""
+}
+
+// requestLocale returns the locale of a request, the one chosen by the user on
+// the account page, the one asked for by the browser or the default one.
+func requestLocale(r *http.Request) string {
+
+	if cookie, err := r.Cookie(localeCookie); err == nil {
+		if locale := matchLocale(cookie.Value); locale != "" {
+			return locale
+		}
+	}
+
+	if locale := negotiateLocale(r.Header.Get("Accept-Language")); locale != "" {
+		return locale
+	}
+
+	return defaultLocale()
+}
+
+// setLocaleCookie remembers the locale of the user in the browser, so it
+// doesn't have to be looked up on every request.
+func setLocaleCookie(w http.ResponseWriter, locale string) {
+	if locale == "" {
+		http.SetCookie(w, newCookie(localeCookie, "", "/", -1))
+		return
+	}
+	http.SetCookie(w, newCookie(localeCookie, locale, "/", 365*24*60*60))
+}
+
+// translate returns a message in a locale, the English message if there is no
+// translation, formatted with the args if there are any.
+func translate(locale string, msg string, args ...interface{}) string {
+
+	if t, ok := catalogs[locale].Messages[msg]; ok && t != "" {
+		msg = t
+	}
+
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// tr translates a message to the locale of the request.
+func tr(r *http.Request, msg string, args ...interface{}) string {
+	return translate(requestLocale(r), msg, args...)
+}
+
+// statusText returns the text of an api status in the locale of the request.
+func statusText(r *http.Request, code string, args ...interface{}) string {
+	return tr(r, statusMessages[code], args...)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRequestLocale(t *testing.T) {
+
+	setupTest(t)
+
+	for _, tc := range []struct {
+		cookie   string
+		language string
+		want     string
+	}{
+		{"", "", sourceLocale},
+		{"", "de", "de"},
+		{"", "de-AT", "de"},
+		{"", "de_CH", "de"},
+		{"", "fr, de;q=0.5", "de"},
+		{"", "de;q=0.5, en;q=0.9", "en"},
+		{"", "de;q=0", sourceLocale},
+		{"", "fr, *;q=0.1", sourceLocale},
+		{"", "fr", sourceLocale},
+		{"de", "en", "de"},
+		{"fr", "de", "de"},
+		{"en", "de", "en"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tc.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: localeCookie, Value: tc.cookie})
+		}
+		if tc.language != "" {
+			r.Header.Set("Accept-Language", tc.language)
+		}
+		if got := requestLocale(r); got != tc.want {
+			t.Errorf("the cookie %q and Accept-Language %q gave %s instead of %s",
+				tc.cookie, tc.language, got, tc.want)
+		}
+	}
+
+	// The default locale answers everyone else,
+	configuration.DefaultLocale = "DE"
+	if got := requestLocale(httptest.NewRequest("GET", "/", nil)); got != "de" {
+		t.Errorf("the default locale gave %s", got)
+	}
+}
+
+var formatVerbRegexp = regexp.MustCompile(`%[-+# 0-9.]*[a-zA-Z%]`)
+
+// formatVerbs returns the sorted format verbs of a message.
+func formatVerbs(msg string) string {
+	verbs := formatVerbRegexp.FindAllString(msg, -1)
+	sort.Strings(verbs)
+	return strings.Join(verbs, " ")
+}
+
+func TestCatalogsTranslateEveryMessage(t *testing.T) {
+
+	setupTest(t)
+
+	messages := map[string]string{}
+	for code, msg := range statusMessages {
+		messages[msg] = "status " + code
+	}
+
+	sources, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, err := filepath.Glob("assets/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range append(sources, templates...) {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range regexp.MustCompile(`\btr\([a-z]+, "((?:[^"\\]|\\.)*)"|\{\{-? *t "((?:[^"\\]|\\.)*)"`).FindAllStringSubmatch(string(data), -1) {
+			msg := strings.Replace(m[1]+m[2], `\"`, `"`, -1)
+			messages[msg] = file
+		}
+	}
+	if len(messages) < len(statusMessages)+50 {
+		t.Fatalf("only found %d messages", len(messages))
+	}
+
+	for locale, c := range catalogs {
+		for msg, where := range messages {
+			translated, ok := c.Messages[msg]
+			switch {
+			case !ok || translated == "":
+				t.Errorf("%s has no translation of %q from %s", locale, msg, where)
+			case formatVerbs(translated) != formatVerbs(msg):
+				t.Errorf("%s translates %q with other format verbs", locale, msg)
+			}
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"html"
+	"net/url"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapAuthenticator checks credentials by binding to an ldap directory as the
+// user. Accounts are created on the first login, using the mapped attributes
+// for email and display name.
+type ldapAuthenticator struct {
+	url            string
+	startTLS       bool
+	bindDN         string
+	bindPassword   string
+	baseDN         string
+	userFilter     string
+	emailAttribute string
+	nameAttribute  string
+	groupAttribute string
+	requiredGroups []string
+}
+
+// newLDAPAuthenticator creates the ldap authenticator from the configuration,
+// filling in defaults for the attribute mapping.
+func newLDAPAuthenticator() *ldapAuthenticator {
+
+	a := &ldapAuthenticator{
+		url:            configuration.LDAPURL,
+		startTLS:       configuration.LDAPStartTLS,
+		bindDN:         configuration.LDAPBindDN,
+		bindPassword:   configuration.LDAPBindPassword,
+		baseDN:         configuration.LDAPBaseDN,
+		userFilter:     configuration.LDAPUserFilter,
+		emailAttribute: configuration.LDAPEmailAttribute,
+		nameAttribute:  configuration.LDAPNameAttribute,
+		groupAttribute: configuration.LDAPGroupAttribute,
+		requiredGroups: configuration.LDAPRequiredGroups,
+	}
+
+	if a.userFilter == "" {
+		a.userFilter = "(&(objectClass=person)(uid=%s))"
+	}
+	if a.emailAttribute == "" {
+		a.emailAttribute = "mail"
+	}
+	if a.nameAttribute == "" {
+		a.nameAttribute = "displayName"
+	}
+	if a.groupAttribute == "" {
+		a.groupAttribute = "memberOf"
+	}
+
+	return a
+}
+
+// dial connects to the directory and binds as the service account.
+func (a *ldapAuthenticator) dial() (*ldap.Conn, error) {
+
+	conn, err := ldap.DialURL(a.url)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.startTLS {
+		u, err := url.Parse(a.url)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		err = conn.StartTLS(&tls.Config{ServerName: u.Hostname()})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if a.bindDN != "" {
+		err = conn.Bind(a.bindDN, a.bindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// inRequiredGroup returns true if no groups are required or the entry is a
+// member of one of them.
+func (a *ldapAuthenticator) inRequiredGroup(entry *ldap.Entry) bool {
+
+	if len(a.requiredGroups) == 0 {
+		return true
+	}
+
+	for _, group := range entry.GetAttributeValues(a.groupAttribute) {
+		for _, required := range a.requiredGroups {
+			if strings.EqualFold(group, required) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Authenticate looks up the user in the directory and binds as the user with
+// the given password.
+func (a *ldapAuthenticator) Authenticate(login string, password string) (*User, error) {
+
+	// An empty password would be an unauthenticated bind, which succeeds,
+	if login == "" || password == "" {
+		return nil, nil
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	search := ldap.NewSearchRequest(a.baseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+		fmt.Sprintf(a.userFilter, ldap.EscapeFilter(login)),
+		[]string{a.emailAttribute, a.nameAttribute, a.groupAttribute},
+		nil)
+
+	res, err := conn.Search(search)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res.Entries) != 1 {
+		loggy(fmt.Sprintf("Found %d directory entries for '%s'.",
+			len(res.Entries), login))
+		return nil, nil
+	}
+	entry := res.Entries[0]
+
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		loggy(fmt.Sprintf("Wrong password for directory entry '%s'.", entry.DN))
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !a.inRequiredGroup(entry) {
+		loggy(fmt.Sprintf("Directory entry '%s' is not in any of the required groups.",
+			entry.DN))
+		return nil, nil
+	}
+
+	email := html.EscapeString(entry.GetAttributeValue(a.emailAttribute))
+	name := html.EscapeString(entry.GetAttributeValue(a.nameAttribute))
+	if !validName(name) {
+		name = ""
+	}
+	if email == "" {
+		loggy(fmt.Sprintf("Directory entry '%s' has no '%s' attribute.", entry.DN,
+			a.emailAttribute))
+		return nil, nil
+	}
+
+	u := getUserByEmail(email)
+	switch {
+	case u == nil:
+		// Directory accounts don't have a local password,
+		u = createUser(email, name, []byte(""))
+		setUserAuthSource(u.Id, authLDAP)
+		u.AuthSource = authLDAP
+		setUserVerified(u.Id)
+		u.Verified = true
+		loggy(fmt.Sprintf("Provisioned account '%s' with id %d for '%s'.",
+			email, u.Id, entry.DN))
+
+	// Anyone can sign up locally with an address they don't own, so only
+	// accounts of the directory are used by it,
+	case u.AuthSource != authLDAP:
+		loggy(fmt.Sprintf("Refusing '%s' for the local account '%s'.", entry.DN, email))
+		return nil, nil
+
+	case name != "" && name != u.DisplayName:
+		renameUser(u.Id, name)
+		u.DisplayName = name
+	}
+
+	return u, nil
+}
+
+// checkPassword binds as the directory entry of the account with the password,
+// to confirm sensitive actions of accounts without a local password. The entry
+// is looked up by the email of the account.
+func (a *ldapAuthenticator) checkPassword(u *User, password string) (bool, error) {
+
+	// An empty password would be an unauthenticated bind, which succeeds,
+	if password == "" {
+		return false, nil
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	search := ldap.NewSearchRequest(a.baseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+		fmt.Sprintf("(%s=%s)", a.emailAttribute, ldap.EscapeFilter(html.UnescapeString(u.Email))),
+		[]string{a.groupAttribute},
+		nil)
+
+	res, err := conn.Search(search)
+	if err != nil {
+		return false, err
+	}
+
+	if len(res.Entries) != 1 {
+		loggy(fmt.Sprintf("Found %d directory entries for account %d.",
+			len(res.Entries), u.Id))
+		return false, nil
+	}
+	entry := res.Entries[0]
+
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		loggy(fmt.Sprintf("Wrong password for directory entry '%s'.", entry.DN))
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return a.inRequiredGroup(entry), nil
+}
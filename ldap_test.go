@@ -0,0 +1,292 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ldapStubEntry is a user in the stub directory.
+type ldapStubEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// The uid or the mail the filter of a search asks for,
+var ldapStubUID = regexp.MustCompile(`\(uid=([^)]*)\)`)
+var ldapStubMail = regexp.MustCompile(`\(mail=([^)]*)\)`)
+
+// startLDAPStub serves a directory with the entries on a local port, enough
+// of the protocol for simple binds and searches by uid or mail. The service account
+// cn=service binds with the password service.
+// Returns the url of the directory.
+func startLDAPStub(t *testing.T, entries map[string]ldapStubEntry) string {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveLDAPStub(conn, entries)
+		}
+	}()
+
+	return "ldap://" + l.Addr().String()
+}
+
+// serveLDAPStub answers the requests of one connection.
+func serveLDAPStub(conn net.Conn, entries map[string]ldapStubEntry) {
+
+	defer conn.Close()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+
+			code := ldap.LDAPResultInvalidCredentials
+			if dn == "cn=service" && password == "service" {
+				code = ldap.LDAPResultSuccess
+			}
+			for _, e := range entries {
+				if e.dn == dn && e.password == password {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+			conn.Write(ldapStubResult(id, ldap.ApplicationBindResponse, code).Bytes())
+
+		case ldap.ApplicationSearchRequest:
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			if m := ldapStubUID.FindStringSubmatch(filter); m != nil {
+				if e, ok := entries[m[1]]; ok {
+					conn.Write(ldapStubEntryPacket(id, e).Bytes())
+				}
+			}
+			if m := ldapStubMail.FindStringSubmatch(filter); m != nil {
+				for _, e := range entries {
+					if len(e.attrs["mail"]) > 0 && e.attrs["mail"][0] == m[1] {
+						conn.Write(ldapStubEntryPacket(id, e).Bytes())
+					}
+				}
+			}
+			conn.Write(ldapStubResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+// ldapStubResult encodes a response with a result code.
+func ldapStubResult(id interface{}, tag ber.Tag, code int) *ber.Packet {
+
+	res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	res.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+
+	return ldapStubMessage(id, res)
+}
+
+// ldapStubEntryPacket encodes a search result with the entry.
+func ldapStubEntryPacket(id interface{}, e ldapStubEntry) *ber.Packet {
+
+	res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "Object Name"))
+
+	attrs := ber.NewSequence("Attributes")
+	for name, values := range e.attrs {
+		attr := ber.NewSequence("Attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+		}
+		attr.AppendChild(set)
+		attrs.AppendChild(attr)
+	}
+	res.AppendChild(attrs)
+
+	return ldapStubMessage(id, res)
+}
+
+// ldapStubMessage wraps a response in an ldap message.
+func ldapStubMessage(id interface{}, op *ber.Packet) *ber.Packet {
+	msg := ber.NewSequence("LDAP Message")
+	msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+	msg.AppendChild(op)
+	return msg
+}
+
+// setupLDAP points the ldap authenticator at a stub directory with alice,
+// who is in the staff group, and bob, who isn't.
+func setupLDAP(t *testing.T) *ldapAuthenticator {
+
+	setupTest(t)
+
+	configuration.LDAPURL = startLDAPStub(t, map[string]ldapStubEntry{
+		"alice": {
+			dn:       "uid=alice,ou=people,dc=example,dc=com",
+			password: "alice-secret",
+			attrs: map[string][]string{
+				"mail":        {"alice@example.com"},
+				"displayName": {"Alice"},
+				"memberOf":    {"cn=staff,ou=groups,dc=example,dc=com"},
+			},
+		},
+		"bob": {
+			dn:       "uid=bob,ou=people,dc=example,dc=com",
+			password: "bob-secret",
+			attrs: map[string][]string{
+				"mail":     {"bob@example.com"},
+				"memberOf": {"cn=interns,ou=groups,dc=example,dc=com"},
+			},
+		},
+	})
+	configuration.LDAPBindDN = "cn=service"
+	configuration.LDAPBindPassword = "service"
+	configuration.LDAPRequiredGroups = nil
+
+	return newLDAPAuthenticator()
+}
+
+func TestLDAPBind(t *testing.T) {
+
+	a := setupLDAP(t)
+
+	u, err := a.Authenticate("alice", "wrong")
+	if err != nil || u != nil {
+		t.Fatalf("logged in with the wrong password : %v, %v", u, err)
+	}
+
+	u, err = a.Authenticate("alice", "")
+	if err != nil || u != nil {
+		t.Fatalf("logged in with an empty password : %v, %v", u, err)
+	}
+
+	u, err = a.Authenticate("nobody", "alice-secret")
+	if err != nil || u != nil {
+		t.Fatalf("logged in as an unknown user : %v, %v", u, err)
+	}
+
+	u, err = a.Authenticate("alice", "alice-secret")
+	if err != nil || u == nil {
+		t.Fatalf("alice can't log in : %v", err)
+	}
+}
+
+func TestLDAPServiceAccountFailure(t *testing.T) {
+
+	a := setupLDAP(t)
+	a.bindPassword = "wrong"
+
+	u, err := a.Authenticate("alice", "alice-secret")
+	if err == nil || u != nil {
+		t.Fatal("logged in without the service account")
+	}
+}
+
+func TestLDAPRequiredGroups(t *testing.T) {
+
+	a := setupLDAP(t)
+	a.requiredGroups = []string{"CN=staff,ou=groups,dc=example,dc=com"}
+
+	if u, err := a.Authenticate("bob", "bob-secret"); err != nil || u != nil {
+		t.Fatalf("bob isn't in the required group but logged in : %v, %v", u, err)
+	}
+	if getUserByEmail("bob@example.com") != nil {
+		t.Error("an account was provisioned for bob")
+	}
+
+	if u, err := a.Authenticate("alice", "alice-secret"); err != nil || u == nil {
+		t.Fatalf("alice is in the required group but can't log in : %v", err)
+	}
+}
+
+func TestLDAPProvisioning(t *testing.T) {
+
+	a := setupLDAP(t)
+
+	u, err := a.Authenticate("alice", "alice-secret")
+	if err != nil || u == nil {
+		t.Fatalf("alice can't log in : %v", err)
+	}
+	if u.Email != "alice@example.com" || u.DisplayName != "Alice" || !u.Verified {
+		t.Errorf("provisioned %s named %s, verified %v", u.Email, u.DisplayName, u.Verified)
+	}
+	if len(getUserPassword(u.Id)) != 0 {
+		t.Error("the provisioned account has a local password")
+	}
+
+	// The next login uses the same account,
+	again, err := a.Authenticate("alice", "alice-secret")
+	if err != nil || again == nil || again.Id != u.Id {
+		t.Fatalf("the second login didn't use the provisioned account : %v, %v", again, err)
+	}
+}
+
+func TestLDAPRefusesLocalAccounts(t *testing.T) {
+
+	a := setupLDAP(t)
+
+	// Someone signed up with the address of alice,
+	hashed, _ := bcrypt.GenerateFromPassword([]byte("squatter"), bcrypt.MinCost)
+	squatted := createUser("alice@example.com", "", hashed)
+
+	if u, err := a.Authenticate("alice", "alice-secret"); err != nil || u != nil {
+		t.Fatalf("the unverified local account was used : %v, %v", u, err)
+	}
+
+	// and verifying the address doesn't hand out an account with a password,
+	setUserVerified(squatted.Id)
+	if u, err := a.Authenticate("alice", "alice-secret"); err != nil || u != nil {
+		t.Fatalf("the local account with a password was used : %v, %v", u, err)
+	}
+}
+
+func TestLDAPAccountsConfirmWithTheDirectoryPassword(t *testing.T) {
+
+	a := setupLDAP(t)
+	authenticators = []Authenticator{localAuthenticator{}, a}
+
+	u, err := a.Authenticate("alice", "alice-secret")
+	if err != nil || u == nil {
+		t.Fatalf("alice can't log in : %v", err)
+	}
+	if u = getUserById(u.Id); u.AuthSource != authLDAP {
+		t.Fatalf("the provisioned account logs in with %q", u.AuthSource)
+	}
+
+	r := httptest.NewRequest("POST", "/account", nil)
+	for password, confirmed := range map[string]bool{
+		"":             false,
+		"wrong":        false,
+		"bob-secret":   false,
+		"alice-secret": true,
+	} {
+		if confirmPassword(r, u, password) != confirmed {
+			t.Errorf("the password %q confirmed %v", password, !confirmed)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+)
+
+// How long failed logins are remembered when loginfailurewindow isn't set,
+const defaultLoginFailureWindow = 24 * 60 * 60
+
+// LoginFailures are the failed logins of an account or ip address. Only the
+// failures since the counter was last reset are kept, the counter is reset
+// after a successful login or once the failure window has passed since the
+// last failure.
+type LoginFailures struct {
+	Subject     string
+	Failures    int
+	LastFailure int64
+	LockedUntil int64
+}
+
+// accountSubject returns the subject failed logins of an account are counted
+// under.
+func accountSubject(login string) string {
+	return "login:" + strings.ToLower(html.EscapeString(strings.TrimSpace(login)))
+}
+
+// ipSubject returns the subject failed logins from an ip address are counted
+// under.
+func ipSubject(ip string) string {
+	return "ip:" + ip
+}
+
+// loginFailureWindow returns how many seconds failed logins are remembered
+// after the last one, loginfailurewindow or a day if it isn't set.
+func loginFailureWindow() int64 {
+	if configuration.LoginFailureWindow > 0 {
+		return configuration.LoginFailureWindow
+	}
+	return defaultLoginFailureWindow
+}
+
+// loginBackoff returns how long to wait after the given number of failures,
+// doubling with every failure from loginbackoffafter on, up to the lockout
+// time or the failure window.
+func loginBackoff(failures int) int64 {
+
+	if configuration.LoginBackoffAfter <= 0 || failures < configuration.LoginBackoffAfter {
+		return 0
+	}
+
+	n := failures - configuration.LoginBackoffAfter
+	if n > 30 {
+		n = 30
+	}
+	max := loginFailureWindow()
+	if configuration.LoginLockoutTime > 0 && configuration.LoginLockoutTime < max {
+		max = configuration.LoginLockoutTime
+	}
+
+	backoff := int64(1) << uint(n)
+	if backoff > max {
+		backoff = max
+	}
+
+	return backoff
+}
+
+// getLoginFailures looks up the failed logins of a subject.
+// Returns an empty LoginFailures if there are none, or the last one is older
+// than the failure window.
+func getLoginFailures(subject string) LoginFailures {
+
+	f := LoginFailures{Subject: subject}
+	err := dbHandle.QueryRow("select failures, last_failure, locked_until from "+
+		configuration.DBLoginFailuresTable+" where subject="+
+		configuration.DBPlaceHolder[0], subject).Scan(&f.Failures, &f.LastFailure,
+		&f.LockedUntil)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return f
+	case err != nil:
+		checkErr(err)
+	}
+
+	now := time.Now().Unix()
+	if f.LockedUntil <= now && now-f.LastFailure > loginFailureWindow() {
+		return LoginFailures{Subject: subject}
+	}
+
+	return f
+}
+
+// loginWait returns how many seconds the account and ip address have to wait
+// before the next login attempt, 0 if they can try right away.
+func loginWait(login string, ip string) int64 {
+
+	now := time.Now().Unix()
+	var wait int64
+	for _, subject := range []string{accountSubject(login), ipSubject(ip)} {
+		f := getLoginFailures(subject)
+		if f.LockedUntil-now > wait {
+			wait = f.LockedUntil - now
+		}
+		if next := f.LastFailure + loginBackoff(f.Failures) - now; next > wait {
+			wait = next
+		}
+	}
+
+	return wait
+}
+
+// addLoginFailure counts a failed login of the account from the ip address.
+// Accounts and ip addresses are locked out once they reach loginlockoutafter
+// failures, and the owner of a locked account is told by email.
+func addLoginFailure(login string, ip string) {
+
+	now := time.Now().Unix()
+	for _, subject := range []string{accountSubject(login), ipSubject(ip)} {
+		f := getLoginFailures(subject)
+		f.Failures++
+		f.LastFailure = now
+
+		locked := configuration.LoginLockoutAfter > 0 &&
+			f.Failures >= configuration.LoginLockoutAfter && f.LockedUntil <= now
+		if locked {
+			f.LockedUntil = now + configuration.LoginLockoutTime
+		}
+
+		stmt, err := dbHandle.Prepare("UPDATE " + configuration.DBLoginFailuresTable +
+			" SET failures=" + configuration.DBPlaceHolder[0] + ", last_failure=" +
+			configuration.DBPlaceHolder[1] + ", locked_until=" +
+			configuration.DBPlaceHolder[2] + " WHERE subject=" +
+			configuration.DBPlaceHolder[3])
+		checkErr(err)
+		res, err := stmt.Exec(f.Failures, f.LastFailure, f.LockedUntil, subject)
+		checkErr(err)
+		stmt.Close()
+
+		if n, _ := res.RowsAffected(); n == 0 {
+			stmt, err := dbHandle.Prepare("INSERT INTO " + configuration.DBLoginFailuresTable +
+				" (subject,failures,last_failure,locked_until)values(" + dbPlaceHolders(4) + ")")
+			checkErr(err)
+			_, err = stmt.Exec(subject, f.Failures, f.LastFailure, f.LockedUntil)
+			checkErr(err)
+			stmt.Close()
+		}
+
+		loggy(fmt.Sprintf("Failed login %d of %s.", f.Failures, subject))
+
+		if locked {
+			loggy(fmt.Sprintf("Locked out %s for %d seconds.", subject,
+				configuration.LoginLockoutTime))
+			if subject == accountSubject(login) {
+				if u := getUserByEmail(html.EscapeString(strings.TrimSpace(login))); u != nil {
+					sendLockoutNotice(u, f.Failures, ip)
+				}
+			}
+		}
+	}
+}
+
+// clearLoginFailures resets the failed logins of a subject.
+func clearLoginFailures(subject string) {
+
+	stmt, err := dbHandle.Prepare("DELETE FROM " + configuration.DBLoginFailuresTable +
+		" WHERE subject=" + configuration.DBPlaceHolder[0])
+	checkErr(err)
+
+	_, err = stmt.Exec(subject)
+	checkErr(err)
+	stmt.Close()
+}
+
+// isLockedOut returns true if logging in to the account with the email is
+// locked.
+func isLockedOut(email string) bool {
+	return getLoginFailures(accountSubject(html.UnescapeString(email))).LockedUntil >
+		time.Now().Unix()
+}
+
+// sendLockoutNotice tells the user that logging in to their account has been
+// locked.
+func sendLockoutNotice(u *User, failures int, ip string) {
+
+	body := "Hi " + html.UnescapeString(u.Name()) + ",\n\n" +
+		fmt.Sprintf("There were %d failed attempts to log in to your %s account, "+
+			"the last one from %s. Logging in has been blocked for %d minutes.\n\n",
+			failures, configuration.DisplayName, ip, configuration.LoginLockoutTime/60) +
+		"If this wasn't you, someone may be guessing your password. Consider " +
+		"choosing a stronger one and enabling two-factor authentication.\n"
+
+	err := mailer.Send(html.UnescapeString(u.Email), "Failed logins to your account", body)
+	if err != nil {
+		debugLogger.Println("   Mail error : " + err.Error())
+	}
+}
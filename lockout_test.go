@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginFailuresOutliveTheLockoutTime(t *testing.T) {
+
+	setupTest(t)
+
+	for _, lockout := range []int64{0, 1} {
+		configuration.LoginLockoutTime = lockout
+		configuration.LoginFailureWindow = 0
+		clearLoginFailures(ipSubject("192.0.2.1"))
+
+		addLoginFailure("alice@example.com", "192.0.2.1")
+		_, err := dbHandle.Exec("update "+configuration.DBLoginFailuresTable+
+			" set last_failure=? where subject=?", time.Now().Unix()-60, ipSubject("192.0.2.1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		addLoginFailure("alice@example.com", "192.0.2.1")
+
+		if f := getLoginFailures(ipSubject("192.0.2.1")); f.Failures != 2 {
+			t.Errorf("with a lockout time of %d, %d failures are remembered instead of 2",
+				lockout, f.Failures)
+		}
+	}
+
+	// but not beyond the failure window,
+	configuration.LoginFailureWindow = 30
+	if f := getLoginFailures(ipSubject("192.0.2.1")); f.Failures != 2 {
+		t.Errorf("%d failures within the window", f.Failures)
+	}
+	_, err := dbHandle.Exec("update "+configuration.DBLoginFailuresTable+
+		" set last_failure=? where subject=?", time.Now().Unix()-31, ipSubject("192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := getLoginFailures(ipSubject("192.0.2.1")); f.Failures != 0 {
+		t.Errorf("%d failures are remembered after the window", f.Failures)
+	}
+}
+
+func TestLoginBackoffDoublesUpToTheLockoutTime(t *testing.T) {
+
+	setupTest(t)
+
+	for _, tc := range []struct {
+		after    int
+		lockout  int64
+		window   int64
+		failures int
+		want     int64
+	}{
+		{0, 600, 0, 10, 0},
+		{3, 600, 0, 0, 0},
+		{3, 600, 0, 2, 0},
+		{3, 600, 0, 3, 1},
+		{3, 600, 0, 4, 2},
+		{3, 600, 0, 8, 32},
+		{3, 600, 0, 12, 512},
+		{3, 600, 0, 13, 600},
+		{3, 600, 0, 1000, 600},
+		{3, 0, 0, 1000, defaultLoginFailureWindow},
+		{3, 0, 100, 1000, 100},
+		{3, 600, 100, 1000, 100},
+	} {
+		configuration.LoginBackoffAfter = tc.after
+		configuration.LoginLockoutTime = tc.lockout
+		configuration.LoginFailureWindow = tc.window
+
+		if got := loginBackoff(tc.failures); got != tc.want {
+			t.Errorf("%d failures with backoff after %d, lockout %d and window %d wait %d instead of %d",
+				tc.failures, tc.after, tc.lockout, tc.window, got, tc.want)
+		}
+	}
+}
+
+func TestLockoutCoversTheAccountAndTheAddress(t *testing.T) {
+
+	setupTest(t)
+	configuration.LoginBackoffAfter = 0
+	configuration.LoginLockoutAfter = 3
+	configuration.LoginLockoutTime = 600
+	sent := recordingMailer{}
+	mailer = sent
+
+	createUser("alice@example.com", "", []byte(""))
+	for i := 0; i < 4; i++ {
+		addLoginFailure(" alice@example.com", "192.0.2.1")
+	}
+
+	for _, tc := range []struct {
+		login  string
+		ip     string
+		locked bool
+	}{
+		{"alice@example.com", "192.0.2.1", true},
+		{"ALICE@example.com", "192.0.2.2", true},
+		{"bob@example.com", "192.0.2.1", true},
+		{"bob@example.com", "192.0.2.2", false},
+	} {
+		wait := loginWait(tc.login, tc.ip)
+		if (wait > 0) != tc.locked || wait > 600 {
+			t.Errorf("%s from %s waits %d seconds", tc.login, tc.ip, wait)
+		}
+	}
+
+	if !isLockedOut("alice@example.com") || isLockedOut("bob@example.com") {
+		t.Error("the wrong account is locked")
+	}
+
+	// The owner is told once, not for every failure after the lockout,
+	if n := len(sent["alice@example.com"]); n != 1 {
+		t.Errorf("%d lockout notices were sent", n)
+	}
+
+	// and logging in again clears the account,
+	clearLoginFailures(accountSubject("alice@example.com"))
+	if isLockedOut("alice@example.com") || loginWait("alice@example.com", "192.0.2.2") != 0 {
+		t.Error("the account is still locked")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends emails to users.
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+// smtpMailer sends emails through an smtp server.
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// fileMailer appends emails to a file instead of sending them. It's meant for
+// local testing.
+type fileMailer struct {
+	path string
+	mu   sync.Mutex
+}
+
+// noMailer drops every email, so there's no verification or password reset.
+type noMailer struct{}
+
+// The mailer used to send emails, set up in main.
+var mailer Mailer
+
+// newMailer creates the mailer selected in the configuration.
+func newMailer() Mailer {
+
+	switch configuration.Mailer {
+
+	case "smtp":
+		m := &smtpMailer{
+			addr: configuration.SMTPHost + ":" + configuration.SMTPPort,
+			from: configuration.MailFrom,
+		}
+		if configuration.SMTPUser != "" {
+			m.auth = smtp.PlainAuth("", configuration.SMTPUser,
+				configuration.SMTPPassword, configuration.SMTPHost)
+		}
+		loggy("Sending emails through " + m.addr)
+		return m
+
+	case "file":
+		// The links in the emails log in whoever reads them, so they never
+		// go to the log,
+		if configuration.MailFile == "" {
+			debugLogger.Println("   Config error : The file mailer needs a mailfile.")
+			os.Exit(1)
+		}
+		loggy("Writing emails to " + configuration.MailFile)
+		return &fileMailer{path: configuration.MailFile}
+
+	case "none", "":
+		if configuration.RequireVerification {
+			debugLogger.Println("   Config error : requireverification needs a mailer.")
+			os.Exit(1)
+		}
+		loggy("Emails are disabled, there is no email verification or password reset.")
+		return noMailer{}
+
+	default:
+		debugLogger.Println("   Config error : Specified mailer (" +
+			configuration.Mailer + ") not supported.")
+		os.Exit(1)
+	}
+
+	return nil
+}
+
+// headerValue returns the value of an email header on a single line, the line
+// breaks of names users chose can't add headers.
+func headerValue(value string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+}
+
+// buildMail formats an email with the headers needed by most mail servers.
+// Subjects that aren't plain ascii are encoded.
+func buildMail(from string, to string, subject string, body string) string {
+	return "From: " + headerValue(from) + "\r\n" +
+		"To: " + headerValue(to) + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", headerValue(subject)) + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" +
+		strings.Replace(body, "\n", "\r\n", -1)
+}
+
+// Send sends the email through the smtp server.
+func (m *smtpMailer) Send(to string, subject string, body string) error {
+
+	msg := buildMail(m.from, to, subject, body)
+
+	err := smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg))
+	if err != nil {
+		loggy(fmt.Sprintf("Failed to send email to '%s' : %s", to, err))
+		return err
+	}
+
+	loggy(fmt.Sprintf("Sent email '%s' to '%s'.", subject, to))
+	return nil
+}
+
+// Send writes the email to the file.
+func (m *fileMailer) Send(to string, subject string, body string) error {
+
+	msg := buildMail(configuration.MailFrom, to, subject, body)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(msg + "\r\n\r\n")
+	return err
+}
+
+// Send drops the email.
+func (noMailer) Send(to string, subject string, body string) error {
+	loggy(fmt.Sprintf("Emails are disabled, not sending '%s' to '%s'.", subject, to))
+	return nil
+}
+
+// validEmail returns true if email is a plain address like user@example.com,
+// without a name or angle brackets.
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
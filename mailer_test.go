@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNamesFitOnOneLine(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"":                          true,
+		"ops team":                  true,
+		"Équipe opérateur":          true,
+		"ops\r\nBcc: x@example.com": false,
+		"ops\nteam":                 false,
+		"ops\tteam":                 false,
+		"ops\x00":                   false,
+		"ops\u2028team":             false,
+		"ops\u0085team":             false,
+		"\xff\xfe":                  false,
+	} {
+		if validName(name) != valid {
+			t.Errorf("validName(%q) isn't %v", name, valid)
+		}
+	}
+}
+
+func TestMailHeadersStayOnTheirLine(t *testing.T) {
+	for _, c := range []struct {
+		to, subject, header string
+	}{
+		{"bob@example.com", "You were added to ops", "Subject: You were added to ops\r\n"},
+		{"bob@example.com", "You were added to ops\r\nBcc: eve@example.com",
+			"Subject: You were added to ops  Bcc: eve@example.com\r\n"},
+		{"bob@example.com\nBcc: eve@example.com", "Hello", "To: bob@example.com Bcc: eve@example.com\r\n"},
+		{"bob@example.com", "You were added to Équipe", "Subject: =?utf-8?q?You_were_added_to_=C3=89quipe?=\r\n"},
+	} {
+		msg := buildMail("paste@example.com", c.to, c.subject, "body\n")
+		headers := msg[:strings.Index(msg, "\r\n\r\n")]
+		if !strings.Contains(headers+"\r\n", c.header) {
+			t.Errorf("the headers for %q, %q are :\n%s", c.to, c.subject, headers)
+		}
+		for _, line := range strings.Split(headers, "\r\n") {
+			if strings.HasPrefix(line, "Bcc:") || strings.ContainsAny(line, "\r\n") {
+				t.Errorf("the headers for %q, %q have the line %q", c.to, c.subject, line)
+			}
+		}
+	}
+}
+
+func TestPasteTitlesAreOneLine(t *testing.T) {
+
+	setupTest(t)
+
+	_, _, _, err := checkPasteContent("192.0.2.1", nil, "notes\r\nBcc: eve@example.com", "paste", "")
+	if e, ok := err.(*RequestError); !ok || e.Code != codeInvalidField {
+		t.Errorf("a title with a line break answered %v", err)
+	}
+	if _, _, _, err := checkPasteContent("192.0.2.1", nil, "notes", "paste", ""); err != nil {
+		t.Errorf("a plain title answered %v", err)
+	}
+}
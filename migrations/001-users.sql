@@ -0,0 +1,35 @@
+-- Moves the accounts into the users table with numeric ids, and points the
+-- pastes at their owner by id instead of by api key.
+
+CREATE TABLE `users` (
+  `id` integer NOT NULL AUTO_INCREMENT,
+  `email` varchar(255) NOT NULL,
+  `password` varchar(255) NOT NULL,
+  `displayname` varchar(255) default NULL,
+  `apikey` varchar(255) NOT NULL,
+  `created_at` int NOT NULL,
+  `disabled` int NOT NULL default 0,
+  PRIMARY KEY (`id`),
+  UNIQUE (`email`),
+  UNIQUE (`apikey`)
+);
+
+-- Accounts didn't record when they were created,
+INSERT INTO `users` (`email`, `password`, `apikey`, `created_at`)
+  SELECT `email`, `password`, `key`, 0 FROM `accounts`;
+
+CREATE TABLE `sessions` (
+  `id` char(40) NOT NULL,
+  `userid` integer NOT NULL,
+  `created_at` int NOT NULL,
+  PRIMARY KEY (`id`)
+);
+
+ALTER TABLE `pastebin` ADD COLUMN `ownerid` integer default NULL;
+
+UPDATE `pastebin` SET `ownerid` =
+  (SELECT `id` FROM `users` WHERE `users`.`apikey` = `pastebin`.`userid`);
+
+ALTER TABLE `pastebin` DROP COLUMN `userid`;
+
+DROP TABLE `accounts`;
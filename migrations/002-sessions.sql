@@ -0,0 +1,15 @@
+-- Sessions now expire and record where they were made. The old sessions are
+-- dropped, so everyone logs in again.
+
+DROP TABLE `sessions`;
+
+CREATE TABLE `sessions` (
+  `id` char(40) NOT NULL,
+  `userid` integer NOT NULL,
+  `created_at` int NOT NULL,
+  `expires_at` int NOT NULL,
+  `last_seen` int NOT NULL,
+  `ip` varchar(45) default NULL,
+  `useragent` varchar(255) default NULL,
+  PRIMARY KEY (`id`)
+);
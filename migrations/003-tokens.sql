@@ -0,0 +1,13 @@
+-- Adds personal api tokens.
+
+CREATE TABLE `tokens` (
+  `id` integer NOT NULL AUTO_INCREMENT,
+  `userid` integer NOT NULL,
+  `name` varchar(255) NOT NULL,
+  `hash` char(64) NOT NULL,
+  `scopes` varchar(255) NOT NULL,
+  `created_at` int NOT NULL,
+  `last_used` int default NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE (`hash`)
+);
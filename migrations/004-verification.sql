@@ -0,0 +1,6 @@
+-- Adds email verification. Existing accounts count as verified so they aren't
+-- locked out once requireverification is turned on, new accounts start out
+-- unverified.
+
+ALTER TABLE `users` ADD COLUMN `verified` int NOT NULL default 0;
+UPDATE `users` SET `verified`=1;
@@ -0,0 +1,10 @@
+-- Adds two-factor authentication with recovery codes.
+
+ALTER TABLE `users` ADD COLUMN `totp_secret` varchar(64) default NULL;
+ALTER TABLE `users` ADD COLUMN `totp_last` int default NULL;
+
+CREATE TABLE `recoverycodes` (
+  `userid` integer NOT NULL,
+  `hash` char(64) NOT NULL,
+  PRIMARY KEY (`userid`, `hash`)
+);
@@ -0,0 +1,6 @@
+-- Adds roles and the subject of single sign-on accounts.
+
+ALTER TABLE `users` ADD COLUMN `role` varchar(32) NOT NULL default 'user';
+ALTER TABLE `users` ADD COLUMN `oidc_subject` varchar(255) default NULL;
+
+CREATE UNIQUE INDEX `users_oidc_subject` ON `users` (`oidc_subject`);
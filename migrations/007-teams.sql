@@ -0,0 +1,20 @@
+-- Adds teams, team pastes and team tokens.
+
+ALTER TABLE `pastebin` ADD COLUMN `teamid` integer default NULL;
+ALTER TABLE `tokens` ADD COLUMN `teamid` integer default NULL;
+
+CREATE TABLE `teams` (
+  `id` integer NOT NULL AUTO_INCREMENT,
+  `name` varchar(255) NOT NULL,
+  `created_at` int NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE (`name`)
+);
+
+CREATE TABLE `teammembers` (
+  `teamid` integer NOT NULL,
+  `userid` integer NOT NULL,
+  `role` varchar(32) NOT NULL,
+  `created_at` int NOT NULL,
+  PRIMARY KEY (`teamid`, `userid`)
+);
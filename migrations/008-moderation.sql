@@ -0,0 +1,24 @@
+-- Adds quarantine, abuse reports and the audit trail of admins.
+
+ALTER TABLE `pastebin` ADD COLUMN `created_at` int default NULL;
+ALTER TABLE `pastebin` ADD COLUMN `quarantined` int NOT NULL default 0;
+
+CREATE TABLE `reports` (
+  `id` integer NOT NULL AUTO_INCREMENT,
+  `pasteid` varchar(30) NOT NULL,
+  `userid` integer default NULL,
+  `ip` varchar(45) default NULL,
+  `reason` varchar(255) NOT NULL,
+  `created_at` int NOT NULL,
+  PRIMARY KEY (`id`)
+);
+
+CREATE TABLE `audit` (
+  `id` integer NOT NULL AUTO_INCREMENT,
+  `created_at` int NOT NULL,
+  `adminid` integer NOT NULL,
+  `action` varchar(64) NOT NULL,
+  `target` varchar(255) NOT NULL,
+  `detail` varchar(255) default NULL,
+  PRIMARY KEY (`id`)
+);
@@ -0,0 +1,21 @@
+-- Adds the spam log and the word counts of the Bayesian filter.
+
+CREATE TABLE `spam` (
+  `id` integer NOT NULL AUTO_INCREMENT,
+  `created_at` int NOT NULL,
+  `ip` varchar(45) NOT NULL,
+  `userid` integer default NULL,
+  `filter` varchar(32) NOT NULL,
+  `score` float NOT NULL,
+  `reason` varchar(255) NOT NULL,
+  `title` varchar(50) NOT NULL,
+  `paste` text NOT NULL,
+  PRIMARY KEY (`id`)
+);
+
+CREATE TABLE `bayes` (
+  `token` varchar(32) NOT NULL,
+  `spam` integer NOT NULL default 0,
+  `ham` integer NOT NULL default 0,
+  PRIMARY KEY (`token`)
+);
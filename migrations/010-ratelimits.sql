@@ -0,0 +1,8 @@
+-- Adds the rate limit buckets, used with the database store.
+
+CREATE TABLE `ratelimits` (
+  `bucket` varchar(100) NOT NULL,
+  `tokens` float NOT NULL,
+  `updated_at` bigint NOT NULL,
+  PRIMARY KEY (`bucket`)
+);
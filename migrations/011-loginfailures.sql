@@ -0,0 +1,9 @@
+-- Adds the failed login counters.
+
+CREATE TABLE `loginfailures` (
+  `subject` varchar(300) NOT NULL,
+  `failures` int NOT NULL,
+  `last_failure` int NOT NULL,
+  `locked_until` int NOT NULL default 0,
+  PRIMARY KEY (`subject`)
+);
@@ -0,0 +1,3 @@
+-- Adds the language of users.
+
+ALTER TABLE `users` ADD COLUMN `locale` varchar(16) default NULL;
@@ -0,0 +1,12 @@
+-- Adds changing pastes, keeping their former versions.
+
+ALTER TABLE `pastebin` ADD COLUMN `updated_at` int default NULL;
+
+CREATE TABLE `revisions` (
+  `pasteid` varchar(30) NOT NULL,
+  `revision` integer NOT NULL,
+  `title` varchar(50) default NULL,
+  `data` longtext,
+  `created_at` int NOT NULL,
+  PRIMARY KEY (`pasteid`, `revision`)
+);
@@ -0,0 +1,14 @@
+-- Adds ssh keys on accounts.
+
+CREATE TABLE `sshkeys` (
+  `id` integer NOT NULL AUTO_INCREMENT,
+  `userid` integer NOT NULL,
+  `name` varchar(255) NOT NULL,
+  `fingerprint` varchar(64) NOT NULL,
+  `keytype` varchar(64) NOT NULL,
+  `publickey` text NOT NULL,
+  `created_at` int NOT NULL,
+  `last_used` int default NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE (`fingerprint`)
+);
@@ -0,0 +1,3 @@
+-- Adds pastes that are deleted once they're read.
+
+ALTER TABLE `pastebin` ADD COLUMN `burn` int NOT NULL default 0;
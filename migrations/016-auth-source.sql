@@ -0,0 +1,7 @@
+-- Adds where accounts log in. Accounts of the identity provider or the
+-- directory have no local password, so they are told apart from local ones.
+
+ALTER TABLE `users` ADD COLUMN `auth_source` varchar(16) NOT NULL default 'local';
+
+UPDATE `users` SET `auth_source`='oidc' WHERE `password`='' AND `oidc_subject` IS NOT NULL;
+UPDATE `users` SET `auth_source`='ldap' WHERE `password`='' AND `oidc_subject` IS NULL;
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/dchest/uniuri"
+	"github.com/gorilla/securecookie"
+	"golang.org/x/oauth2"
+)
+
+// How long the user may spend at the identity provider in seconds.
+const oidcLoginLifetime = 10 * 60
+
+// How long signing in again confirms sensitive actions in seconds.
+const reauthLifetime = 5 * 60
+
+// The pages of sensitive actions, where the user comes back to after signing
+// in again,
+var reauthPages = map[string]bool{"/account": true, "/account/2fa": true}
+
+// oidcClaims are the claims read from the id token. The role claim is parsed
+// separately since it can be a string or a list.
+type oidcClaims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	Nonce         string `json:"nonce"`
+	AuthTime      int64  `json:"auth_time"`
+}
+
+// The provider is discovered on the first login and kept afterwards, so the
+// pastebin can start while the identity provider is down.
+var oidcProvider *oidc.Provider
+var oidcProviderLock sync.Mutex
+
+// oidcEnabled returns true if single sign-on is configured.
+func oidcEnabled() bool {
+	return configuration.OIDCIssuer != "" && configuration.OIDCClientID != ""
+}
+
+// getOIDCProvider discovers the identity provider.
+func getOIDCProvider(ctx context.Context) (*oidc.Provider, error) {
+
+	oidcProviderLock.Lock()
+	defer oidcProviderLock.Unlock()
+
+	if oidcProvider != nil {
+		return oidcProvider, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, configuration.OIDCIssuer)
+	if err != nil {
+		return nil, err
+	}
+
+	loggy("Discovered identity provider " + configuration.OIDCIssuer)
+	oidcProvider = provider
+	return provider, nil
+}
+
+// oidcConfig returns the oauth2 configuration for the provider.
+func oidcConfig(provider *oidc.Provider) *oauth2.Config {
+
+	scopes := configuration.OIDCScopes
+	if len(scopes) == 0 {
+		scopes = []string{"profile", "email"}
+	}
+
+	return &oauth2.Config{
+		ClientID:     configuration.OIDCClientID,
+		ClientSecret: configuration.OIDCClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  configuration.Address + "/login/oidc/callback",
+		Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+	}
+}
+
+// mapRole maps the value of the role claim to a role using the configured
+// role map. The role with the most privileges wins.
+// Returns roleUser if nothing matches.
+func mapRole(claim interface{}) string {
+
+	var values []string
+	switch v := claim.(type) {
+	case string:
+		values = append(values, v)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	role := roleUser
+	for _, value := range values {
+		if mapped, ok := configuration.OIDCRoleMap[value]; ok &&
+			rolePriority(mapped) > rolePriority(role) {
+			role = mapped
+		}
+	}
+
+	return role
+}
+
+// oidcLoginHandler starts the authorization code flow by redirecting to the
+// identity provider. The state, nonce and PKCE verifier are kept in a signed
+// cookie until the user comes back. With reauth, the logged in user has to
+// enter their credentials again to confirm a sensitive action on that page.
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+
+	if !oidcEnabled() {
+		notFoundHandler(w, r)
+		return
+	}
+
+	provider, err := getOIDCProvider(r.Context())
+	if err != nil {
+		debugLogger.Println("   OIDC error : " + err.Error())
+		sendError(w, r, newError(http.StatusBadGateway, codeProviderDown))
+		return
+	}
+
+	value := map[string]string{
+		"state":    uniuri.NewLen(32),
+		"nonce":    uniuri.NewLen(32),
+		"verifier": oauth2.GenerateVerifier(),
+		"expires":  strconv.FormatInt(time.Now().Unix()+oidcLoginLifetime, 10),
+	}
+	opts := []oauth2.AuthCodeOption{
+		oidc.Nonce(value["nonce"]),
+		oauth2.S256ChallengeOption(value["verifier"]),
+	}
+
+	if page := r.FormValue("reauth"); page != "" {
+		u := currentUser(r)
+		if u == nil || u.AuthSource != authOIDC || !reauthPages[page] {
+			http.Redirect(w, r, "/login", 302)
+			return
+		}
+		value["reauth"] = strconv.FormatInt(u.Id, 10)
+		value["page"] = page
+		opts = append(opts, oauth2.SetAuthURLParam("prompt", "login"),
+			oauth2.SetAuthURLParam("max_age", "0"))
+	}
+
+	encoded, err := securecookie.EncodeMulti("oidc", value, cookieCodecs...)
+	checkErr(err)
+
+	http.SetCookie(w, newCookie("oidc", encoded, "/login/oidc", oidcLoginLifetime))
+
+	url := oidcConfig(provider).AuthCodeURL(value["state"], opts...)
+	http.Redirect(w, r, url, 302)
+}
+
+// oidcCallbackHandler finishes the authorization code flow. The account is
+// looked up by the subject of the id token and created on the first login.
+// The role of the account is updated from the role claim on every login.
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+
+	if !oidcEnabled() {
+		notFoundHandler(w, r)
+		return
+	}
+
+	// Get the state we started with,
+	value := make(map[string]string)
+	cookie, err := r.Cookie("oidc")
+	if err == nil {
+		err = securecookie.DecodeMulti("oidc", cookie.Value, &value, cookieCodecs...)
+	}
+	expires, _ := strconv.ParseInt(value["expires"], 10, 64)
+	if err != nil || value["state"] != r.FormValue("state") ||
+		time.Now().Unix() >= expires {
+		loggy("OIDC callback with missing or invalid state.")
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+
+	http.SetCookie(w, newCookie("oidc", "", "/login/oidc", -1))
+
+	if e := r.FormValue("error"); e != "" {
+		loggy(fmt.Sprintf("Identity provider returned an error : %s %s", e,
+			r.FormValue("error_description")))
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+
+	provider, err := getOIDCProvider(r.Context())
+	if err != nil {
+		debugLogger.Println("   OIDC error : " + err.Error())
+		sendError(w, r, newError(http.StatusBadGateway, codeProviderDown))
+		return
+	}
+
+	// Exchange the code for tokens and verify the id token,
+	token, err := oidcConfig(provider).Exchange(r.Context(), r.FormValue("code"),
+		oauth2.VerifierOption(value["verifier"]))
+	if err != nil {
+		loggy("OIDC code exchange failed : " + err.Error())
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		loggy("OIDC token response without an id token.")
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+
+	verifier := provider.Verifier(&oidc.Config{ClientID: configuration.OIDCClientID})
+	idToken, err := verifier.Verify(r.Context(), rawIDToken)
+	if err != nil {
+		loggy("OIDC id token verification failed : " + err.Error())
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+
+	var claims oidcClaims
+	var allClaims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		loggy("OIDC claims could not be parsed : " + err.Error())
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+	idToken.Claims(&allClaims)
+
+	if claims.Nonce != value["nonce"] {
+		loggy("OIDC id token with the wrong nonce.")
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+
+	loggy(fmt.Sprintf("Verified id token for subject '%s'.", claims.Subject))
+
+	if value["reauth"] != "" {
+		oidcReauthenticate(w, r, claims, value)
+		return
+	}
+
+	u := getUserBySubject(claims.Subject)
+	email := html.EscapeString(claims.Email)
+
+	// Link an existing local account if both the provider and the account
+	// vouch for the email. Anyone can sign up with an address they don't own,
+	// so unverified accounts are never linked,
+	if u == nil && claims.EmailVerified && email != "" {
+		if local := getUserByEmail(email); local != nil && local.Verified {
+			loggy(fmt.Sprintf("Linking account '%s' to subject '%s'.", email,
+				claims.Subject))
+			setUserSubject(local.Id, claims.Subject)
+			u = local
+		}
+	}
+
+	// or create a new one,
+	if u == nil {
+		if email == "" || getUserByEmail(email) != nil {
+			loggy(fmt.Sprintf("Can't provision account for subject '%s', email '%s' is missing or taken.",
+				claims.Subject, email))
+			sendError(w, r, newError(http.StatusForbidden, codeAccountRefused))
+			return
+		}
+
+		// Accounts from the identity provider don't have a local password,
+		name := html.EscapeString(claims.Name)
+		if !validName(name) {
+			name = ""
+		}
+		u = createUser(email, name, []byte(""))
+		setUserAuthSource(u.Id, authOIDC)
+		u.AuthSource = authOIDC
+		setUserSubject(u.Id, claims.Subject)
+		if claims.EmailVerified {
+			setUserVerified(u.Id)
+		}
+		loggy(fmt.Sprintf("Provisioned account '%s' with id %d for subject '%s'.",
+			email, u.Id, claims.Subject))
+	}
+
+	if u.Disabled {
+		loggy(fmt.Sprintf("Account '%s' is disabled.", u.Email))
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+
+	if configuration.OIDCRoleClaim != "" {
+		role := mapRole(allClaims[configuration.OIDCRoleClaim])
+		if role != u.Role {
+			loggy(fmt.Sprintf("Changing role of account '%s' from '%s' to '%s'.",
+				u.Email, u.Role, role))
+			setUserRole(u.Id, role)
+		}
+	}
+
+	newSession(w, r, u)
+	loggy(fmt.Sprintf("Successfully logged account '%s' in with OIDC.", u.Email))
+	http.Redirect(w, r, "/", 302)
+}
+
+// oidcReauthenticate remembers that the logged in user just entered their
+// credentials at the identity provider again, in a signed cookie confirming
+// the sensitive actions of the next minutes in this session.
+func oidcReauthenticate(w http.ResponseWriter, r *http.Request, claims oidcClaims, value map[string]string) {
+
+	u := currentUser(r)
+	owner := getUserBySubject(claims.Subject)
+	now := time.Now().Unix()
+
+	if u == nil || owner == nil || owner.Id != u.Id ||
+		strconv.FormatInt(u.Id, 10) != value["reauth"] ||
+		now-claims.AuthTime > oidcLoginLifetime {
+		loggy(fmt.Sprintf("Subject '%s' did not sign in again for the logged in account.",
+			claims.Subject))
+		http.Redirect(w, r, value["page"], 302)
+		return
+	}
+
+	confirmed := map[string]string{
+		"user":    value["reauth"],
+		"session": getSessionId(r),
+		"expires": strconv.FormatInt(now+reauthLifetime, 10),
+	}
+	encoded, err := securecookie.EncodeMulti("reauth", confirmed, cookieCodecs...)
+	checkErr(err)
+
+	http.SetCookie(w, newCookie("reauth", encoded, "/account", reauthLifetime))
+	loggy(fmt.Sprintf("Account %d signed in again with OIDC.", u.Id))
+	http.Redirect(w, r, value["page"], 302)
+}
+
+// oidcReauthenticated returns true if the user signed in again at the identity
+// provider in the last minutes, in the session of the request.
+func oidcReauthenticated(r *http.Request, u *User) bool {
+
+	cookie, err := r.Cookie("reauth")
+	if err != nil {
+		return false
+	}
+
+	value := make(map[string]string)
+	err = securecookie.DecodeMulti("reauth", cookie.Value, &value, cookieCodecs...)
+	if err != nil {
+		return false
+	}
+
+	expires, _ := strconv.ParseInt(value["expires"], 10, 64)
+	return value["user"] == strconv.FormatInt(u.Id, 10) &&
+		value["session"] != "" && value["session"] == getSessionId(r) &&
+		time.Now().Unix() < expires
+}
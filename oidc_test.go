@@ -0,0 +1,425 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// mockIssuer is a minimal OpenID Connect provider. Codes are handed out by
+// authorize and redeemed at the token endpoint, which checks the PKCE
+// verifier and signs an id token with the claims given for the code.
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+// mockGrant is what an authorization code was issued for.
+type mockGrant struct {
+	challenge string
+	claims    map[string]interface{}
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockIssuer{key: key, codes: map[string]mockGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                m.URL,
+			"authorization_endpoint":                m.URL + "/authorize",
+			"token_endpoint":                        m.URL + "/token",
+			"jwks_uri":                              m.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		m.mu.Lock()
+		grant, ok := m.codes[r.FormValue("code")]
+		delete(m.codes, r.FormValue("code"))
+		m.mu.Unlock()
+
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     m.sign(t, grant.claims),
+		})
+	})
+
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// sign returns an RS256 signed jwt with the claims.
+func (m *mockIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// authorize plays the user logging in at the provider. It reads the
+// authorization url the pastebin redirected to and issues a code for the
+// claims, with the nonce and PKCE challenge of the request unless the
+// claims set their own nonce.
+func (m *mockIssuer) authorize(t *testing.T, location string, claims map[string]interface{}) url.Values {
+
+	u, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+
+	if !strings.HasPrefix(location, m.URL+"/authorize") {
+		t.Fatalf("redirected to %s instead of the provider", location)
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("authorization request without a PKCE challenge : %s", location)
+	}
+
+	all := map[string]interface{}{
+		"iss":   m.URL,
+		"aud":   configuration.OIDCClientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": q.Get("nonce"),
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+
+	code := "code-" + q.Get("state")
+	m.mu.Lock()
+	m.codes[code] = mockGrant{challenge: q.Get("code_challenge"), claims: all}
+	m.mu.Unlock()
+
+	return url.Values{"code": {code}, "state": {q.Get("state")}}
+}
+
+// setupOIDC points the pastebin at a new mock issuer.
+func setupOIDC(t *testing.T) *mockIssuer {
+
+	setupTest(t)
+
+	m := newMockIssuer(t)
+	configuration.OIDCIssuer = m.URL
+	configuration.OIDCClientID = "pastebin"
+	configuration.OIDCClientSecret = "secret"
+	configuration.OIDCRoleClaim = "groups"
+	configuration.OIDCRoleMap = map[string]string{"pastebin-admins": roleAdmin}
+
+	oidcProvider = nil
+	t.Cleanup(func() { oidcProvider = nil })
+
+	return m
+}
+
+// oidcLogin runs a login through the mock issuer, with the claims changed by
+// tamper before the code is redeemed if it's given.
+// Returns the answer of the callback.
+func oidcLogin(t *testing.T, m *mockIssuer, claims map[string]interface{}, tamper func(url.Values)) *httptest.ResponseRecorder {
+
+	w := httptest.NewRecorder()
+	oidcLoginHandler(w, httptest.NewRequest("GET", "/login/oidc", nil))
+	if w.Code != 302 {
+		t.Fatalf("login answered %d instead of a redirect", w.Code)
+	}
+
+	query := m.authorize(t, w.Header().Get("Location"), claims)
+	if tamper != nil {
+		tamper(query)
+	}
+
+	r := httptest.NewRequest("GET", "/login/oidc/callback?"+query.Encode(), nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+
+	w = httptest.NewRecorder()
+	oidcCallbackHandler(w, r)
+	return w
+}
+
+// hasSession returns true if the answer logs someone in.
+func hasSession(w *httptest.ResponseRecorder) bool {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "session" && c.Value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestOIDCProvisionsAccountWithRole(t *testing.T) {
+
+	m := setupOIDC(t)
+
+	w := oidcLogin(t, m, map[string]interface{}{
+		"sub":            "alice-1",
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"name":           "Alice",
+		"groups":         []string{"staff", "pastebin-admins"},
+	}, nil)
+
+	if w.Code != 302 || w.Header().Get("Location") != "/" || !hasSession(w) {
+		t.Fatalf("login failed : %d to %s", w.Code, w.Header().Get("Location"))
+	}
+
+	u := getUserBySubject("alice-1")
+	if u == nil {
+		t.Fatal("no account was provisioned")
+	}
+	if u.Email != "alice@example.com" || !u.Verified {
+		t.Errorf("provisioned %s, verified %v", u.Email, u.Verified)
+	}
+	if u.Role != roleAdmin {
+		t.Errorf("role is %s instead of %s", u.Role, roleAdmin)
+	}
+
+	// The role follows the groups on the next login,
+	w = oidcLogin(t, m, map[string]interface{}{
+		"sub":    "alice-1",
+		"email":  "alice@example.com",
+		"groups": "staff",
+	}, nil)
+	if !hasSession(w) {
+		t.Fatal("second login failed")
+	}
+	if u = getUserBySubject("alice-1"); u.Role != roleUser {
+		t.Errorf("role is %s instead of %s after leaving the group", u.Role, roleUser)
+	}
+}
+
+func TestOIDCRejectsWrongNonce(t *testing.T) {
+
+	m := setupOIDC(t)
+
+	w := oidcLogin(t, m, map[string]interface{}{
+		"sub":   "mallory-1",
+		"email": "mallory@example.com",
+		"nonce": "replayed",
+	}, nil)
+
+	if hasSession(w) || w.Header().Get("Location") != "/login" {
+		t.Fatal("an id token with the wrong nonce logged in")
+	}
+	if getUserBySubject("mallory-1") != nil {
+		t.Error("an account was provisioned for the wrong nonce")
+	}
+}
+
+func TestOIDCRequiresPKCEVerifier(t *testing.T) {
+
+	m := setupOIDC(t)
+	claims := map[string]interface{}{"sub": "bob-1", "email": "bob@example.com"}
+
+	// A code issued for another challenge can't be redeemed with our verifier,
+	w := oidcLogin(t, m, claims, func(q url.Values) {
+		m.mu.Lock()
+		grant := m.codes[q.Get("code")]
+		grant.challenge = "another-challenge"
+		m.codes[q.Get("code")] = grant
+		m.mu.Unlock()
+	})
+
+	if hasSession(w) || getUserBySubject("bob-1") != nil {
+		t.Fatal("logged in with a code issued for another PKCE challenge")
+	}
+}
+
+func TestOIDCRejectsWrongState(t *testing.T) {
+
+	m := setupOIDC(t)
+
+	w := oidcLogin(t, m, map[string]interface{}{"sub": "carol-1", "email": "carol@example.com"},
+		func(q url.Values) { q.Set("state", "forged") })
+
+	if hasSession(w) || getUserBySubject("carol-1") != nil {
+		t.Fatal("logged in with a forged state")
+	}
+}
+
+func TestOIDCLinksOnlyVerifiedAccounts(t *testing.T) {
+
+	m := setupOIDC(t)
+
+	hashed, _ := bcrypt.GenerateFromPassword([]byte("squatter"), bcrypt.MinCost)
+	squatted := createUser("victim@example.com", "", hashed)
+
+	claims := map[string]interface{}{
+		"sub":            "victim-1",
+		"email":          "victim@example.com",
+		"email_verified": true,
+	}
+
+	// Someone registered the address without owning it,
+	w := oidcLogin(t, m, claims, nil)
+	if hasSession(w) || w.Code != http.StatusForbidden {
+		t.Fatalf("answered %d, an unverified account was logged into", w.Code)
+	}
+	if getUserBySubject("victim-1") != nil {
+		t.Fatal("an unverified account was linked")
+	}
+
+	// once the owner verified it, it's linked,
+	setUserVerified(squatted.Id)
+	w = oidcLogin(t, m, claims, nil)
+	if !hasSession(w) {
+		t.Fatalf("answered %d, the verified account wasn't linked", w.Code)
+	}
+	if u := getUserBySubject("victim-1"); u == nil || u.Id != squatted.Id {
+		t.Fatal("the verified account wasn't linked")
+	}
+}
+
+// oidcReauth signs the logged in user in again at the mock issuer for the
+// page, with the claims.
+// Returns the answer of the callback.
+func oidcReauth(t *testing.T, m *mockIssuer, cookies []*http.Cookie, page string, claims map[string]interface{}) *httptest.ResponseRecorder {
+
+	r := httptest.NewRequest("GET", "/login/oidc?reauth="+page, nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	oidcLoginHandler(w, r)
+
+	location, _ := url.Parse(w.Header().Get("Location"))
+	if q := location.Query(); q.Get("prompt") != "login" || q.Get("max_age") != "0" {
+		t.Fatalf("signing in again doesn't ask for the credentials : %s", location)
+	}
+	query := m.authorize(t, location.String(), claims)
+
+	r = httptest.NewRequest("GET", "/login/oidc/callback?"+query.Encode(), nil)
+	for _, c := range append(cookies, w.Result().Cookies()...) {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	oidcCallbackHandler(w, r)
+	return w
+}
+
+// setCookie returns the cookie the answer sets, nil if it doesn't set it.
+func setCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name && c.Value != "" {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestOIDCAccountsSignInAgainForSensitiveActions(t *testing.T) {
+
+	m := setupOIDC(t)
+
+	w := oidcLogin(t, m, map[string]interface{}{"sub": "alice-1", "email": "alice@example.com"}, nil)
+	session := []*http.Cookie{setCookie(w, "session")}
+	u := getUserBySubject("alice-1")
+	if u == nil || u.AuthSource != authOIDC {
+		t.Fatalf("the provisioned account is %+v", u)
+	}
+	if confirmPassword(httptest.NewRequest("POST", "/account", nil), u, "") {
+		t.Fatal("an empty password confirmed an account without one")
+	}
+
+	deleteAccount := func(cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		return postForm(func(w http.ResponseWriter, r *http.Request) {
+			for _, c := range cookies {
+				r.AddCookie(c)
+			}
+			accountHandler(w, r)
+		}, "/account", url.Values{"action": {"delete"}})
+	}
+
+	w = deleteAccount(session...)
+	if w.Header().Get("Location") != "/login/oidc?reauth=/account" || getUserById(u.Id) == nil {
+		t.Fatalf("deleting without signing in again answered %d to %s", w.Code, w.Header().Get("Location"))
+	}
+
+	for name, claims := range map[string]map[string]interface{}{
+		"another subject": {"sub": "bob-1", "email": "bob@example.com", "auth_time": time.Now().Unix()},
+		"an old login":    {"sub": "alice-1", "auth_time": time.Now().Unix() - oidcLoginLifetime - 1},
+		"no auth time":    {"sub": "alice-1"},
+	} {
+		if w = oidcReauth(t, m, session, "/account", claims); setCookie(w, "reauth") != nil {
+			t.Errorf("%s confirmed sensitive actions", name)
+		}
+	}
+
+	w = oidcReauth(t, m, session, "/account", map[string]interface{}{"sub": "alice-1", "auth_time": time.Now().Unix()})
+	reauth := setCookie(w, "reauth")
+	if reauth == nil || w.Header().Get("Location") != "/account" {
+		t.Fatalf("signing in again answered %d to %s", w.Code, w.Header().Get("Location"))
+	}
+
+	// The confirmation only holds in the session it was made in,
+	other := oidcLogin(t, m, map[string]interface{}{"sub": "alice-1", "email": "alice@example.com"}, nil)
+	deleteAccount(setCookie(other, "session"), reauth)
+	if getUserById(u.Id) == nil {
+		t.Fatal("the confirmation of another session deleted the account")
+	}
+
+	deleteAccount(append(session, reauth)...)
+	if getUserById(u.Id) != nil {
+		t.Fatal("the account wasn't deleted after signing in again")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The variables of the paths that are numbers, the others are strings,
+var integerPathVars = map[string]bool{"revision": true, "tokenId": true}
+
+var pathVarRegexp = regexp.MustCompile(`\{([A-Za-z]+)\}`)
+
+// openAPIDocument describes the v2 api as an openapi 3 document, set up from
+// apiRoutes.
+func openAPIDocument() map[string]interface{} {
+
+	schemas := map[string]interface{}{
+		"APIError": openAPISchema(reflect.TypeOf(APIError{}), nil),
+	}
+
+	paths := make(map[string]interface{})
+	for _, route := range apiRoutes {
+		op := map[string]interface{}{
+			"operationId": route.Name,
+			"summary":     route.Summary,
+			"security": []interface{}{
+				map[string]interface{}{"token": []string{route.Scope}},
+				map[string]interface{}{"session": []string{}},
+			},
+		}
+
+		var params []interface{}
+		for _, m := range pathVarRegexp.FindAllStringSubmatch(route.Path, -1) {
+			typ := "string"
+			if integerPathVars[m[1]] {
+				typ = "integer"
+			}
+			params = append(params, map[string]interface{}{
+				"name": m[1], "in": "path", "required": true,
+				"schema": map[string]interface{}{"type": typ},
+			})
+		}
+		for _, p := range route.Params {
+			params = append(params, map[string]interface{}{
+				"name": p.Name, "in": p.In, "description": p.Description,
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+
+		if route.Request != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": openAPISchema(reflect.TypeOf(route.Request), schemas),
+					},
+				},
+			}
+		}
+
+		success := map[string]interface{}{"description": http.StatusText(route.Status)}
+		if route.Response != nil {
+			success["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": openAPISchema(reflect.TypeOf(route.Response), schemas),
+				},
+			}
+		}
+		op["responses"] = map[string]interface{}{
+			strconv.Itoa(route.Status): success,
+			"default": map[string]interface{}{
+				"description": "Error",
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": map[string]interface{}{"$ref": "#/components/schemas/APIError"},
+					},
+				},
+			},
+		}
+
+		item, ok := paths[route.Path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[route.Path] = item
+		}
+		item[strings.ToLower(route.Method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   configuration.DisplayName,
+			"version": "2",
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": configuration.Address + "/api/v2"},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"token":   map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"session": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": "session"},
+			},
+		},
+	}
+}
+
+// openAPISchema returns the schema of a type. Structs are added to schemas and
+// referenced, unless schemas is nil.
+func openAPISchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return openAPISchema(t.Elem(), schemas)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": openAPISchema(t.Elem(), schemas)}
+	case reflect.Struct:
+	default:
+		return map[string]interface{}{}
+	}
+
+	props := make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		props[name] = openAPISchema(t.Field(i).Type, schemas)
+	}
+	schema := map[string]interface{}{"type": "object", "properties": props}
+
+	if schemas == nil {
+		return schema
+	}
+	if _, ok := schemas[t.Name()]; !ok {
+		schemas[t.Name()] = schema
+	}
+	return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+}
@@ -5,6 +5,7 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/sha1"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -17,6 +18,7 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	// Random string generation,
@@ -30,47 +32,128 @@ import (
 
 	// For url routing
 	"github.com/gorilla/mux"
-	// securecookie for cookie handling
-	"github.com/gorilla/securecookie"
 	// bcrypt for password hashing
 	"golang.org/x/crypto/bcrypt"
 )
 
 // Configuration struct,
 type Configuration struct {
-	Address         string    `json:"address"`    // Url to to the pastebin
-	DBHost          string    `json:"dbhost"`     // Name of your database host
-	DBName          string    `json:"dbname"`     // Name of your database
-	DBPassword      string    `json:"dbpassword"` // The password for the database user
-	DBPlaceHolder   [7]string // ? / $[i] Depending on db driver.
-	DBPort          string    `json:"dbport"`                // Port of the database
-	DBTable         string    `json:"dbtable"`               // Name of the table in the database
-	DBAccountsTable string    `json:"dbaccountstable"`       // Name of the table in the database
-	DBType          string    `json:"dbtype"`                // Type of database
-	DBUser          string    `json:"dbuser"`                // The database user
-	DisplayName     string    `json:"displayname"`           // Name of your pastebin
-	GoogleAPIKey    string    `json:"googleapikey"`          // Your google api key
-	Highlighter     string    `json:"highlighter"`           // The name of the highlighter.
-	ListenAddress   string    `json:"listenaddress"`         // Address that pastebin will bind on
-	ListenPort      string    `json:"listenport"`            // Port that pastebin will listen on
-	ShortUrlLength  int       `json:"shorturllength,string"` // Length of the generated short urls
+	Address              string     `json:"address"`    // Url to to the pastebin
+	AssetsDir            string     `json:"assetsdir"`  // Directory with templates and assets replacing the built-in ones
+	DBHost               string     `json:"dbhost"`     // Name of your database host
+	DBName               string     `json:"dbname"`     // Name of your database
+	DBPassword           string     `json:"dbpassword"` // The password for the database user
+	DBPlaceHolder        [10]string // ? / $[i] Depending on db driver.
+	DBPort               string     `json:"dbport"`                // Port of the database
+	DBTable              string     `json:"dbtable"`               // Name of the table in the database
+	DBUsersTable         string     `json:"dbuserstable"`          // Name of the users table in the database
+	DBSessionsTable      string     `json:"dbsessionstable"`       // Name of the sessions table in the database
+	DBTokensTable        string     `json:"dbtokenstable"`         // Name of the api tokens table in the database
+	DBRecoveryTable      string     `json:"dbrecoverytable"`       // Name of the 2fa recovery codes table in the database
+	DBTeamsTable         string     `json:"dbteamstable"`          // Name of the teams table in the database
+	DBMembersTable       string     `json:"dbmemberstable"`        // Name of the team members table in the database
+	DBReportsTable       string     `json:"dbreportstable"`        // Name of the abuse reports table in the database
+	DBAuditTable         string     `json:"dbaudittable"`          // Name of the admin audit trail table in the database
+	DBSpamTable          string     `json:"dbspamtable"`           // Name of the rejected submissions table in the database
+	DBBayesTable         string     `json:"dbbayestable"`          // Name of the spam classifier table in the database
+	DBRateLimitsTable    string     `json:"dbratelimitstable"`     // Name of the rate limit buckets table in the database
+	DBLoginFailuresTable string     `json:"dbloginfailurestable"`  // Name of the failed logins table in the database
+	DBRevisionsTable     string     `json:"dbrevisionstable"`      // Name of the paste revisions table in the database
+	DBKeysTable          string     `json:"dbkeystable"`           // Name of the ssh keys table in the database
+	DBType               string     `json:"dbtype"`                // Type of database
+	DBUser               string     `json:"dbuser"`                // The database user
+	DefaultLocale        string     `json:"defaultlocale"`         // Locale of browsers not asking for a known one
+	DisplayName          string     `json:"displayname"`           // Name of your pastebin
+	GoogleAPIKey         string     `json:"googleapikey"`          // Your google api key
+	Highlighter          string     `json:"highlighter"`           // The name of the highlighter.
+	ListenAddress        string     `json:"listenaddress"`         // Address that pastebin will bind on
+	ListenPort           string     `json:"listenport"`            // Port that pastebin will listen on
+	TCPListenAddress     string     `json:"tcplistenaddress"`      // Address the netcat listener will bind on
+	TCPListenPort        string     `json:"tcplistenport"`         // Port of the netcat listener, empty to disable it
+	TCPTimeout           int64      `json:"tcptimeout,string"`     // Seconds without data before a netcat paste is saved
+	SSHListenAddress     string     `json:"sshlistenaddress"`      // Address the ssh server will bind on
+	SSHListenPort        string     `json:"sshlistenport"`         // Port of the ssh server, empty to disable it
+	SSHHostKey           string     `json:"sshhostkey"`            // File with the private host key, generated if missing
+	ShortUrlLength       int        `json:"shorturllength,string"` // Length of the generated short urls
+
+	CookieKeys      []CookieKeys `json:"cookiekeys"`             // Session cookie keys, the first pair signs new cookies
+	SessionLifetime int64        `json:"sessionlifetime,string"` // Lifetime of a session in seconds
+
+	Mailer              string `json:"mailer"`                 // smtp, file or none
+	MailFile            string `json:"mailfile"`               // File the file mailer writes to
+	MailFrom            string `json:"mailfrom"`               // Sender address of emails
+	SMTPHost            string `json:"smtphost"`               // Host of the smtp server
+	SMTPPort            string `json:"smtpport"`               // Port of the smtp server
+	SMTPUser            string `json:"smtpuser"`               // The smtp user, empty to skip authentication
+	SMTPPassword        string `json:"smtppassword"`           // The password for the smtp user
+	RequireVerification bool   `json:"requireverification"`    // Block login until the email is verified
+	DisableRegistration bool   `json:"disableregistration"`    // Only allow accounts from single sign-on
+	ReportThreshold     int    `json:"reportthreshold,string"` // Quarantine pastes after this many reports, 0 to never
+	SecretScan          string `json:"secretscan"`             // off, warn, redact or reject pastes with secrets
+	SecretRules         string `json:"secretrules"`            // File with extra secret rules, empty for the built-in ones
+
+	SpamFilters   []string `json:"spamfilters"`          // Spam filters run in order, honeypot, size, links, words and/or bayes
+	SpamThreshold float64  `json:"spamthreshold,string"` // Reject pastes once the filters score this much, 0 to never
+	MaxPasteSize  int      `json:"maxpastesize,string"`  // Largest paste in bytes, 0 for no limit
+	SpamMaxLinks  int      `json:"spammaxlinks,string"`  // Most links in a paste, 0 for no limit
+	SpamWords     string   `json:"spamwords"`            // File with banned words, one per line
+	SpamWordScore float64  `json:"spamwordscore,string"` // Score of every banned word found
+
+	RateLimits     map[string]RateLimit `json:"ratelimits"`     // Token buckets of the create, read, render and login routes
+	RateLimitStore string               `json:"ratelimitstore"` // memory, or sql to share the buckets between instances
+	TrustedProxies []string             `json:"trustedproxies"` // Proxies whose X-Forwarded-For is trusted, addresses or networks
+
+	LoginBackoffAfter  int   `json:"loginbackoffafter,string"`  // Failed logins before waiting between attempts, 0 to never
+	LoginLockoutAfter  int   `json:"loginlockoutafter,string"`  // Failed logins before locking out, 0 to never
+	LoginLockoutTime   int64 `json:"loginlockouttime,string"`   // Seconds a lockout lasts
+	LoginFailureWindow int64 `json:"loginfailurewindow,string"` // Seconds failed logins are remembered after the last one, 0 for a day
+
+	OIDCName         string            `json:"oidcname"`         // Name of the login button
+	OIDCIssuer       string            `json:"oidcissuer"`       // Issuer url of the identity provider
+	OIDCClientID     string            `json:"oidcclientid"`     // Client id registered at the provider
+	OIDCClientSecret string            `json:"oidcclientsecret"` // Client secret registered at the provider
+	OIDCScopes       []string          `json:"oidcscopes"`       // Scopes to request besides openid
+	OIDCRoleClaim    string            `json:"oidcroleclaim"`    // Claim holding the groups or roles of the user
+	OIDCRoleMap      map[string]string `json:"oidcrolemap"`      // Maps values of the role claim to roles
+
+	Authenticators     []string `json:"authenticators"`     // Password checks tried in order, local and/or ldap
+	LDAPURL            string   `json:"ldapurl"`            // ldap:// or ldaps:// url of the directory
+	LDAPStartTLS       bool     `json:"ldapstarttls"`       // Upgrade ldap:// connections with StartTLS
+	LDAPBindDN         string   `json:"ldapbinddn"`         // Service account used to search, empty for anonymous
+	LDAPBindPassword   string   `json:"ldapbindpassword"`   // The password for the service account
+	LDAPBaseDN         string   `json:"ldapbasedn"`         // Where to search for users
+	LDAPUserFilter     string   `json:"ldapuserfilter"`     // Search filter, %s is replaced by the login
+	LDAPEmailAttribute string   `json:"ldapemailattribute"` // Attribute holding the email
+	LDAPNameAttribute  string   `json:"ldapnameattribute"`  // Attribute holding the display name
+	LDAPGroupAttribute string   `json:"ldapgroupattribute"` // Attribute listing the groups of the user
+	LDAPRequiredGroups []string `json:"ldaprequiredgroups"` // Group dns allowed to log in, empty for everyone
+
+	Theme            string       `json:"theme"`            // Template set in themes/ of the assets, empty for the built-in one
+	ThemeLogo        string       `json:"themelogo"`        // Asset shown in the navbar instead of Home
+	ThemeColors      ThemeColors  `json:"themecolors"`      // Colours replacing the material design ones
+	ThemeFooterLinks []FooterLink `json:"themefooterlinks"` // Links in the footer of every page
+	ThemeStyle       string       `json:"themestyle"`       // Highlight style of pastes without one
+	ThemeCSS         string       `json:"themecss"`         // Asset with extra css, linked after the built-in styles
 }
 
 // This struct is used for responses.
 // A request to the pastebin will always this json struct.
 type Response struct {
-	DelKey string `json:"delkey"` // The id to use when delete a paste
-	Expiry string `json:"expiry"` // The date when post expires
-	Extra  string `json:"extra"`  // Extra output from the highlight-wrapper
-	Id     string `json:"id"`     // The id of the paste
-	Lang   string `json:"lang"`   // Specified language
-	Paste  string `json:"paste"`  // The eactual paste data
-	Sha1   string `json:"sha1"`   // The sha1 of the paste
-	Size   int    `json:"size"`   // The length of the paste
-	Status string `json:"status"` // A custom status message
-	Style  string `json:"style"`  // Specified style
-	Title  string `json:"title"`  // The title of the paste
-	Url    string `json:"url"`    // The url of the paste
+	DelKey      string `json:"delkey"`                // The id to use when delete a paste
+	Expiry      string `json:"expiry"`                // The date when post expires
+	Extra       string `json:"extra"`                 // Extra output from the highlight-wrapper
+	Code        string `json:"code,omitempty"`        // Machine readable status, the same in every locale
+	Id          string `json:"id"`                    // The id of the paste
+	Lang        string `json:"lang"`                  // Specified language
+	Paste       string `json:"paste"`                 // The eactual paste data
+	Quarantined bool   `json:"quarantined,omitempty"` // Only shown to admins
+	Burn        bool   `json:"burn,omitempty"`        // Deleted once read by anyone but its owner
+	Sha1        string `json:"sha1"`                  // The sha1 of the paste
+	Size        int    `json:"size"`                  // The length of the paste
+	Status      string `json:"status"`                // A custom status message
+	Style       string `json:"style"`                 // Specified style
+	Title       string `json:"title"`                 // The title of the paste
+	Url         string `json:"url"`                   // The url of the paste
 }
 
 // This struct is used for indata when a request is being made to the pastebin.
@@ -81,9 +164,12 @@ type Request struct {
 	Lang    string `json:"lang"`          // The language of the paste
 	Paste   string `json:"paste"`         // The actual pase
 	Style   string `json:"style"`         // The style of the paste
+	Team    int64  `json:"team,string"`   // The team to save the paste into
+	Burn    bool   `json:"burn"`          // Delete the paste once it's read
 	Title   string `json:"title"`         // The title of the paste
-	UserKey string `json:"key"`           // The title of the paste
+	UserKey string `json:"key"`           // Deprecated, use an api token instead
 	WebReq  bool   `json:"webreq"`        // If its a webrequest or not
+	Website string `json:"website"`       // Hidden in the paste form, only bots fill it in
 }
 
 // This struct is used for generating pages.
@@ -96,6 +182,7 @@ type Page struct {
 	LangsLast       map[string]string
 	PasteTitle      string
 	Style           string
+	StyleCSS        template.CSS
 	SupportedStyles map[string]string
 	Title           string
 	UrlAddress      string
@@ -105,32 +192,51 @@ type Page struct {
 	UrlRaw          string
 	WrapperErr      string
 	UserKey         string
+	User            *User
+	Message         string
+	FormToken       string
+	SSOName         string
+	AllowRegister   bool
+	Locales         []Locale
+	Teams           []Team
+	PasteId         string
+	Quarantined     bool
+	ReportReasons   []string
+	CSRFToken       string
+	CSPNonce        string
+	Theme           Theme
 }
 type Pastes struct {
 	Response []Response
 }
 
-// Template pages,
-var templates = template.Must(template.ParseFiles("assets/index.html",
-	"assets/syntax.html",
-	"assets/register.html",
-	"assets/pastes.html",
-	"assets/login.html"))
+// This struct is used for generating the pastes page, with the pastes of each
+// team below the pastes of the user.
+type PastesPage struct {
+	Response  []Response
+	Teams     []TeamPastes
+	CSRFToken string
+	CSPNonce  string
+	Theme     Theme
+}
+type TeamPastes struct {
+	Team     Team
+	Response []Response
+}
 
 // Global variables, *shrug*
 var configuration Configuration
 var dbHandle *sql.DB
 var debug bool
+var reset2FAEmail string
+var makeAdminEmail string
 var debugLogger *log.Logger
 var listOfLangsFirst map[string]string
 var listOfLangsLast map[string]string
 var listOfStyles map[string]string
-
-// generate new random cookie keys
-var cookieHandler = securecookie.New(
-	securecookie.GenerateRandomKey(64),
-	securecookie.GenerateRandomKey(32),
-)
+var styleSheets = make(map[string]template.CSS)
+var styleSheetsLock sync.Mutex
+var templates *template.Template
 
 //
 // Functions below,
@@ -143,12 +249,12 @@ func loggy(str string) {
 	}
 }
 
-// checkErr simply checks if passed error is anything but nil.
-// If an error exists it will be printed and the program terminates.
-func checkErr(err error) {
+// sendJSON answers a request with data as json.
+func sendJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
 	if err != nil {
-		debugLogger.Println("   " + err.Error())
-		os.Exit(1)
+		loggy("Could not send json : " + err.Error())
 	}
 }
 
@@ -177,6 +283,28 @@ func getSupportedStyles() {
 	}
 }
 
+// getStyleSheet returns the css of a highlight style from the
+// highlighter-wrapper, the highlighted pastes only carry classes. The sheets
+// are kept once read.
+func getStyleSheet(style string) template.CSS {
+
+	styleSheetsLock.Lock()
+	defer styleSheetsLock.Unlock()
+
+	if css, ok := styleSheets[style]; ok {
+		return css
+	}
+
+	out, err := exec.Command(configuration.Highlighter, "getcss", style).Output()
+	if err != nil {
+		loggy(fmt.Sprintf("Could not get the css of style '%s' : %s", style, err))
+		return ""
+	}
+
+	styleSheets[style] = template.CSS(out)
+	return styleSheets[style]
+}
+
 // getSupportedLangs reads supported lexers from the highlighter-wrapper (which
 // in turn gets available lexers from pygments). It then puts them into two
 // maps, depending on if it's a "prioritized" lexers. If it's prioritized or not
@@ -194,7 +322,7 @@ func getSupportedLangs() {
 	listOfLangsLast = make(map[string]string)
 
 	// Get prioritized lexers and put them in a separate map,
-	file, err := os.Open("assets/prio-lexers")
+	file, err := assetsFS().Open("prio-lexers")
 	checkErr(err)
 
 	scanner := bufio.NewScanner(file)
@@ -248,12 +376,19 @@ func printHelp(err int) {
 	fmt.Printf("      No more no less.\n\n")
 
 	fmt.Printf(" Usage, \n")
-	fmt.Printf("    - %s [--help] [--debug]\n\n", os.Args[0])
+	fmt.Printf("    - %s [--help] [--debug] [--reset-2fa email] [--make-admin email]\n", os.Args[0])
+	fmt.Printf("    - %s put|get|rm|ls [options] [args]\n\n", os.Args[0])
 
 	fmt.Printf(" Where, \n")
 	fmt.Printf("    - help shows this incredibly useful help.\n")
 	fmt.Printf("    - debug shows quite detailed information about whats")
-	fmt.Printf(" going on.\n\n")
+	fmt.Printf(" going on.\n")
+	fmt.Printf("    - reset-2fa disables two-factor authentication for the")
+	fmt.Printf(" account with the given email and exits.\n")
+	fmt.Printf("    - make-admin gives the account with the given email the")
+	fmt.Printf(" admin role and exits.\n")
+	fmt.Printf("    - put, get, rm and ls run as a client of the server in")
+	fmt.Printf(" ~/.config/pastebin/client.json, see -h of each command.\n\n")
 
 	os.Exit(err)
 }
@@ -261,16 +396,27 @@ func printHelp(err int) {
 // checkArgs parses the command line in a very simple manner.
 func checkArgs() {
 
-	if len(os.Args[1:]) >= 1 {
-		for _, arg := range os.Args[1:] {
-			switch arg {
-			case "-h", "--help":
-				printHelp(0)
-			case "-d", "--debug":
-				debug = true
-			default:
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-h", "--help":
+			printHelp(0)
+		case "-d", "--debug":
+			debug = true
+		case "--reset-2fa":
+			if i+1 >= len(args) {
+				printHelp(1)
+			}
+			i++
+			reset2FAEmail = args[i]
+		case "--make-admin":
+			if i+1 >= len(args) {
 				printHelp(1)
 			}
+			i++
+			makeAdminEmail = args[i]
+		default:
+			printHelp(1)
 		}
 	}
 }
@@ -280,7 +426,7 @@ func checkArgs() {
 func getDBHandle() *sql.DB {
 
 	var dbinfo string
-	for i := 0; i < 7; i++ {
+	for i := range configuration.DBPlaceHolder {
 		configuration.DBPlaceHolder[i] = "?"
 	}
 
@@ -299,7 +445,7 @@ func getDBHandle() *sql.DB {
 			configuration.DBUser,
 			configuration.DBPassword,
 			configuration.DBName)
-		for i := 0; i < 7; i++ {
+		for i := range configuration.DBPlaceHolder {
 			configuration.DBPlaceHolder[i] = "$" + strconv.Itoa(i+1)
 		}
 
@@ -335,6 +481,18 @@ func getDBHandle() *sql.DB {
 	return db
 }
 
+// dbPlaceHolders returns n comma separated placeholders for use in a query.
+// This is needed since mysql/postgres uses different placeholders.
+func dbPlaceHolders(n int) string {
+
+	var dbQuery string
+	for i := 0; i < n; i++ {
+		dbQuery += configuration.DBPlaceHolder[i] + ","
+	}
+
+	return dbQuery[:len(dbQuery)-1]
+}
+
 // generateName generates a short url with the length defined in main config
 // The function calls itself recursively until an id that doesn't exist is found
 // Returns the id
@@ -355,8 +513,7 @@ func generateName() string {
 	case err == sql.ErrNoRows:
 		loggy(fmt.Sprintf("Id '%s' is not taken, will use it.", id))
 	case err != nil:
-		debugLogger.Println("   Database error : " + err.Error())
-		os.Exit(1)
+		checkErr(err)
 	default:
 		loggy(fmt.Sprintf("Id '%s' is taken, generating new id.", id_taken))
 		generateName()
@@ -383,37 +540,57 @@ func shaPaste(paste string) string {
 // title, title of the paste as string,
 // paste, the actual paste data as a string,
 // expiry, the epxpiry date in epoch time as an int64
+// ownerId, the id of the user owning the paste, 0 for anonymous pastes
+// teamId, the id of the team the paste is private to, 0 for public pastes
+// burn, true to delete the paste once it's read
 // Returns the Response struct
-func savePaste(title string, paste string, expiry int64, user_key string) Response {
+func savePaste(title string, paste string, expiry int64, ownerId int64, teamId int64, burn bool) Response {
 
 	var id, hash, delkey, url string
 
 	// Escape user input,
 	paste = html.EscapeString(paste)
 	title = html.EscapeString(title)
-	user_key = html.EscapeString(user_key)
 
 	// Hash paste data and query database to see if paste exists
 	sha := shaPaste(paste)
 	loggy("Checking if pasted data is already in the database.")
 
-	err := dbHandle.QueryRow("select id, title, hash, data, delkey from "+
-		configuration.DBTable+" where hash="+
-		configuration.DBPlaceHolder[0], sha).Scan(&id,
-		&title, &hash, &paste, &delkey)
+	// Only look at live pastes of the same team, or of the same owner outside
+	// of teams, so nobody learns about the pastes of others by pasting the same
+	// data. Pastes that burn after reading are never shared,
+	query := "select id, title, hash, data, delkey from " + configuration.DBTable +
+		" where hash=" + configuration.DBPlaceHolder[0] + " and burn=0 and quarantined=0" +
+		" and (expiry is NULL or expiry=0 or expiry>" + configuration.DBPlaceHolder[1] + ")"
+	args := []interface{}{sha, time.Now().Unix()}
+	switch {
+	case teamId != 0:
+		query += " and teamid=" + configuration.DBPlaceHolder[2]
+		args = append(args, teamId)
+	case ownerId != 0:
+		query += " and teamid is NULL and ownerid=" + configuration.DBPlaceHolder[2]
+		args = append(args, ownerId)
+	default:
+		query += " and teamid is NULL and ownerid is NULL"
+	}
+
+	err := sql.ErrNoRows
+	if !burn {
+		err = dbHandle.QueryRow(query, args...).Scan(&id, &title, &hash, &paste, &delkey)
+	}
 	switch {
 	case err == sql.ErrNoRows:
 		loggy("Pasted data is not in the database, will insert it.")
 	case err != nil:
-		debugLogger.Println("   Database error : " + err.Error())
-		os.Exit(1)
+		checkErr(err)
 	default:
 		loggy(fmt.Sprintf("Pasted data already exists at id '%s' with title '%s'.",
 			id, html.UnescapeString(title)))
 
 		url = configuration.Address + "/p/" + id
 		return Response{
-			Status: "Paste data already exists ...",
+			Code:   codePasteExists,
+			Status: statusMessages[codePasteExists],
 			Id:     id,
 			Title:  title,
 			Sha1:   hash,
@@ -437,17 +614,19 @@ func savePaste(title string, paste string, expiry int64, user_key string) Respon
 
 	delKey := uniuri.NewLen(40)
 
-	// This is needed since mysql/postgres uses different placeholders,
-	var dbQuery string
-	for i := 0; i < 7; i++ {
-		dbQuery += configuration.DBPlaceHolder[i] + ","
+	// Anonymous pastes don't have an owner and public pastes don't have a team,
+	owner := sql.NullInt64{Int64: ownerId, Valid: ownerId != 0}
+	team := sql.NullInt64{Int64: teamId, Valid: teamId != 0}
+
+	burnFlag := 0
+	if burn {
+		burnFlag = 1
 	}
-	dbQuery = dbQuery[:len(dbQuery)-1]
 
-	stmt, err := dbHandle.Prepare("INSERT INTO " + configuration.DBTable + " (id,title,hash,data,delkey,expiry,userid)values(" + dbQuery + ")")
+	stmt, err := dbHandle.Prepare("INSERT INTO " + configuration.DBTable + " (id,title,hash,data,delkey,expiry,ownerid,teamid,burn,created_at)values(" + dbPlaceHolders(10) + ")")
 	checkErr(err)
 
-	_, err = stmt.Exec(id, title, sha, paste, delKey, expiry, user_key)
+	_, err = stmt.Exec(id, title, sha, paste, delKey, expiry, owner, team, burnFlag, time.Now().Unix())
 	checkErr(err)
 
 	loggy(fmt.Sprintf("Sucessfully inserted data at id '%s', title '%s', expiry '%v' and data \n \n* * * *\n\n%s\n\n* * * *\n",
@@ -459,13 +638,77 @@ func savePaste(title string, paste string, expiry int64, user_key string) Respon
 	checkErr(err)
 
 	return Response{
-		Status: "Successfully saved paste.",
+		Code:   codePasteSaved,
+		Status: statusMessages[codePasteSaved],
 		Id:     id,
 		Title:  title,
 		Sha1:   hash,
 		Url:    url,
 		Size:   len(paste),
-		DelKey: delKey}
+		DelKey: delKey,
+		Burn:   burn}
+}
+
+// getPasteDelKey gets the delkey of a paste from the database.
+// Returns false if the paste doesn't exist.
+func getPasteDelKey(pasteId string) (string, bool) {
+
+	var delKey string
+	err := dbHandle.QueryRow("select delkey from "+configuration.DBTable+
+		" where id="+configuration.DBPlaceHolder[0], pasteId).Scan(&delKey)
+	if err == sql.ErrNoRows {
+		return "", false
+	}
+	checkErr(err)
+
+	return delKey, true
+}
+
+// checkPasteChange checks that a paste may be changed or deleted, by its owner
+// and team editors, or by anyone with the delkey.
+// Returns an error if the paste doesn't exist or the user isn't allowed to.
+func checkPasteChange(r *http.Request, u *User, pasteId string, delKey string, action string) error {
+
+	key, ok := getPasteDelKey(pasteId)
+	if !ok {
+		return newError(http.StatusNotFound, codeNotFound)
+	}
+
+	if delKey == "" && u != nil {
+		// The owner and team editors don't need the delkey. Team pastes
+		// belong to the team, so their creator needs to still be an editor,
+		ownerId, teamId := getPasteOwner(pasteId)
+		allowed := ownerId == u.Id && u.Team == 0
+		if teamId != 0 {
+			allowed = hasTeamRole(u, teamId, teamEditor)
+		}
+		if !allowed {
+			return newError(http.StatusForbidden, codeForbidden, tr(r, action))
+		}
+		return nil
+	}
+
+	// A wrong delkey looks the same as a missing paste,
+	if delKey == "" || subtle.ConstantTimeCompare([]byte(delKey), []byte(key)) != 1 {
+		return newError(http.StatusNotFound, codeNotFound)
+	}
+
+	return nil
+}
+
+// removePaste deletes a paste for the owner, team editors or anyone with the
+// delkey.
+// Returns an error if the paste can't be deleted by them.
+func removePaste(r *http.Request, u *User, pasteId string, delKey string) error {
+
+	loggy(fmt.Sprintf("Trying to delete paste with id '%s'", pasteId))
+	err := checkPasteChange(r, u, pasteId, delKey, "delete this paste")
+	if err != nil {
+		return err
+	}
+
+	delPaste(pasteId)
+	return nil
 }
 
 // DelHandler handles the deletion of pastes.
@@ -475,7 +718,7 @@ func DelHandler(w http.ResponseWriter, r *http.Request) {
 	var inData Request
 	loggy(fmt.Sprintf("Recieving request to delete a paste, trying to parse indata."))
 	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&inData)
+	decoder.Decode(&inData)
 
 	inData.Id = vars["pasteId"]
 
@@ -483,74 +726,185 @@ func DelHandler(w http.ResponseWriter, r *http.Request) {
 	inData.DelKey = html.EscapeString(inData.DelKey)
 	inData.Id = html.EscapeString(inData.Id)
 
-	fmt.Printf("Trying to delete paste with id '%s' and delkey '%s'\n",
-		inData.Id, inData.DelKey)
-	stmt, err := dbHandle.Prepare("delete from pastebin where delkey=" +
-		configuration.DBPlaceHolder[0] + " and id=" +
-		configuration.DBPlaceHolder[1])
-	checkErr(err)
-	res, err := stmt.Exec(inData.DelKey, inData.Id)
-	checkErr(err)
+	u, ok := apiUser(w, r, scopeDelete)
+	if !ok {
+		return
+	}
+
+	err := removePaste(r, u, inData.Id, inData.DelKey)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
 
-	_, err = res.RowsAffected()
+	sendJSON(w, Response{
+		Code:   codePasteDeleted,
+		Status: statusText(r, codePasteDeleted, inData.Id),
+	})
+}
 
-	if err != sql.ErrNoRows {
-		w.Header().Set("Content-Type", "application/json")
-		b := Response{Status: "Deleted paste " + inData.Id}
-		err := json.NewEncoder(w).Encode(b)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+// checkPasteContent checks a new paste, or the new content of a paste, before
+// it's stored. Spam is refused, from everyone but admins, and secrets are
+// handled as secretscan says. The ip address is the one the paste came from.
+// Returns the paste to store, with redacted secrets, the code of the status to
+// answer with and the names of the secrets found, or an error if the paste is
+// refused.
+func checkPasteContent(ip string, u *User, title string, paste string, honeypot string) (string, string, string, error) {
+
+	// Return error if we don't have any data at all
+	if paste == "" {
+		return "", "", "", newError(http.StatusBadRequest, codeEmptyPaste)
+	}
+
+	// Return error if title is to long
+	if len(title) > 50 {
+		loggy(fmt.Sprintf("Paste title to long (%v).", len(title)))
+		return "", "", "", newError(http.StatusBadRequest, codeTitleTooLong)
+	}
+	if !validName(title) {
+		return "", "", "", newError(http.StatusBadRequest, codeInvalidField, "title")
+	}
+
+	// or if the paste is larger than allowed,
+	if configuration.MaxPasteSize > 0 && len(paste) > configuration.MaxPasteSize {
+		return "", "", "", newError(http.StatusRequestEntityTooLarge, codePasteTooLarge,
+			configuration.MaxPasteSize)
+	}
+
+	var userId int64
+	if u != nil {
+		userId = u.Id
+	}
+
+	// Refuse spam, admins are trusted,
+	if !isAdmin(u) && checkSpam(&Submission{
+		Title:    title,
+		Paste:    paste,
+		Honeypot: honeypot,
+		IP:       ip,
+		UserId:   userId,
+	}) {
+		return "", "", "", newError(http.StatusUnprocessableEntity, codeSpam)
+	}
+
+	// Look for credentials before anything is stored,
+	code, names := codePasteSaved, ""
+	if findings := scanSecrets(paste); len(findings) > 0 {
+		names = secretNames(findings)
+		loggy(fmt.Sprintf("Paste contains secrets (%s), action is %s.", names,
+			configuration.SecretScan))
+
+		switch configuration.SecretScan {
+		case secretScanReject:
+			return "", "", "", newError(http.StatusUnprocessableEntity, codeSecretsRejected, names)
+		case secretScanRedact:
+			paste = redactSecrets(paste, findings)
+			code = codeSecretsRedacted
+		default:
+			code = codeSecretsFound
 		}
 	}
+
+	return paste, code, names, nil
 }
 
-// SaveHandler will handle the actual save of each paste.
-// Returns with a Response struct.
-func SaveHandler(w http.ResponseWriter, r *http.Request) {
+// submitPaste checks and saves a paste sent to the api, owned by the user of
+// the request.
+// Returns the Response struct with the status in the locale of the request, or
+// an error if the paste is refused.
+func submitPaste(w http.ResponseWriter, r *http.Request, inData Request) (Response, error) {
 
-	var inData Request
+	// Pastes are owned by the user of the token or session,
+	u, _, err := requestUser(r, scopeWrite)
+	if err != nil {
+		return Response{}, err
+	}
 
-	loggy(fmt.Sprintf("Recieving request to save new paste, trying to parse indata."))
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&inData)
+	// or by the user of the deprecated key,
+	if u == nil && inData.UserKey != "" {
+		loggy("Paste saved with the deprecated key field.")
+		w.Header().Set("Warning", `299 - "The key field is deprecated, use an api token"`)
+		if u = getUserByKey(inData.UserKey); u != nil && u.Disabled {
+			u = nil
+		}
+	}
 
-	// Return error if we can't decode the json-data,
+	var ownerId int64
+	if u != nil {
+		ownerId = u.Id
+
+		// Team tokens always save into their team,
+		if u.Team != 0 && inData.Team == 0 {
+			inData.Team = u.Team
+		}
+	}
+
+	if inData.Team != 0 && !hasTeamRole(u, inData.Team, teamEditor) {
+		loggy(fmt.Sprintf("Not allowed to save pastes into team %d.", inData.Team))
+		return Response{}, newError(http.StatusForbidden, codeForbidden,
+			tr(r, "save pastes into this team"))
+	}
+
+	paste, code, names, err := checkPasteContent(remoteIP(r), u, inData.Title, inData.Paste, inData.Website)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return Response{}, err
 	}
 
-	d, _ := json.MarshalIndent(inData, "DEBUG : ", "  ")
-	loggy(fmt.Sprintf("Successfully parsed json indata into struct \nDEBUG : %s", d))
+	p := savePaste(inData.Title, paste, inData.Expiry, ownerId, inData.Team, inData.Burn)
 
-	// Return error if we don't have any data at all
-	if inData.Paste == "" {
-		loggy("Empty paste received, returning 500.")
-		http.Error(w, "Empty paste.", 500)
-		return
+	// Secrets found in a paste that already existed aren't news,
+	if p.Code == codePasteSaved && code != codePasteSaved {
+		p.Code = code
+		p.Status = statusText(r, code, names)
+	} else {
+		p.Status = statusText(r, p.Code)
 	}
 
-	// Return error if title is to long
-	// TODO add check of paste size.
-	if len(inData.Title) > 50 {
-		loggy(fmt.Sprintf("Paste title to long (%v).", len(inData.Title)))
-		http.Error(w, "Title to long.", 500)
+	return p, nil
+}
+
+// SaveHandler will handle the actual save of each paste, sent as json, as a
+// form or as the raw body.
+// Returns with a Response struct, or just the url as plain text.
+func SaveHandler(w http.ResponseWriter, r *http.Request) {
+
+	loggy(fmt.Sprintf("Recieving request to save new paste, trying to parse indata."))
+	inData, isJSON, err := parseSaveRequest(r)
+
+	// Pastes that weren't sent as json are answered with just the url,
+	plain := wantsPlainURL(r, isJSON)
+
+	// Return error if we can't read the indata,
+	if err != nil {
+		if plain {
+			sendPlainError(w, r, err)
+		} else {
+			sendError(w, r, err)
+		}
 		return
 	}
 
-	p := savePaste(inData.Title, inData.Paste, inData.Expiry, inData.UserKey)
+	d, _ := json.MarshalIndent(inData, "DEBUG : ", "  ")
+	loggy(fmt.Sprintf("Successfully parsed indata into struct \nDEBUG : %s", d))
 
-	d, _ = json.MarshalIndent(p, "DEBUG : ", "  ")
-	loggy(fmt.Sprintf("Returning json data to requester \nDEBUG : %s", d))
+	p, err := submitPaste(w, r, inData)
+	if err != nil {
+		if plain {
+			sendPlainError(w, r, err)
+		} else {
+			sendError(w, r, err)
+		}
+		return
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(p)
+	d, _ = json.MarshalIndent(p, "DEBUG : ", "  ")
+	loggy(fmt.Sprintf("Returning data to requester \nDEBUG : %s", d))
 
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if plain {
+		sendPlainURL(w, p, inData.Lang)
 		return
 	}
+	sendJSON(w, p)
 }
 
 // high calls the highlighter-wrapper and runs the paste through it.
@@ -598,13 +952,13 @@ func high(paste string, lang string, style string) (string, string, string, stri
 
 	// Same with the styles,
 	if !supported_styles {
-		style = "manni"
+		style = defaultStyle()
 		loggy(fmt.Sprintf("Given style ('%s') not supported, using ", style))
 	}
 
-	if _, err := os.Stat(configuration.Highlighter); os.IsNotExist(err) {
-		log.Fatal(err)
-	}
+	// A missing highlighter is a broken installation,
+	_, err := os.Stat(configuration.Highlighter)
+	checkErr(err)
 
 	loggy(fmt.Sprintf("Executing command : %s %s %s", configuration.Highlighter,
 		lang, style))
@@ -617,7 +971,7 @@ func high(paste string, lang string, style string) (string, string, string, stri
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 
-	err := cmd.Run()
+	err = cmd.Run()
 	if err != nil {
 		loggy(fmt.Sprintf("The highlightning feature failed, returning text. Error : %s", stderr.String()))
 		return paste, "Internal Error, returning plain text.", lang, style
@@ -661,8 +1015,8 @@ func checkPasteExpiry(pasteId string, expiry int64) bool {
 func delPaste(pasteId string) {
 
 	// Prepare statement,
-	stmt, err := dbHandle.Prepare("delete from pastebin where id=" +
-		configuration.DBPlaceHolder[0])
+	stmt, err := dbHandle.Prepare("delete from " + configuration.DBTable +
+		" where id=" + configuration.DBPlaceHolder[0])
 	checkErr(err)
 
 	// Execute it,
@@ -670,33 +1024,85 @@ func delPaste(pasteId string) {
 	checkErr(err)
 
 	stmt.Close()
+	delRevisions(pasteId)
 	loggy("Successfully deleted paste.")
 }
 
+// burnAfterReading deletes a paste that burns after reading once it has been
+// read by anyone but its owner.
+func burnAfterReading(pasteId string, p Response, u *User) {
+
+	if !p.Burn || isPasteOwner(pasteId, u) {
+		return
+	}
+
+	loggy(fmt.Sprintf("Paste '%s' was read, burning it.", pasteId))
+	delPaste(pasteId)
+}
+
+// isPasteOwner returns true if the user owns the paste, false for anonymous
+// users and pastes.
+func isPasteOwner(pasteId string, u *User) bool {
+	ownerId, _ := getPasteOwner(pasteId)
+	return ownerId != 0 && u != nil && u.Id == ownerId
+}
+
+// getPasteOwner gets the owner and team of a paste from the database.
+// Returns zero for pastes without an owner or team, and for missing pastes.
+func getPasteOwner(pasteId string) (int64, int64) {
+
+	var ownerId, teamId sql.NullInt64
+
+	err := dbHandle.QueryRow("select ownerid, teamid from "+
+		configuration.DBTable+" where id="+configuration.DBPlaceHolder[0],
+		pasteId).Scan(&ownerId, &teamId)
+	if err != nil && err != sql.ErrNoRows {
+		checkErr(err)
+	}
+
+	return ownerId.Int64, teamId.Int64
+}
+
 // getPaste gets the paste from the database.
-// Takes the pasteid as a string argument.
-// Returns the Response struct.
-func getPaste(pasteId string) Response {
+// Takes the pasteid as a string argument and the user requesting it, which is
+// nil for anonymous requests. Team pastes are only returned to team members and
+// quarantined pastes only to admins, who can see every paste.
+// Returns the Response struct, or an error for pastes that can't be shown.
+func getPaste(pasteId string, u *User) (Response, error) {
 
 	var title, paste string
 	var expiry int64
+	var teamId sql.NullInt64
+	var quarantined, burn int
 
-	err := dbHandle.QueryRow("select title, data, expiry from "+
+	err := dbHandle.QueryRow("select title, data, expiry, teamid, quarantined, burn from "+
 		configuration.DBTable+" where id="+configuration.DBPlaceHolder[0],
-		pasteId).Scan(&title, &paste, &expiry)
+		pasteId).Scan(&title, &paste, &expiry, &teamId, &quarantined, &burn)
 
 	switch {
 	case err == sql.ErrNoRows:
 		loggy("Requested paste doesn't exist.")
-		return Response{Status: "Requested paste doesn't exist."}
+		return Response{}, newError(http.StatusNotFound, codeNotFound)
 	case err != nil:
-		debugLogger.Println("   Database error : " + err.Error())
-		os.Exit(1)
+		return Response{}, internalError(err)
+	}
+
+	// Pretend team pastes don't exist for everyone outside the team,
+	if teamId.Valid && !isAdmin(u) && !hasTeamRole(u, teamId.Int64, teamViewer) {
+		loggy(fmt.Sprintf("Requested paste belongs to team %d, not showing it.",
+			teamId.Int64))
+		return Response{}, newError(http.StatusNotFound, codeNotFound)
+	}
+
+	// and quarantined pastes for everyone but admins,
+	if quarantined != 0 && !isAdmin(u) {
+		loggy("Requested paste is quarantined, not showing it.")
+		return Response{}, newError(http.StatusForbidden, codeUnderReview)
 	}
 
 	// Check if paste is overdue,
 	if !checkPasteExpiry(pasteId, expiry) {
-		return Response{Status: "Requested paste doesn't exist."}
+		return Response{}, newError(http.StatusGone, codePasteExpired)
 	}
 
 	// Unescape the saved data,
@@ -709,17 +1115,20 @@ func getPaste(pasteId string) Response {
 	}
 
 	r := Response{
-		Status: "Success",
-		Id:     pasteId,
-		Title:  title,
-		Paste:  paste,
-		Size:   len(paste),
-		Expiry: expiryS}
+		Code:        codeSuccess,
+		Status:      statusMessages[codeSuccess],
+		Id:          pasteId,
+		Title:       title,
+		Paste:       paste,
+		Size:        len(paste),
+		Expiry:      expiryS,
+		Quarantined: quarantined != 0,
+		Burn:        burn != 0}
 
 	d, _ := json.MarshalIndent(r, "DEBUG : ", "  ")
 	loggy(fmt.Sprintf("Returning data from getPaste \nDEBUG : %s", d))
 
-	return r
+	return r, nil
 }
 
 // APIHandler handles all
@@ -739,13 +1148,23 @@ func APIHandler(w http.ResponseWriter, r *http.Request) {
 	loggy(fmt.Sprintf("Getting paste with id '%s' and lang '%s' and style '%s'.",
 		pasteId, inData.Lang, inData.Style))
 
+	u, ok := apiUser(w, r, scopeRead)
+	if !ok {
+		return
+	}
+
 	// Get the actual paste data,
-	p := getPaste(pasteId)
+	p, err := getPaste(pasteId, u)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	p.Status = statusText(r, p.Code)
 
 	if inData.WebReq {
 		// If no style is given, use default style,
 		if inData.Style == "" {
-			inData.Style = "manni"
+			inData.Style = defaultStyle()
 			p.Url += "/" + inData.Style
 		}
 
@@ -759,16 +1178,40 @@ func APIHandler(w http.ResponseWriter, r *http.Request) {
 		p.Paste, p.Extra, p.Lang, p.Style = high(p.Paste, inData.Lang, inData.Style)
 	}
 
+	burnAfterReading(pasteId, p, u)
+
 	d, _ := json.MarshalIndent(p, "DEBUG : ", "  ")
 	loggy(fmt.Sprintf("Returning json data to requester \nDEBUG : %s", d))
 
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(p)
+	sendJSON(w, p)
+}
 
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+// APIPastesHandler lists the pastes of the user of the token or session.
+func APIPastesHandler(w http.ResponseWriter, r *http.Request) {
+
+	u, ok := apiUser(w, r, scopeRead)
+	if !ok {
+		return
+	}
+	if u == nil {
+		sendError(w, r, newError(http.StatusUnauthorized, codeAuthRequired))
 		return
 	}
+
+	// Team tokens list the pastes of their team,
+	var b Pastes
+	if u.Team != 0 {
+		t := getUserTeam(u.Team, u.Id)
+		if t == nil {
+			sendError(w, r, newError(http.StatusForbidden, codeNotTeamMember))
+			return
+		}
+		b = getTeamPastes(t)
+	} else {
+		b = getUserPastes(u.Id)
+	}
+
+	sendJSON(w, b)
 }
 
 // pasteHandler generates the html paste pages
@@ -782,7 +1225,13 @@ func pasteHandler(w http.ResponseWriter, r *http.Request) {
 	loggy(fmt.Sprintf("Getting paste with id '%s' and lang '%s' and style '%s'.", pasteId, lang, style))
 
 	// Get the actual paste data,
-	p := getPaste(pasteId)
+	u := currentUser(r)
+	p, err := getPaste(pasteId, u)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	burnAfterReading(pasteId, p, u)
 
 	// Run it through the highgligther.,
 	p.Paste, p.Extra, p.Lang, p.Style = high(p.Paste, lang, style)
@@ -790,11 +1239,15 @@ func pasteHandler(w http.ResponseWriter, r *http.Request) {
 	// Construct page struct
 	page := &Page{
 		Body:            template.HTML(p.Paste),
+		CSRFToken:       csrfToken(w, r),
+		CSPNonce:        cspNonce(r),
+		Theme:           siteTheme,
 		Expiry:          p.Expiry,
 		Lang:            p.Lang,
 		LangsFirst:      listOfLangsFirst,
 		LangsLast:       listOfLangsLast,
 		Style:           p.Style,
+		StyleCSS:        getStyleSheet(p.Style),
 		SupportedStyles: listOfStyles,
 		Title:           p.Title,
 		GoogleAPIKey:    configuration.GoogleAPIKey,
@@ -803,12 +1256,12 @@ func pasteHandler(w http.ResponseWriter, r *http.Request) {
 		UrlHome:         configuration.Address,
 		UrlRaw:          configuration.Address + "/raw/" + pasteId,
 		WrapperErr:      p.Extra,
+		PasteId:         pasteId,
+		Quarantined:     p.Quarantined,
+		ReportReasons:   reportReasons,
 	}
 
-	err := templates.ExecuteTemplate(w, "syntax.html", page)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
+	renderPage(w, r, "syntax.html", page)
 }
 
 // CloneHandler handles generating the clone pages
@@ -816,22 +1269,32 @@ func CloneHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	paste := vars["pasteId"]
 
-	p := getPaste(paste)
+	u := currentUser(r)
+	p, err := getPaste(paste, u)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	burnAfterReading(paste, p, u)
 
 	loggy(p.Paste)
 
 	// Clone page struct
 	page := &Page{
 		Body:       template.HTML(p.Paste),
-		PasteTitle: "Copy of " + p.Title,
-		Title:      "Copy of " + p.Title,
-		UserKey:    getUserKey(r),
+		CSRFToken:  csrfToken(w, r),
+		CSPNonce:   cspNonce(r),
+		Theme:      siteTheme,
+		PasteTitle: tr(r, "Copy of %s", p.Title),
+		Title:      tr(r, "Copy of %s", p.Title),
+		User:       u,
 	}
-
-	err := templates.ExecuteTemplate(w, "index.html", page)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if u != nil {
+		page.UserKey = u.ApiKey
+		page.Teams = getUserTeams(u.Id)
 	}
+
+	renderPage(w, r, "index.html", page)
 }
 
 // DownloadHandler forces downloads of selected pastes
@@ -839,7 +1302,13 @@ func DownloadHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	pasteId := vars["pasteId"]
 
-	p := getPaste(pasteId)
+	u := currentUser(r)
+	p, err := getPaste(pasteId, u)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	burnAfterReading(pasteId, p, u)
 
 	// Set header to an attachment so browser will automatically download it
 	w.Header().Set("Content-Disposition", "attachment; filename="+p.Paste)
@@ -852,85 +1321,107 @@ func RawHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	pasteId := vars["pasteId"]
 
-	p := getPaste(pasteId)
+	u := currentUser(r)
+	p, err := getPaste(pasteId, u)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	burnAfterReading(pasteId, p, u)
 	w.Header().Set("Content-Type", "text/plain; charset=UTF-8; imeanit=yes")
 
 	// Simply write string to browser
 	io.WriteString(w, p.Paste)
 }
 
-// loginHandler
+// loginHandler shows the login form and logs the user in on POST.
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		err := templates.ExecuteTemplate(w, "login.html", "")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+		renderLogin(w, r, "")
 	case "POST":
 		email := r.FormValue("email")
 		password := r.FormValue("password")
-		email_escaped := html.EscapeString(email)
+		ip := remoteIP(r)
 
-		// Query database if id exists and if it does call generateName again
-		var hashedPassword []byte
-		err := dbHandle.QueryRow("select password from "+configuration.DBAccountsTable+
-			" where email="+configuration.DBPlaceHolder[0], email_escaped).
-			Scan(&hashedPassword)
+		// Refuse to check the password while backing off,
+		if wait := loginWait(email, ip); wait > 0 {
+			loggy(fmt.Sprintf("Login to '%s' from %s refused for %d seconds.", email, ip, wait))
+			w.WriteHeader(http.StatusTooManyRequests)
+			renderLogin(w, r, tr(r, "Too many failed logins, try again in %d seconds.", wait))
+			return
+		}
 
-		switch {
-		case err == sql.ErrNoRows:
-			loggy(fmt.Sprintf("Email '%s' is not taken.", email))
-			http.Redirect(w, r, "/register", 302)
-		case err != nil:
-			debugLogger.Println("   Database error : " + err.Error())
-			os.Exit(1)
-		default:
-			loggy(fmt.Sprintf("Account '%s' exists.", email))
+		u := authenticate(email, password)
+		if u == nil {
+			addLoginFailure(email, ip)
+			http.Redirect(w, r, "/login", 302)
+			return
 		}
 
-		// compare bcrypt hash to userinput password
-		err = bcrypt.CompareHashAndPassword(hashedPassword, []byte(password))
-		if err == nil {
-			// prepare cookie
-			value := map[string]string{
-				"email": email,
-			}
-			// encode variables into cookie
-			if encoded, err := cookieHandler.Encode("session", value); err == nil {
-				cookie := &http.Cookie{
-					Name:  "session",
-					Value: encoded,
-					Path:  "/",
-				}
-				// set user cookie
-				http.SetCookie(w, cookie)
-			}
-			loggy(fmt.Sprintf("Successfully logged account '%s' in.", email))
-			// Redirect to home page
-			http.Redirect(w, r, "/", 302)
+		if u.Disabled {
+			loggy(fmt.Sprintf("Account '%s' is disabled.", email))
+			http.Redirect(w, r, "/login", 302)
+			return
 		}
-		// Redirect to login page
-		http.Redirect(w, r, "/login", 302)
 
+		if configuration.RequireVerification && !u.Verified {
+			loggy(fmt.Sprintf("Account '%s' is not verified.", email))
+			http.Redirect(w, r, "/verify", 302)
+			return
+		}
+
+		// Ask for the second factor if 2fa is enabled,
+		if secret, _ := getUserTOTP(u.Id); secret != "" {
+			loggy(fmt.Sprintf("Account '%s' has 2fa enabled, asking for a code.", email))
+			startSecondStep(w, r, u)
+			return
+		}
+
+		clearLoginFailures(accountSubject(email))
+		newSession(w, r, u)
+		loggy(fmt.Sprintf("Successfully logged account '%s' in.", email))
+
+		// Redirect to home page
+		http.Redirect(w, r, "/", 302)
 	}
+}
+
+// renderLogin generates the login page with an optional error message.
+func renderLogin(w http.ResponseWriter, r *http.Request, message string) {
 
+	page := &Page{
+		Title:         tr(r, "Login"),
+		AllowRegister: !configuration.DisableRegistration,
+		Message:       message,
+		CSRFToken:     csrfToken(w, r),
+		CSPNonce:      cspNonce(r),
+		Theme:         siteTheme,
+	}
+	if oidcEnabled() {
+		page.SSOName = configuration.OIDCName
+		if page.SSOName == "" {
+			page.SSOName = "single sign-on"
+		}
+	}
+	renderPage(w, r, "login.html", page)
 }
 
-func pastesHandler(w http.ResponseWriter, r *http.Request) {
+// getUserPastes gets the pastes owned by a user from the database, leaving
+// out the pastes saved into a team.
+// Returns the Pastes struct.
+func getUserPastes(userId int64) Pastes {
 
-	key := getUserKey(r)
 	b := Pastes{Response: []Response{}}
 
 	rows, err := dbHandle.Query("select id, title, delkey, data from "+
-		configuration.DBTable+" where userid="+
-		configuration.DBPlaceHolder[0], key)
+		configuration.DBTable+" where ownerid="+
+		configuration.DBPlaceHolder[0]+" and teamid is NULL", userId)
 	switch {
 	case err == sql.ErrNoRows:
-		loggy("Pasted data is not in the database, will insert it.")
+		loggy("User doesn't have any pastes.")
 	case err != nil:
-		debugLogger.Println("   Database error : " + err.Error())
-		os.Exit(1)
+		checkErr(err)
 	default:
 		for rows.Next() {
 			var id, title, url, delKey, data string
@@ -949,168 +1440,181 @@ func pastesHandler(w http.ResponseWriter, r *http.Request) {
 		rows.Close()
 	}
 
-	err = templates.ExecuteTemplate(w, "pastes.html", &b)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
+	return b
 }
 
-// loggedIn returns true if cookie exists
-func getUserKey(r *http.Request) string {
-	cookie, err := r.Cookie("session")
-	cookieValue := make(map[string]string)
-	if err != nil {
-		return ""
-	}
-	err = cookieHandler.Decode("session", cookie.Value, &cookieValue)
-	if err != nil {
-		return ""
-	}
-	email := cookieValue["email"]
-	// Query database if id exists and if it does call generateName again
-	var user_key string
-	err = dbHandle.QueryRow("select key from "+configuration.DBAccountsTable+
-		" where email="+configuration.DBPlaceHolder[0], email).
-		Scan(&user_key)
+// pastesHandler lists the pastes of the logged in user.
+func pastesHandler(w http.ResponseWriter, r *http.Request) {
 
-	switch {
-	case err == sql.ErrNoRows:
-		loggy(fmt.Sprintf("Key does not exist for user '%s'", email))
-	case err != nil:
-		debugLogger.Println("   Database error : " + err.Error())
-		os.Exit(1)
-	default:
-		loggy(fmt.Sprintf("User key found for user '%s'", email))
+	u := currentUser(r)
+	if u == nil {
+		http.Redirect(w, r, "/login", 302)
+		return
 	}
 
-	return user_key
-
-}
-
-// generateKey generates a short url with the length defined in main config
-// The function calls itself recursively until an id that doesn't exist is found
-// Returns the id
-func generateKey() string {
-
-	// Use uniuri to generate random string
-	key := uniuri.NewLen(20)
-	loggy(fmt.Sprintf("Generated id is '%s', checking if it's already taken in the database",
-		key))
-
-	// Query database if id exists and if it does call generateName again
-	var key_taken string
-	err := dbHandle.QueryRow("select key from "+configuration.DBAccountsTable+
-		" where key="+configuration.DBPlaceHolder[0], key).
-		Scan(&key_taken)
-
-	switch {
-	case err == sql.ErrNoRows:
-		loggy(fmt.Sprintf("Key '%s' is not taken, will use it.", key))
-	case err != nil:
-		debugLogger.Println("   Database error : " + err.Error())
-		os.Exit(1)
-	default:
-		loggy(fmt.Sprintf("Key '%s' is taken, generating new key.", key_taken))
-		generateKey()
+	b := &PastesPage{
+		Response:  getUserPastes(u.Id).Response,
+		CSRFToken: csrfToken(w, r),
+		CSPNonce:  cspNonce(r),
+		Theme:     siteTheme,
+	}
+	for _, t := range getUserTeams(u.Id) {
+		b.Teams = append(b.Teams, TeamPastes{
+			Team:     t,
+			Response: getTeamPastes(&t).Response,
+		})
 	}
 
-	return key
+	renderPage(w, r, "pastes.html", b)
 }
 
-// registerHandler
+// registerHandler shows the register form and creates the account on POST.
 func registerHandler(w http.ResponseWriter, r *http.Request) {
+	if configuration.DisableRegistration {
+		loggy("Registration is disabled, redirecting to login.")
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+
 	switch r.Method {
 	case "GET":
-		err := templates.ExecuteTemplate(w, "register.html", "")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+		page := &Page{Title: tr(r, "Register"), CSRFToken: csrfToken(w, r), CSPNonce: cspNonce(r), Theme: siteTheme}
+		renderPage(w, r, "register.html", page)
 	case "POST":
 		email := r.FormValue("email")
 		pass := r.FormValue("password")
 		email_escaped := html.EscapeString(email)
+		displayName := html.EscapeString(r.FormValue("displayname"))
 
-		loggy(fmt.Sprintf("Attempting to create account '%s', checking if it's already taken in the database",
-			email))
+		if !validEmail(email) {
+			loggy(fmt.Sprintf("Refused to create an account for the invalid email '%s'.", email))
+			page := &Page{Title: tr(r, "Register"), CSRFToken: csrfToken(w, r), CSPNonce: cspNonce(r), Theme: siteTheme,
+				Message: tr(r, "That is not a valid email address.")}
+			renderPage(w, r, "register.html", page)
+			return
+		}
 
-		// Query database if id exists and if it does call generateName again
-		var email_taken string
-		err := dbHandle.QueryRow("select email from "+configuration.DBAccountsTable+
-			" where email="+configuration.DBPlaceHolder[0], email_escaped).
-			Scan(&email_taken)
-
-		switch {
-		case err == sql.ErrNoRows:
-			loggy(fmt.Sprintf("Email '%s' is not taken, will use it.", email))
-		case err != nil:
-			debugLogger.Println("   Database error : " + err.Error())
-			os.Exit(1)
-		default:
-			loggy(fmt.Sprintf("Email '%s' is taken.", email_taken))
-			http.Redirect(w, r, "/register", 302)
+		if !validPassword(pass) {
+			loggy(fmt.Sprintf("Refused to create an account for '%s' with an invalid password.", email))
+			page := &Page{Title: tr(r, "Register"), CSRFToken: csrfToken(w, r), CSPNonce: cspNonce(r), Theme: siteTheme,
+				Message: passwordRule(r)}
+			renderPage(w, r, "register.html", page)
+			return
 		}
 
-		// This is needed since mysql/postgres uses different placeholders,
-		var dbQuery string
-		for i := 0; i < 3; i++ {
-			dbQuery += configuration.DBPlaceHolder[i] + ","
+		if !validName(displayName) {
+			loggy(fmt.Sprintf("Refused to create an account for '%s' with an invalid name.", email))
+			page := &Page{Title: tr(r, "Register"), CSRFToken: csrfToken(w, r), CSPNonce: cspNonce(r), Theme: siteTheme,
+				Message: nameRule(r)}
+			renderPage(w, r, "register.html", page)
+			return
 		}
-		dbQuery = dbQuery[:len(dbQuery)-1]
 
-		stmt, err := dbHandle.Prepare("INSERT into " + configuration.DBAccountsTable + "(email, password, key) values(" + dbQuery + ")")
-		checkErr(err)
+		loggy(fmt.Sprintf("Attempting to create account '%s', checking if it's already taken in the database",
+			email))
+
+		if u := getUserByEmail(email_escaped); u != nil {
+			loggy(fmt.Sprintf("Email '%s' is taken.", email))
+			http.Redirect(w, r, "/register", 302)
+			return
+		}
 
 		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
 		checkErr(err)
 
-		key := generateKey()
+		u := createUser(email_escaped, displayName, hashedPassword)
+		sendVerification(u)
 
-		_, err = stmt.Exec(email_escaped, hashedPassword, key)
-		checkErr(err)
-
-		loggy(fmt.Sprintf("Successfully created account '%s' with hashed password '%s'",
-			email,
-			hashedPassword))
-		stmt.Close()
-		checkErr(err)
+		loggy(fmt.Sprintf("Successfully created account '%s' with id %d",
+			email, u.Id))
 		http.Redirect(w, r, "/login", 302)
+	}
+}
 
+// accountHandler shows the account settings of the logged in user and handles
+// renaming and deleting the account on POST.
+func accountHandler(w http.ResponseWriter, r *http.Request) {
+
+	u := currentUser(r)
+	if u == nil {
+		http.Redirect(w, r, "/login", 302)
+		return
 	}
 
+	switch r.Method {
+	case "GET":
+		page := &Page{
+			Title:     tr(r, "Account"),
+			UserKey:   u.ApiKey,
+			User:      u,
+			Locales:   getLocales(),
+			CSRFToken: csrfToken(w, r),
+			CSPNonce:  cspNonce(r),
+			Theme:     siteTheme,
+		}
+		renderPage(w, r, "account.html", page)
+	case "POST":
+		switch r.FormValue("action") {
+		case "rename":
+			name := html.EscapeString(r.FormValue("displayname"))
+			if !validName(name) {
+				loggy(fmt.Sprintf("Refused to rename account %d to an invalid name.", u.Id))
+				break
+			}
+			renameUser(u.Id, name)
+			loggy(fmt.Sprintf("Renamed account %d.", u.Id))
+		case "locale":
+			locale := r.FormValue("locale")
+			if locale != "" && !supportedLocale(locale) {
+				break
+			}
+			setUserLocale(u.Id, locale)
+			setLocaleCookie(w, locale)
+			loggy(fmt.Sprintf("Set the locale of account %d to '%s'.", u.Id, locale))
+		case "delete":
+			// Accounts of the identity provider sign in there again first,
+			if u.AuthSource == authOIDC && !oidcReauthenticated(r, u) {
+				http.Redirect(w, r, "/login/oidc?reauth=/account", 302)
+				return
+			}
+			if !confirmPassword(r, u, r.FormValue("password")) {
+				loggy(fmt.Sprintf("Wrong password when deleting account %d.", u.Id))
+				break
+			}
+			deleteUser(u.Id)
+			endSession(w, r)
+			http.Redirect(w, r, "/", 302)
+			return
+		}
+		http.Redirect(w, r, "/account", 302)
+	}
 }
 
-// logoutHandler destroys cookie data and redirects to root
+// logoutHandler destroys the session and redirects to root
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	cookie := &http.Cookie{
-		Name:   "session",
-		Value:  "",
-		Path:   "/",
-		MaxAge: -1,
-	}
-	http.SetCookie(w, cookie)
-	http.Redirect(w, r, "/", 301)
-
+	endSession(w, r)
+	http.Redirect(w, r, "/", 302)
 }
 
 // RootHandler handles generating the root page
 func RootHandler(w http.ResponseWriter, r *http.Request) {
 
 	p := &Page{
+		CSRFToken:  csrfToken(w, r),
+		CSPNonce:   cspNonce(r),
+		Theme:      siteTheme,
 		LangsFirst: listOfLangsFirst,
 		LangsLast:  listOfLangsLast,
 		Title:      configuration.DisplayName,
 		UrlAddress: configuration.Address,
-		UserKey:    getUserKey(r),
+		User:       currentUser(r),
 	}
-
-	err := templates.ExecuteTemplate(w, "index.html", p)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if p.User != nil {
+		p.UserKey = p.User.ApiKey
+		p.Teams = getUserTeams(p.User.Id)
 	}
-}
 
-func serveCss(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, "assets/pastebin.css")
+	renderPage(w, r, "index.html", p)
 }
 
 func main() {
@@ -1118,6 +1622,14 @@ func main() {
 	// Set up new logger,
 	debugLogger = log.New(os.Stderr, "DEBUG : ", log.Ldate|log.Ltime)
 
+	// Errors at startup end the program,
+	defer exitOnError()
+
+	// Run as a client if asked to,
+	if isClientCommand(os.Args[1:]) {
+		runClient(os.Args[1:])
+	}
+
 	// Check args,
 	checkArgs()
 
@@ -1140,41 +1652,99 @@ func main() {
 	d, _ := json.MarshalIndent(configuration, "DEBUG : ", "  ")
 	loggy(fmt.Sprintf("Successfully parsed json data into struct \nDEBUG : %s", d))
 
+	// Parse the templates, and translate them,
+	templates = loadTemplates()
+	loadCatalogs()
+	checkVendoredAssets()
+
 	// Get languages and styles,
 	getSupportedLangs()
 	getSupportedStyles()
 
+	// Set up the theme of the pages,
+	loadTheme()
+
 	// Get the database handle
 	dbHandle = getDBHandle()
 
+	// Run admin commands given on the command line,
+	if reset2FAEmail != "" {
+		resetTwoFactor(reset2FAEmail)
+		os.Exit(0)
+	}
+	if makeAdminEmail != "" {
+		makeAdmin(makeAdminEmail)
+		os.Exit(0)
+	}
+
+	// Set up the session cookie keys,
+	setupCookieCodecs()
+
+	// Set up the mailer,
+	mailer = newMailer()
+
+	// Set up the password checks,
+	authenticators = newAuthenticators()
+
+	// Set up the secret scanners,
+	secretScanners = newSecretScanners()
+
+	// Set up the spam filters,
+	spamFilters = newSpamFilters()
+
+	// Set up the rate limits,
+	trustedProxies = newTrustedProxies()
+	rateLimiter = newRateLimitStore()
+
 	// Router object,
 	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(notFoundHandler)
 
 	// Routes,
 	router.HandleFunc("/", RootHandler)
-	router.HandleFunc("/p/{pasteId}", pasteHandler).Methods("GET")
-	router.HandleFunc("/p/{pasteId}/{lang}", pasteHandler).Methods("GET")
-	router.HandleFunc("/p/{pasteId}/{lang}/{style}", pasteHandler).Methods("GET")
+	router.HandleFunc("/p/{pasteId}", rateLimited(rateRender, pasteHandler)).Methods("GET")
+	router.HandleFunc("/p/{pasteId}/{lang}", rateLimited(rateRender, pasteHandler)).Methods("GET")
+	router.HandleFunc("/p/{pasteId}/{lang}/{style}", rateLimited(rateRender, pasteHandler)).Methods("GET")
 
 	// Api
-	router.HandleFunc("/api", SaveHandler).Methods("POST")
-	router.HandleFunc("/api/{pasteId}", APIHandler).Methods("POST")
-	router.HandleFunc("/api/{pasteId}", APIHandler).Methods("GET")
-	router.HandleFunc("/api/{pasteId}", DelHandler).Methods("DELETE")
-
-	router.HandleFunc("/raw/{pasteId}", RawHandler).Methods("GET")
-	router.HandleFunc("/clone/{pasteId}", CloneHandler).Methods("GET")
-	router.HandleFunc("/login", loginHandler)
+	registerAPIv2(router)
+	router.HandleFunc("/api", deprecatedAPI(rateLimited(rateCreate, SaveHandler))).Methods("POST")
+	router.HandleFunc("/api/pastes", deprecatedAPI(rateLimited(rateRead, APIPastesHandler))).Methods("GET")
+	router.HandleFunc("/api/{pasteId}/report", deprecatedAPI(rateLimited(rateCreate, reportHandler))).Methods("POST")
+	router.HandleFunc("/api/{pasteId}", deprecatedAPI(rateLimited(rateRender, APIHandler))).Methods("POST")
+	router.HandleFunc("/api/{pasteId}", deprecatedAPI(rateLimited(rateRead, APIHandler))).Methods("GET")
+	router.HandleFunc("/api/{pasteId}", deprecatedAPI(rateLimited(rateCreate, DelHandler))).Methods("DELETE")
+
+	router.HandleFunc("/raw/{pasteId}", rateLimited(rateRead, RawHandler)).Methods("GET")
+	router.HandleFunc("/clone/{pasteId}", rateLimited(rateRead, CloneHandler)).Methods("GET")
+	router.HandleFunc("/login", rateLimited(rateLogin, loginHandler))
+	router.HandleFunc("/login/2fa", rateLimited(rateLogin, loginTwoFactorHandler))
+	router.HandleFunc("/login/oidc", oidcLoginHandler).Methods("GET")
+	router.HandleFunc("/login/oidc/callback", oidcCallbackHandler).Methods("GET")
 	router.HandleFunc("/logout", logoutHandler)
-	router.HandleFunc("/register", registerHandler)
+	router.HandleFunc("/register", rateLimited(rateLogin, registerHandler))
+	router.HandleFunc("/verify", verifyHandler)
+	router.HandleFunc("/reset", rateLimited(rateLogin, resetHandler))
+	router.HandleFunc("/reset/confirm", rateLimited(rateLogin, resetConfirmHandler))
+	router.HandleFunc("/account", accountHandler)
+	router.HandleFunc("/account/sessions", sessionsHandler)
+	router.HandleFunc("/account/tokens", tokensHandler)
+	router.HandleFunc("/account/keys", keysHandler)
+	router.HandleFunc("/account/2fa", twoFactorHandler)
 	router.HandleFunc("/pastes", pastesHandler).Methods("GET")
+	router.HandleFunc("/teams", teamsHandler)
+	router.HandleFunc("/teams/{teamId}", teamHandler)
+	router.HandleFunc("/admin", adminHandler)
+
+	router.HandleFunc("/download/{pasteId}", rateLimited(rateRead, DownloadHandler)).Methods("GET")
+	router.PathPrefix("/assets/").HandlerFunc(serveAsset).Methods("GET", "HEAD")
 
-	router.HandleFunc("/download/{pasteId}", DownloadHandler).Methods("GET")
-	router.HandleFunc("/assets/pastebin.css", serveCss).Methods("GET")
+	startTCPListener()
+	startSSHServer()
 
 	// Set up server,
 	srv := &http.Server{
-		Handler:      router,
+		Handler:      securityHeaders(recoverErrors(limitBody(csrfProtect(router)))),
 		Addr:         configuration.ListenAddress + ":" + configuration.ListenPort,
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
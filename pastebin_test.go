@@ -0,0 +1,146 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupTest loads config.json into the configuration and opens a fresh sqlite
+// database with the schema of database.sql, like main does at startup.
+func setupTest(t *testing.T) {
+
+	t.Helper()
+
+	debugLogger = log.New(ioutil.Discard, "DEBUG : ", 0)
+	if testing.Verbose() {
+		debugLogger = log.New(os.Stderr, "DEBUG : ", log.Ltime)
+		debug = true
+	}
+
+	data, err := ioutil.ReadFile("config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configuration = Configuration{}
+	if err := json.Unmarshal(data, &configuration); err != nil {
+		t.Fatal(err)
+	}
+	configuration.DBType = "sqlite3"
+	configuration.DBName = filepath.Join(t.TempDir(), "pastebin.db")
+	configuration.Address = "http://pastebin.test"
+
+	schema, err := ioutil.ReadFile("database.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open(configuration.DBType, configuration.DBName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(strings.Replace(string(schema), " AUTO_INCREMENT", "", -1))
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbHandle = getDBHandle()
+	t.Cleanup(func() { dbHandle.Close() })
+
+	// The tests don't need pygments,
+	listOfStyles = map[string]string{"manni": "Manni"}
+	listOfLangsFirst = map[string]string{"Go": "go"}
+	listOfLangsLast = map[string]string{"Text": "text"}
+
+	templates = loadTemplates()
+	loadCatalogs()
+	loadTheme()
+	setupCookieCodecs()
+	mailer = noMailer{}
+	authenticators = newAuthenticators()
+	rateLimiter = nil
+	assetHashes = make(map[string]string)
+	trustedProxies = nil
+	secretScanners = nil
+	spamFilters = nil
+	spamModel = &bayesModel{spam: map[string]int{}, ham: map[string]int{}}
+}
+
+// loggedIn returns the request with the session cookie of the user.
+func loggedIn(r *http.Request, u *User) *http.Request {
+	w := httptest.NewRecorder()
+	newSession(w, httptest.NewRequest("GET", "/login", nil), u)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestSavePasteSharesOnlyLivePastesOfTheSameOwner(t *testing.T) {
+
+	setupTest(t)
+
+	alice := createUser("alice@example.com", "", []byte(""))
+	bob := createUser("bob@example.com", "", []byte(""))
+	team := createTeam("ops", alice.Id)
+
+	anonymous := savePaste("", "same data", 0, 0, 0, false)
+	mine := savePaste("", "same data", 0, alice.Id, 0, false)
+	ours := savePaste("", "same data", 0, alice.Id, team.Id, false)
+
+	ids := map[string]bool{anonymous.Id: true, mine.Id: true, ours.Id: true}
+	if len(ids) != 3 {
+		t.Fatal("pastes of different owners or teams were shared")
+	}
+
+	// The same owner gets the paste again,
+	for _, again := range []Response{
+		savePaste("", "same data", 0, 0, 0, false),
+		savePaste("", "same data", 0, alice.Id, 0, false),
+		savePaste("", "same data", 0, alice.Id, team.Id, false),
+	} {
+		if again.Code != codePasteExists || !ids[again.Id] {
+			t.Errorf("saved %s again instead of sharing it", again.Id)
+		}
+	}
+
+	// but not somebody else,
+	if p := savePaste("", "same data", 0, bob.Id, 0, false); ids[p.Id] {
+		t.Error("bob was handed a paste of someone else")
+	}
+
+	// and never a quarantined, expired or burning paste,
+	setPasteQuarantined(mine.Id, true)
+	if p := savePaste("", "same data", 0, alice.Id, 0, false); p.Id == mine.Id {
+		t.Error("the quarantined paste was shared")
+	}
+
+	_, err := dbHandle.Exec("update "+configuration.DBTable+" set expiry=? where id=?",
+		time.Now().Unix()-1, anonymous.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := savePaste("", "same data", 0, 0, 0, false); p.Id == anonymous.Id {
+		t.Error("the expired paste was shared")
+	}
+
+	burning := savePaste("", "burning data", 0, 0, 0, true)
+	if !burning.Burn || burning.Code != codePasteSaved {
+		t.Fatal("the paste doesn't burn")
+	}
+	if p := savePaste("", "burning data", 0, 0, 0, false); p.Id == burning.Id {
+		t.Error("the burning paste was shared")
+	}
+	if p := savePaste("", "same data", 0, alice.Id, team.Id, true); p.Id == ours.Id || !p.Burn {
+		t.Error("a paste that should burn was shared")
+	}
+}
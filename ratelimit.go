@@ -0,0 +1,359 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Classes of routes that are rate limited separately,
+const (
+	rateCreate = "create" // Saving, deleting and reporting pastes
+	rateRead   = "read"   // Fetching pastes without highlighting them
+	rateRender = "render" // Highlighting pastes, which starts the highlighter
+	rateLogin  = "login"  // Logging in, registering and resetting passwords
+	rateTCP    = "tcp"    // Pastes sent to the netcat listener
+	rateSSH    = "ssh"    // Commands run over ssh
+)
+
+// Where the buckets are kept,
+const (
+	rateStoreMemory = "memory" // In the process, for a single instance
+	rateStoreSQL    = "sql"    // In the database, shared by all instances
+)
+
+// How often buckets that have filled up again are dropped.
+const ratePruneInterval = time.Minute
+
+// RateLimit is a token bucket, refilling Rate tokens a minute up to Burst
+// tokens. Every request takes a token.
+type RateLimit struct {
+	Rate  float64 `json:"rate,string"`  // Requests a minute
+	Burst int     `json:"burst,string"` // Requests allowed at once
+}
+
+// refill returns how long it takes an empty bucket to fill up.
+func (l RateLimit) refill() time.Duration {
+	return time.Duration(float64(l.Burst) / l.Rate * float64(time.Minute))
+}
+
+// bucket is the state of a token bucket.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take refills the bucket for the time passed and takes a token from it.
+// Returns false and how long to wait for the next token if the bucket is empty.
+func (b *bucket) take(now time.Time, l RateLimit) (bool, time.Duration) {
+
+	perSecond := l.Rate / 60
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.updated).Seconds()*perSecond)
+	b.updated = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// RateLimitStore keeps the buckets of the clients.
+type RateLimitStore interface {
+	// Take takes a token from the bucket with the key.
+	// Returns false and how long to wait if the bucket is empty.
+	Take(key string, l RateLimit) (bool, time.Duration)
+}
+
+// The store of the buckets, set up in main. Nil if nothing is rate limited.
+var rateLimiter RateLimitStore
+
+// newRateLimitStore sets up the store configured in the configuration.
+func newRateLimitStore() RateLimitStore {
+
+	if len(configuration.RateLimits) == 0 {
+		return nil
+	}
+
+	var longest time.Duration
+	for class, l := range configuration.RateLimits {
+		switch class {
+		case rateCreate, rateRead, rateRender, rateLogin, rateTCP, rateSSH:
+		default:
+			debugLogger.Println("   Config error : Specified rate limit class (" + class +
+				") not supported.")
+			os.Exit(1)
+		}
+		if l.Rate < 0 || l.Rate > 0 && l.Burst < 1 {
+			debugLogger.Println("   Config error : Rate limit of " + class +
+				" needs a positive rate and burst.")
+			os.Exit(1)
+		}
+		if l.Rate > 0 && l.refill() > longest {
+			longest = l.refill()
+		}
+	}
+
+	switch configuration.RateLimitStore {
+	case "", rateStoreMemory:
+		loggy("Rate limiting in memory.")
+		return &memoryRateStore{buckets: map[string]*bucket{}, idle: longest}
+	case rateStoreSQL:
+		loggy("Rate limiting in the " + configuration.DBRateLimitsTable + " table.")
+		return &sqlRateStore{idle: longest}
+	}
+
+	debugLogger.Println("   Config error : Specified rate limit store (" +
+		configuration.RateLimitStore + ") not supported.")
+	os.Exit(1)
+	return nil
+}
+
+// memoryRateStore keeps the buckets in a map.
+type memoryRateStore struct {
+	sync.Mutex
+	buckets map[string]*bucket
+	idle    time.Duration // Buckets untouched this long are full again
+	pruned  time.Time
+}
+
+func (s *memoryRateStore) Take(key string, l RateLimit) (bool, time.Duration) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.pruned) > ratePruneInterval {
+		for k, b := range s.buckets {
+			if now.Sub(b.updated) > s.idle {
+				delete(s.buckets, k)
+			}
+		}
+		s.pruned = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), updated: now}
+		s.buckets[key] = b
+	}
+
+	return b.take(now, l)
+}
+
+// sqlRateStore keeps the buckets in the database, so several instances share
+// them. Buckets are updated only if nobody else updated them in the meantime,
+// and retried otherwise.
+type sqlRateStore struct {
+	sync.Mutex
+	idle   time.Duration
+	pruned time.Time
+}
+
+func (s *sqlRateStore) Take(key string, l RateLimit) (bool, time.Duration) {
+
+	now := time.Now()
+	s.prune(now)
+
+	for attempt := 0; attempt < 5; attempt++ {
+		var tokens float64
+		var updated int64
+
+		err := dbHandle.QueryRow("select tokens, updated_at from "+
+			configuration.DBRateLimitsTable+" where bucket="+
+			configuration.DBPlaceHolder[0], key).Scan(&tokens, &updated)
+
+		switch {
+		case err == sql.ErrNoRows:
+			b := &bucket{tokens: float64(l.Burst), updated: now}
+			ok, wait := b.take(now, l)
+
+			stmt, err := dbHandle.Prepare("INSERT INTO " + configuration.DBRateLimitsTable +
+				" (bucket,tokens,updated_at)values(" + dbPlaceHolders(3) + ")")
+			checkErr(err)
+			_, err = stmt.Exec(key, b.tokens, now.UnixNano()/int64(time.Millisecond))
+			stmt.Close()
+
+			// Another instance created the bucket first,
+			if err != nil {
+				continue
+			}
+			return ok, wait
+		case err != nil:
+			checkErr(err)
+		}
+
+		b := &bucket{tokens: tokens, updated: time.Unix(0, updated*int64(time.Millisecond))}
+		ok, wait := b.take(now, l)
+
+		stmt, err := dbHandle.Prepare("UPDATE " + configuration.DBRateLimitsTable +
+			" SET tokens=" + configuration.DBPlaceHolder[0] + ", updated_at=" +
+			configuration.DBPlaceHolder[1] + " WHERE bucket=" +
+			configuration.DBPlaceHolder[2] + " and updated_at=" +
+			configuration.DBPlaceHolder[3])
+		checkErr(err)
+		res, err := stmt.Exec(b.tokens, now.UnixNano()/int64(time.Millisecond), key, updated)
+		checkErr(err)
+		stmt.Close()
+
+		n, err := res.RowsAffected()
+		checkErr(err)
+		if n == 1 {
+			return ok, wait
+		}
+	}
+
+	// Rather let a request through than fail it when the bucket is that busy,
+	loggy("Rate limit bucket " + key + " kept changing, letting the request through.")
+	return true, 0
+}
+
+// prune drops the buckets that have filled up again, at most once every
+// ratePruneInterval.
+func (s *sqlRateStore) prune(now time.Time) {
+
+	s.Lock()
+	if now.Sub(s.pruned) < ratePruneInterval {
+		s.Unlock()
+		return
+	}
+	s.pruned = now
+	s.Unlock()
+
+	stmt, err := dbHandle.Prepare("DELETE FROM " + configuration.DBRateLimitsTable +
+		" WHERE updated_at<" + configuration.DBPlaceHolder[0])
+	checkErr(err)
+
+	_, err = stmt.Exec(now.Add(-s.idle).UnixNano() / int64(time.Millisecond))
+	checkErr(err)
+	stmt.Close()
+}
+
+// rateLimitKey returns who the request is counted against, the api token if it
+// has a valid one and the ip address of the client otherwise.
+func rateLimitKey(r *http.Request) string {
+
+	if raw := getBearerToken(r); raw != "" {
+		var id int64
+		err := dbHandle.QueryRow("select id from "+configuration.DBTokensTable+
+			" where hash="+configuration.DBPlaceHolder[0], hashToken(raw)).Scan(&id)
+		if err == nil {
+			return "token:" + strconv.FormatInt(id, 10)
+		}
+	}
+
+	return "ip:" + remoteIP(r)
+}
+
+// rateLimited wraps a handler so requests over the rate limit of the class
+// are answered with 429 Too Many Requests.
+func rateLimited(class string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// Only logging in is limited on the login pages, not showing them,
+		l := configuration.RateLimits[class]
+		if rateLimiter == nil || l.Rate <= 0 || class == rateLogin && r.Method != "POST" {
+			h(w, r)
+			return
+		}
+
+		key := rateLimitKey(r)
+		ok, wait := rateLimiter.Take(class+":"+key, l)
+		if !ok {
+			retry := int(math.Ceil(wait.Seconds()))
+			loggy(fmt.Sprintf("Rate limit of %s reached by %s, retry in %ds.", class, key, retry))
+			w.Header().Set("Retry-After", strconv.Itoa(retry))
+			sendError(w, r, newError(http.StatusTooManyRequests, codeRateLimited, retry))
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// The proxies trusted to tell the address of the client, set up in main.
+var trustedProxies []*net.IPNet
+
+// newTrustedProxies parses the trusted proxies in the configuration, given as
+// addresses or networks in CIDR notation.
+func newTrustedProxies() []*net.IPNet {
+
+	var proxies []*net.IPNet
+	for _, p := range configuration.TrustedProxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(p)
+		if err != nil {
+			debugLogger.Println("   Config error : Trusted proxy : " + err.Error())
+			os.Exit(1)
+		}
+		proxies = append(proxies, network)
+	}
+
+	return proxies
+}
+
+// isTrustedProxy returns true if the address belongs to a trusted proxy.
+func isTrustedProxy(addr string) bool {
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the ip address of the client. Requests from trusted proxies
+// are followed back through X-Forwarded-For, or X-Real-IP, to the first
+// address that isn't a trusted proxy.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !isTrustedProxy(host) {
+		return host
+	}
+
+	if r.Header.Get("X-Forwarded-For") == "" {
+		if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); real != "" {
+			return real
+		}
+		return host
+	}
+
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr == "" {
+			continue
+		}
+		if !isTrustedProxy(addr) {
+			return addr
+		}
+		host = addr
+	}
+
+	// Every address was a trusted proxy,
+	return host
+}
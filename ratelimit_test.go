@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBucketsRefillUpToTheBurst(t *testing.T) {
+
+	l := RateLimit{Rate: 60, Burst: 2}
+	start := time.Now()
+	b := &bucket{tokens: float64(l.Burst), updated: start}
+
+	for _, tc := range []struct {
+		after time.Duration
+		ok    bool
+		wait  time.Duration
+	}{
+		{0, true, 0},
+		{0, true, 0},
+		{0, false, time.Second},
+		{500 * time.Millisecond, false, 500 * time.Millisecond},
+		{time.Second, true, 0},
+		{time.Minute, true, 0},
+		{time.Minute, true, 0},
+		{time.Minute, false, time.Second},
+	} {
+		ok, wait := b.take(start.Add(tc.after), l)
+		if ok != tc.ok || wait.Round(time.Millisecond) != tc.wait {
+			t.Errorf("after %v took %v and waits %v", tc.after, ok, wait)
+		}
+	}
+}
+
+func TestRateLimitStoresKeepBucketsApart(t *testing.T) {
+
+	setupTest(t)
+	configuration.RateLimits = map[string]RateLimit{rateCreate: {Rate: 1, Burst: 2}}
+
+	for _, store := range []string{rateStoreMemory, rateStoreSQL} {
+		configuration.RateLimitStore = store
+		s := newRateLimitStore()
+		l := configuration.RateLimits[rateCreate]
+
+		for i, tc := range []struct {
+			key string
+			ok  bool
+		}{
+			{"a", true},
+			{"a", true},
+			{"b", true},
+			{"a", false},
+			{"b", true},
+			{"b", false},
+		} {
+			ok, wait := s.Take(store+tc.key, l)
+			if ok != tc.ok || !ok && (wait <= 0 || wait > time.Minute) {
+				t.Errorf("%s take %d of %s answered %v, waiting %v", store, i, tc.key, ok, wait)
+			}
+		}
+	}
+}
+
+func TestRateLimitedRoutes(t *testing.T) {
+
+	setupTest(t)
+	configuration.RateLimits = map[string]RateLimit{
+		rateCreate: {Rate: 1, Burst: 1},
+		rateLogin:  {Rate: 1, Burst: 1},
+	}
+	rateLimiter = newRateLimitStore()
+
+	u := createUser("alice@example.com", "", []byte(""))
+	token := createToken(u.Id, "ci", []string{scopeWrite}, 0)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+
+	for _, tc := range []struct {
+		name   string
+		class  string
+		method string
+		ip     string
+		token  string
+		status int
+	}{
+		{"first create", rateCreate, "POST", "192.0.2.1", "", 200},
+		{"second create", rateCreate, "POST", "192.0.2.1", "", http.StatusTooManyRequests},
+		{"other address", rateCreate, "POST", "192.0.2.2", "", 200},
+		{"token", rateCreate, "POST", "192.0.2.1", token, 200},
+		{"token again", rateCreate, "POST", "192.0.2.3", token, http.StatusTooManyRequests},
+		{"unknown token", rateCreate, "POST", "192.0.2.4", "unknown", 200},
+		{"unknown token again", rateCreate, "POST", "192.0.2.4", "other", http.StatusTooManyRequests},
+		{"unlimited class", rateRead, "GET", "192.0.2.1", "", 200},
+		{"login", rateLogin, "POST", "192.0.2.1", "", 200},
+		{"login again", rateLogin, "POST", "192.0.2.1", "", http.StatusTooManyRequests},
+		{"login page", rateLogin, "GET", "192.0.2.1", "", 200},
+	} {
+		r := httptest.NewRequest(tc.method, "/", nil)
+		r.RemoteAddr = tc.ip + ":1234"
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		rateLimited(tc.class, ok)(w, r)
+
+		if w.Code != tc.status {
+			t.Errorf("%s answered %d instead of %d", tc.name, w.Code, tc.status)
+		}
+		if retry := w.Header().Get("Retry-After"); (retry != "") != (tc.status != 200) || retry == "0" {
+			t.Errorf("%s answered Retry-After %q", tc.name, retry)
+		}
+	}
+}
+
+func TestRemoteIPOnlyTrustsTheConfiguredProxies(t *testing.T) {
+
+	setupTest(t)
+	configuration.TrustedProxies = []string{"10.0.0.0/8", "2001:db8::1"}
+	trustedProxies = newTrustedProxies()
+
+	for _, tc := range []struct {
+		remote    string
+		forwarded string
+		real      string
+		want      string
+	}{
+		{"192.0.2.1:1234", "", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "198.51.100.1", "198.51.100.2", "192.0.2.1"},
+		{"10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "", "198.51.100.2", "198.51.100.2"},
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.2", "198.51.100.1"},
+		{"10.0.0.1:1234", "203.0.113.9, 198.51.100.1, 10.0.0.2", "", "198.51.100.1"},
+		{"10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "", "10.0.0.3"},
+		{"10.0.0.1:1234", "198.51.100.1, ", "", "198.51.100.1"},
+		{"[2001:db8::1]:1234", "2001:db8::2", "", "2001:db8::2"},
+		{"[2001:db8::3]:1234", "198.51.100.1", "", "2001:db8::3"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if tc.real != "" {
+			r.Header.Set("X-Real-IP", tc.real)
+		}
+		if got := remoteIP(r); got != tc.want {
+			t.Errorf("%s forwarded for %q is %s instead of %s", tc.remote, tc.forwarded, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// reportReasons are the reasons a paste can be reported for, in the order they
+// are shown.
+var reportReasons = []string{
+	"Spam",
+	"Malware or phishing",
+	"Personal information",
+	"Copyright",
+	"Other",
+}
+
+// This struct is used for indata when a paste is reported.
+type ReportRequest struct {
+	Reason  string `json:"reason"`  // One of the report reasons
+	Details string `json:"details"` // Optional explanation of the reporter
+}
+
+// addReport records an abuse report about a paste. A user can only report a
+// paste once, and so can an ip address without logging in. Users behind the
+// same ip address each get their report.
+// Returns false if the paste was already reported by the user or ip address.
+func addReport(pasteId string, userId int64, ip string, reason string) bool {
+
+	var count int
+	var err error
+	if userId != 0 {
+		err = dbHandle.QueryRow("select count(*) from "+configuration.DBReportsTable+
+			" where pasteid="+configuration.DBPlaceHolder[0]+" and userid="+
+			configuration.DBPlaceHolder[1], pasteId, userId).Scan(&count)
+	} else {
+		err = dbHandle.QueryRow("select count(*) from "+configuration.DBReportsTable+
+			" where pasteid="+configuration.DBPlaceHolder[0]+" and ip="+
+			configuration.DBPlaceHolder[1]+" and userid is NULL", pasteId, ip).Scan(&count)
+	}
+	checkErr(err)
+
+	if count > 0 {
+		loggy(fmt.Sprintf("Paste '%s' was already reported by user %d from %s.", pasteId, userId, ip))
+		return false
+	}
+
+	// Anonymous reports don't have a reporter,
+	reporter := sql.NullInt64{Int64: userId, Valid: userId != 0}
+
+	stmt, err := dbHandle.Prepare("INSERT INTO " + configuration.DBReportsTable +
+		" (pasteid,userid,ip,reason,created_at)values(" + dbPlaceHolders(5) + ")")
+	checkErr(err)
+
+	_, err = stmt.Exec(pasteId, reporter, ip, reason, time.Now().Unix())
+	checkErr(err)
+	stmt.Close()
+
+	loggy(fmt.Sprintf("Paste '%s' reported by %s : %s", pasteId, ip, reason))
+	return true
+}
+
+// countReports returns how many times a paste has been reported.
+func countReports(pasteId string) int {
+
+	var count int
+	err := dbHandle.QueryRow("select count(*) from "+configuration.DBReportsTable+
+		" where pasteid="+configuration.DBPlaceHolder[0], pasteId).Scan(&count)
+	checkErr(err)
+
+	return count
+}
+
+// parseReportReason builds the reason stored with a report from the reason and
+// details given by the reporter.
+// Returns an empty string if the reason is unknown.
+func parseReportReason(reason string, details string) string {
+
+	for _, r := range reportReasons {
+		if r == reason {
+			details = strings.TrimSpace(details)
+			if details != "" {
+				reason += " : " + details
+			}
+			reason = html.EscapeString(reason)
+			if len(reason) > 255 {
+				reason = reason[:255]
+			}
+			return reason
+		}
+	}
+
+	return ""
+}
+
+// reportPaste reports a paste the user can see. The paste is quarantined once
+// it has been reported as often as the report threshold.
+// Returns an error if the reason is unknown, the paste can't be seen or the
+// reporter already reported it.
+func reportPaste(r *http.Request, u *User, pasteId string, inData ReportRequest) error {
+
+	reason := parseReportReason(inData.Reason, inData.Details)
+	if reason == "" {
+		return newError(http.StatusBadRequest, codeUnknownReason,
+			strings.Join(reportReasons, ", "))
+	}
+
+	// Only pastes the reporter can see can be reported,
+	_, err := getPaste(pasteId, u)
+	if err != nil {
+		return err
+	}
+
+	var userId int64
+	if u != nil {
+		userId = u.Id
+	}
+
+	if !addReport(pasteId, userId, remoteIP(r), reason) {
+		return newError(http.StatusConflict, codeAlreadyReported)
+	}
+
+	if configuration.ReportThreshold > 0 &&
+		countReports(pasteId) >= configuration.ReportThreshold {
+		setPasteQuarantined(pasteId, true)
+		logAdminAction(0, auditQuarantine, pasteId,
+			fmt.Sprintf("reached %d reports", configuration.ReportThreshold))
+	}
+
+	return nil
+}
+
+// reportHandler reports a paste.
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+
+	pasteId := html.EscapeString(mux.Vars(r)["pasteId"])
+
+	var inData ReportRequest
+	err := json.NewDecoder(r.Body).Decode(&inData)
+	if err != nil {
+		sendError(w, r, newError(http.StatusBadRequest, codeInvalidRequest, err.Error()))
+		return
+	}
+
+	u, ok := apiUser(w, r, scopeRead)
+	if !ok {
+		return
+	}
+
+	err = reportPaste(r, u, pasteId, inData)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	sendJSON(w, Response{
+		Code:   codePasteReported,
+		Id:     pasteId,
+		Status: statusText(r, codePasteReported)})
+}
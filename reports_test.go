@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// reportFrom reports a paste as the user, from the ip address.
+func reportFrom(pasteId string, u *User, ip string) error {
+	r := httptest.NewRequest("POST", "/api/"+pasteId+"/report", nil)
+	r.RemoteAddr = ip + ":1234"
+	return reportPaste(r, u, pasteId, ReportRequest{Reason: "Spam"})
+}
+
+func TestReportsOncePerUserOrAnonymousIP(t *testing.T) {
+
+	setupTest(t)
+	configuration.ReportThreshold = 0
+
+	p := savePaste("", "buy now", 0, 0, 0, false)
+	alice := createUser("alice@example.com", "", []byte(""))
+	bob := createUser("bob@example.com", "", []byte(""))
+
+	// Users behind the same proxy each get their report,
+	if err := reportFrom(p.Id, alice, "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reportFrom(p.Id, bob, "192.0.2.1"); err != nil {
+		t.Fatalf("bob's report was refused : %v", err)
+	}
+
+	// and so does an anonymous reporter there,
+	if err := reportFrom(p.Id, nil, "192.0.2.1"); err != nil {
+		t.Fatalf("the anonymous report was refused : %v", err)
+	}
+
+	if n := countReports(p.Id); n != 3 {
+		t.Fatalf("%d reports instead of 3", n)
+	}
+
+	// but nobody reports twice,
+	for _, u := range []*User{alice, nil} {
+		err := reportFrom(p.Id, u, "192.0.2.1")
+		if e, ok := err.(*RequestError); !ok || e.Status != http.StatusConflict || e.Code != codeAlreadyReported {
+			t.Errorf("a second report answered %v", err)
+		}
+	}
+
+	// not even from another address,
+	if err := reportFrom(p.Id, alice, "198.51.100.7"); err == nil {
+		t.Error("alice reported twice from another address")
+	}
+
+	if n := countReports(p.Id); n != 3 {
+		t.Fatalf("%d reports instead of 3", n)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"time"
+)
+
+// Revision is a former version of a paste, kept when the paste is changed.
+// The versions of a paste are numbered from 1, the current version comes
+// after the revisions.
+type Revision struct {
+	PasteId   string
+	Revision  int
+	Title     string
+	Paste     string
+	CreatedAt int64
+}
+
+// countRevisions returns how many former versions a paste has.
+func countRevisions(pasteId string) int {
+
+	var count int
+	err := dbHandle.QueryRow("select count(*) from "+configuration.DBRevisionsTable+
+		" where pasteid="+configuration.DBPlaceHolder[0], pasteId).Scan(&count)
+	checkErr(err)
+
+	return count
+}
+
+// getRevisions lists the former versions of a paste, oldest first.
+func getRevisions(pasteId string) []Revision {
+
+	revisions := []Revision{}
+
+	rows, err := dbHandle.Query("select revision, title, data, created_at from "+
+		configuration.DBRevisionsTable+" where pasteid="+configuration.DBPlaceHolder[0]+
+		" order by revision", pasteId)
+	checkErr(err)
+	defer rows.Close()
+
+	for rows.Next() {
+		v := Revision{PasteId: pasteId}
+		err := rows.Scan(&v.Revision, &v.Title, &v.Paste, &v.CreatedAt)
+		checkErr(err)
+
+		v.Title = html.UnescapeString(v.Title)
+		v.Paste = html.UnescapeString(v.Paste)
+		revisions = append(revisions, v)
+	}
+
+	return revisions
+}
+
+// getRevision gets a former version of a paste.
+// Returns nil if there is no such revision.
+func getRevision(pasteId string, revision int) *Revision {
+
+	v := Revision{PasteId: pasteId, Revision: revision}
+	err := dbHandle.QueryRow("select title, data, created_at from "+
+		configuration.DBRevisionsTable+" where pasteid="+configuration.DBPlaceHolder[0]+
+		" and revision="+configuration.DBPlaceHolder[1], pasteId, revision).Scan(&v.Title,
+		&v.Paste, &v.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	checkErr(err)
+
+	v.Title = html.UnescapeString(v.Title)
+	v.Paste = html.UnescapeString(v.Paste)
+	return &v
+}
+
+// updatePaste keeps the current version of a paste as a revision and replaces
+// it with the new title and data.
+func updatePaste(pasteId string, title string, paste string) {
+
+	var oldTitle, oldPaste string
+	var createdAt, updatedAt sql.NullInt64
+
+	err := dbHandle.QueryRow("select title, data, created_at, updated_at from "+
+		configuration.DBTable+" where id="+configuration.DBPlaceHolder[0],
+		pasteId).Scan(&oldTitle, &oldPaste, &createdAt, &updatedAt)
+	checkErr(err)
+
+	// The current version was made when the paste was last changed, or
+	// created,
+	madeAt := createdAt.Int64
+	if updatedAt.Valid {
+		madeAt = updatedAt.Int64
+	}
+
+	revision := countRevisions(pasteId) + 1
+	stmt, err := dbHandle.Prepare("INSERT INTO " + configuration.DBRevisionsTable +
+		" (pasteid,revision,title,data,created_at)values(" + dbPlaceHolders(5) + ")")
+	checkErr(err)
+	_, err = stmt.Exec(pasteId, revision, oldTitle, oldPaste, madeAt)
+	checkErr(err)
+	stmt.Close()
+
+	// Escape user input,
+	paste = html.EscapeString(paste)
+	title = html.EscapeString(title)
+
+	stmt, err = dbHandle.Prepare("UPDATE " + configuration.DBTable + " SET title=" +
+		configuration.DBPlaceHolder[0] + ", data=" + configuration.DBPlaceHolder[1] +
+		", hash=" + configuration.DBPlaceHolder[2] + ", updated_at=" +
+		configuration.DBPlaceHolder[3] + " WHERE id=" + configuration.DBPlaceHolder[4])
+	checkErr(err)
+	_, err = stmt.Exec(title, paste, shaPaste(paste), time.Now().Unix(), pasteId)
+	checkErr(err)
+	stmt.Close()
+
+	loggy(fmt.Sprintf("Kept version %d of paste '%s' and updated it.", revision, pasteId))
+}
+
+// delRevisions deletes the former versions of a paste.
+func delRevisions(pasteId string) {
+
+	stmt, err := dbHandle.Prepare("DELETE FROM " + configuration.DBRevisionsTable +
+		" WHERE pasteid=" + configuration.DBPlaceHolder[0])
+	checkErr(err)
+	_, err = stmt.Exec(pasteId)
+	checkErr(err)
+	stmt.Close()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// What SaveHandler does when a paste contains secrets,
+const (
+	secretScanOff    = "off"    // Don't scan pastes
+	secretScanWarn   = "warn"   // Save the paste and warn in the status
+	secretScanRedact = "redact" // Replace the secrets before saving
+	secretScanReject = "reject" // Refuse to save the paste
+)
+
+// SecretScanner finds secrets in a paste.
+type SecretScanner interface {
+	Scan(paste string) []SecretFinding
+}
+
+// SecretFinding is a secret found by a scanner, at paste[Start:End].
+type SecretFinding struct {
+	Rule  string
+	Start int
+	End   int
+}
+
+// SecretRule is a scanner matching a regular expression. If Entropy is set,
+// matches are only reported when their shannon entropy in bits per character
+// is at least that high, which catches random looking keys without a known
+// format.
+type SecretRule struct {
+	Name    string  `json:"name"`    // Shown to the user
+	Pattern string  `json:"pattern"` // Regular expression, empty to disable a built-in rule
+	Entropy float64 `json:"entropy"` // Minimum entropy of a match, 0 to skip the check
+
+	re *regexp.Regexp
+}
+
+// defaultSecretRules are the built-in rules. A rule from the rules file with the
+// same name replaces the built-in one.
+var defaultSecretRules = []SecretRule{
+	{Name: "AWS access key id", Pattern: `\b(AKIA|ASIA)[0-9A-Z]{16}\b`},
+	{Name: "AWS secret access key", Pattern: `(?i)aws.{0,20}secret.{0,20}[=:]\s*["']?[0-9a-zA-Z/+]{40}\b`},
+	{Name: "Private key", Pattern: `(?s)-----BEGIN [A-Z ]*PRIVATE KEY( BLOCK)?-----.*?(-----END [A-Z ]*PRIVATE KEY( BLOCK)?-----|$)`},
+	{Name: "JSON web token", Pattern: `\beyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}`},
+	{Name: "GitHub token", Pattern: `\bgh[pousr]_[A-Za-z0-9]{36,}\b`},
+	{Name: "Slack token", Pattern: `\bxox[abposr]-[A-Za-z0-9-]{10,}`},
+	{Name: "Google API key", Pattern: `\bAIza[0-9A-Za-z_-]{35}\b`},
+	{Name: "Stripe secret key", Pattern: `\b[rs]k_live_[0-9a-zA-Z]{24,}\b`},
+	{Name: "High entropy string", Pattern: `[A-Za-z0-9+/=_-]{32,}`, Entropy: 4.5},
+}
+
+// The scanners run on every paste, set up in main.
+var secretScanners []SecretScanner
+
+// newSecretScanners compiles the built-in rules together with the rules from
+// the rules file in the configuration.
+func newSecretScanners() []SecretScanner {
+
+	if configuration.SecretScan == "" || configuration.SecretScan == secretScanOff {
+		return nil
+	}
+
+	switch configuration.SecretScan {
+	case secretScanWarn, secretScanRedact, secretScanReject:
+	default:
+		debugLogger.Println("   Config error : Specified secret scan action (" +
+			configuration.SecretScan + ") not supported.")
+		os.Exit(1)
+	}
+
+	rules := append([]SecretRule{}, defaultSecretRules...)
+
+	if configuration.SecretRules != "" {
+		file, err := ioutil.ReadFile(configuration.SecretRules)
+		if err != nil {
+			debugLogger.Println("   Config error : " + err.Error())
+			os.Exit(1)
+		}
+
+		var custom []SecretRule
+		err = json.Unmarshal(file, &custom)
+		if err != nil {
+			debugLogger.Println("   Config error : " + configuration.SecretRules +
+				" : " + err.Error())
+			os.Exit(1)
+		}
+
+		for _, c := range custom {
+			replaced := false
+			for i := range rules {
+				if rules[i].Name == c.Name {
+					rules[i] = c
+					replaced = true
+				}
+			}
+			if !replaced {
+				rules = append(rules, c)
+			}
+		}
+		loggy("Loaded secret rules from " + configuration.SecretRules)
+	}
+
+	var scanners []SecretScanner
+	for _, rule := range rules {
+		if rule.Pattern == "" {
+			continue
+		}
+
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			debugLogger.Println("   Config error : Secret rule (" + rule.Name +
+				") : " + err.Error())
+			os.Exit(1)
+		}
+
+		rule.re = re
+		scanners = append(scanners, rule)
+	}
+
+	loggy("Scanning pastes for secrets, action is " + configuration.SecretScan)
+	return scanners
+}
+
+// shannonEntropy returns the entropy of a string in bits per character.
+func shannonEntropy(s string) float64 {
+
+	counts := make(map[rune]int)
+	for _, c := range s {
+		counts[c]++
+	}
+
+	n := float64(len([]rune(s)))
+	entropy := 0.0
+	for _, count := range counts {
+		p := float64(count) / n
+		entropy -= p * math.Log2(p)
+	}
+
+	return entropy
+}
+
+// Scan returns the matches of the rule.
+func (rule SecretRule) Scan(paste string) []SecretFinding {
+
+	var findings []SecretFinding
+	for _, m := range rule.re.FindAllStringIndex(paste, -1) {
+		if rule.Entropy > 0 && shannonEntropy(paste[m[0]:m[1]]) < rule.Entropy {
+			continue
+		}
+		findings = append(findings, SecretFinding{Rule: rule.Name, Start: m[0], End: m[1]})
+	}
+
+	return findings
+}
+
+// scanSecrets runs every scanner on the paste.
+// Returns the findings ordered by where they start, keeping the order of the
+// scanners for findings starting at the same place.
+func scanSecrets(paste string) []SecretFinding {
+
+	var findings []SecretFinding
+	for _, s := range secretScanners {
+		findings = append(findings, s.Scan(paste)...)
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Start < findings[j].Start
+	})
+
+	return findings
+}
+
+// secretNames returns the distinct rule names of the findings as a comma
+// separated string.
+func secretNames(findings []SecretFinding) string {
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, f := range findings {
+		if !seen[f.Rule] {
+			seen[f.Rule] = true
+			names = append(names, f.Rule)
+		}
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// redactSecrets replaces the findings in the paste. Overlapping findings are
+// redacted together.
+func redactSecrets(paste string, findings []SecretFinding) string {
+
+	var b strings.Builder
+	last := 0
+	for _, f := range findings {
+		if f.End <= last {
+			continue
+		}
+		if f.Start >= last {
+			b.WriteString(paste[last:f.Start])
+			b.WriteString("[REDACTED " + f.Rule + "]")
+		}
+		last = f.End
+	}
+	b.WriteString(paste[last:])
+
+	return b.String()
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gorilla/securecookie"
+)
+
+// CookieKeys is a hash/block key pair used to sign and encrypt the session
+// cookie. Both keys are base64 encoded.
+type CookieKeys struct {
+	Hash  string `json:"hash"`  // 32 or 64 bytes used to authenticate the cookie
+	Block string `json:"block"` // 16, 24 or 32 bytes used to encrypt the cookie
+}
+
+// Session is a logged in device of a user.
+type Session struct {
+	Id        string
+	UserId    int64
+	CreatedAt int64
+	ExpiresAt int64
+	LastSeen  int64
+	IP        string
+	UserAgent string
+	Current   bool
+}
+
+// SessionsPage is used for generating the sessions page.
+type SessionsPage struct {
+	Title     string
+	User      *User
+	Sessions  []Session
+	CSRFToken string
+	CSPNonce  string
+	Theme     Theme
+}
+
+// LastSeenStr returns when the session was last used in a human friendly
+// format.
+func (s Session) LastSeenStr() string {
+	return time.Unix(s.LastSeen, 0).Format("2006-01-02 15:04:05")
+}
+
+// CreatedAtStr returns when the session was created in a human friendly
+// format.
+func (s Session) CreatedAtStr() string {
+	return time.Unix(s.CreatedAt, 0).Format("2006-01-02 15:04:05")
+}
+
+// The default lifetime of a session, 30 days.
+const defaultSessionLifetime = 30 * 24 * 60 * 60
+
+// cookieCodecs signs and encrypts the session cookie. New cookies are always
+// encoded with the first codec, the rest are only used to decode cookies so
+// keys can be rotated without logging everyone out.
+var cookieCodecs []securecookie.Codec
+
+// sessionLifetime returns the configured session lifetime in seconds.
+func sessionLifetime() int64 {
+	if configuration.SessionLifetime <= 0 {
+		return defaultSessionLifetime
+	}
+	return configuration.SessionLifetime
+}
+
+// setupCookieCodecs creates the cookie codecs from the configured key pairs.
+// If no keys are configured random keys are generated, which means sessions
+// won't survive a restart.
+func setupCookieCodecs() {
+
+	var keyPairs [][]byte
+
+	for i, keys := range configuration.CookieKeys {
+		hashKey, err := base64.StdEncoding.DecodeString(keys.Hash)
+		if err != nil || (len(hashKey) != 32 && len(hashKey) != 64) {
+			debugLogger.Println(fmt.Sprintf("   Config error : cookie hash key %d must be 32 or 64 base64 encoded bytes.", i))
+			os.Exit(1)
+		}
+
+		blockKey, err := base64.StdEncoding.DecodeString(keys.Block)
+		if err != nil || (len(blockKey) != 16 && len(blockKey) != 24 && len(blockKey) != 32) {
+			debugLogger.Println(fmt.Sprintf("   Config error : cookie block key %d must be 16, 24 or 32 base64 encoded bytes.", i))
+			os.Exit(1)
+		}
+
+		keyPairs = append(keyPairs, hashKey, blockKey)
+	}
+
+	if len(keyPairs) == 0 {
+		loggy("No cookie keys configured, generating random keys. Sessions will not survive a restart.")
+		keyPairs = append(keyPairs,
+			securecookie.GenerateRandomKey(64),
+			securecookie.GenerateRandomKey(32))
+	}
+
+	cookieCodecs = securecookie.CodecsFromPairs(keyPairs...)
+	for _, codec := range cookieCodecs {
+		codec.(*securecookie.SecureCookie).MaxAge(int(sessionLifetime()))
+	}
+}
+
+// newSession creates a session for the user and sets the session cookie.
+func newSession(w http.ResponseWriter, r *http.Request, u *User) {
+
+	sessionId := uniuri.NewLen(40)
+	now := time.Now().Unix()
+
+	delExpiredSessions()
+
+	stmt, err := dbHandle.Prepare("INSERT INTO " + configuration.DBSessionsTable +
+		" (id,userid,created_at,expires_at,last_seen,ip,useragent)values(" +
+		dbPlaceHolders(7) + ")")
+	checkErr(err)
+
+	// Make sure the user agent fits in the column,
+	userAgent := r.UserAgent()
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+
+	_, err = stmt.Exec(sessionId, u.Id, now, now+sessionLifetime(), now,
+		remoteIP(r), userAgent)
+	checkErr(err)
+	stmt.Close()
+
+	// encode session id into cookie
+	value := map[string]string{
+		"session": sessionId,
+	}
+	encoded, err := securecookie.EncodeMulti("session", value, cookieCodecs...)
+	checkErr(err)
+
+	http.SetCookie(w, newCookie("session", encoded, "/", int(sessionLifetime())))
+
+	// Pages are shown in the locale the user chose,
+	if u.Locale != "" {
+		setLocaleCookie(w, u.Locale)
+	}
+}
+
+// getSessionId decodes the session cookie of the request.
+// Returns an empty string if there is no valid cookie.
+func getSessionId(r *http.Request) string {
+
+	cookie, err := r.Cookie("session")
+	if err != nil {
+		return ""
+	}
+
+	cookieValue := make(map[string]string)
+	err = securecookie.DecodeMulti("session", cookie.Value, &cookieValue,
+		cookieCodecs...)
+	if err != nil {
+		return ""
+	}
+
+	return cookieValue["session"]
+}
+
+// currentUser returns the logged in user of the request.
+// Returns nil if the request has no valid session or the user is disabled.
+func currentUser(r *http.Request) *User {
+
+	sessionId := getSessionId(r)
+	if sessionId == "" {
+		return nil
+	}
+
+	var userId, expiresAt, lastSeen int64
+	err := dbHandle.QueryRow("select userid, expires_at, last_seen from "+
+		configuration.DBSessionsTable+" where id="+configuration.DBPlaceHolder[0],
+		sessionId).Scan(&userId, &expiresAt, &lastSeen)
+
+	switch {
+	case err == sql.ErrNoRows:
+		loggy("Session does not exist.")
+		return nil
+	case err != nil:
+		checkErr(err)
+	}
+
+	now := time.Now().Unix()
+	if now >= expiresAt {
+		loggy("Session has expired, deleting it.")
+		delSession(sessionId)
+		return nil
+	}
+
+	// Only bump last seen once a minute to save some writes,
+	if now-lastSeen > 60 {
+		stmt, err := dbHandle.Prepare("UPDATE " + configuration.DBSessionsTable +
+			" SET last_seen=" + configuration.DBPlaceHolder[0] + ", ip=" +
+			configuration.DBPlaceHolder[1] + " WHERE id=" +
+			configuration.DBPlaceHolder[2])
+		checkErr(err)
+		_, err = stmt.Exec(now, remoteIP(r), sessionId)
+		checkErr(err)
+		stmt.Close()
+	}
+
+	u := getUserById(userId)
+	if u == nil || u.Disabled {
+		return nil
+	}
+
+	return u
+}
+
+// getUserSessions lists the active sessions of a user. The session of the
+// request is marked as current.
+func getUserSessions(r *http.Request, id int64) []Session {
+
+	current := getSessionId(r)
+	sessions := []Session{}
+
+	rows, err := dbHandle.Query("select id, created_at, expires_at, last_seen, ip, useragent from "+
+		configuration.DBSessionsTable+" where userid="+
+		configuration.DBPlaceHolder[0]+" and expires_at>"+
+		configuration.DBPlaceHolder[1]+" order by last_seen desc",
+		id, time.Now().Unix())
+	checkErr(err)
+	defer rows.Close()
+
+	for rows.Next() {
+		s := Session{UserId: id}
+		err := rows.Scan(&s.Id, &s.CreatedAt, &s.ExpiresAt, &s.LastSeen, &s.IP,
+			&s.UserAgent)
+		checkErr(err)
+		s.Current = s.Id == current
+		sessions = append(sessions, s)
+	}
+
+	return sessions
+}
+
+// endSession removes the session of the request and clears the cookie.
+func endSession(w http.ResponseWriter, r *http.Request) {
+
+	if sessionId := getSessionId(r); sessionId != "" {
+		delSession(sessionId)
+	}
+
+	http.SetCookie(w, newCookie("session", "", "/", -1))
+}
+
+// delSession removes a single session.
+func delSession(sessionId string) {
+
+	stmt, err := dbHandle.Prepare("DELETE FROM " + configuration.DBSessionsTable +
+		" WHERE id=" + configuration.DBPlaceHolder[0])
+	checkErr(err)
+
+	_, err = stmt.Exec(sessionId)
+	checkErr(err)
+	stmt.Close()
+}
+
+// delUserSession removes a session, but only if it belongs to the user.
+func delUserSession(id int64, sessionId string) {
+
+	stmt, err := dbHandle.Prepare("DELETE FROM " + configuration.DBSessionsTable +
+		" WHERE id=" + configuration.DBPlaceHolder[0] + " and userid=" +
+		configuration.DBPlaceHolder[1])
+	checkErr(err)
+
+	_, err = stmt.Exec(sessionId, id)
+	checkErr(err)
+	stmt.Close()
+}
+
+// delUserSessions removes every session of a user.
+func delUserSessions(id int64) {
+
+	stmt, err := dbHandle.Prepare("DELETE FROM " + configuration.DBSessionsTable +
+		" WHERE userid=" + configuration.DBPlaceHolder[0])
+	checkErr(err)
+
+	_, err = stmt.Exec(id)
+	checkErr(err)
+	stmt.Close()
+}
+
+// delExpiredSessions removes all sessions that have expired.
+func delExpiredSessions() {
+
+	stmt, err := dbHandle.Prepare("DELETE FROM " + configuration.DBSessionsTable +
+		" WHERE expires_at<=" + configuration.DBPlaceHolder[0])
+	checkErr(err)
+
+	_, err = stmt.Exec(time.Now().Unix())
+	checkErr(err)
+	stmt.Close()
+}
+
+// sessionsHandler lists the active sessions of the logged in user and handles
+// revoking a single session or all of them on POST.
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+
+	u := currentUser(r)
+	if u == nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		page := &SessionsPage{
+			Title:     tr(r, "Sessions"),
+			User:      u,
+			Sessions:  getUserSessions(r, u.Id),
+			CSRFToken: csrfToken(w, r),
+			CSPNonce:  cspNonce(r),
+			Theme:     siteTheme,
+		}
+		renderPage(w, r, "sessions.html", page)
+	case "POST":
+		switch r.FormValue("action") {
+		case "revoke":
+			delUserSession(u.Id, r.FormValue("session"))
+			loggy(fmt.Sprintf("Revoked a session of user %d.", u.Id))
+		case "revokeall":
+			delUserSessions(u.Id)
+			loggy(fmt.Sprintf("Revoked all sessions of user %d.", u.Id))
+		}
+		http.Redirect(w, r, "/account/sessions", 302)
+	}
+}
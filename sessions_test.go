@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCurrentUserNeedsALiveSession(t *testing.T) {
+
+	setupTest(t)
+
+	for _, tc := range []struct {
+		name   string
+		change func(r *http.Request, u *User)
+		valid  bool
+	}{
+		{"live", func(r *http.Request, u *User) {}, true},
+		{"expired", func(r *http.Request, u *User) {
+			_, err := dbHandle.Exec("update "+configuration.DBSessionsTable+
+				" set expires_at=? where id=?", time.Now().Unix(), getSessionId(r))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"ended", func(r *http.Request, u *User) { delSession(getSessionId(r)) }, false},
+		{"revoked", func(r *http.Request, u *User) { delUserSessions(u.Id) }, false},
+		{"disabled", func(r *http.Request, u *User) { setUserDisabled(u.Id, true) }, false},
+		{"deleted", func(r *http.Request, u *User) { deleteUser(u.Id) }, false},
+		{"forged", func(r *http.Request, u *User) {
+			r.Header.Del("Cookie")
+			r.AddCookie(&http.Cookie{Name: "session", Value: "forged"})
+		}, false},
+	} {
+		u := createUser(tc.name+"@example.com", "", []byte(""))
+		r := loggedIn(httptest.NewRequest("GET", "/account", nil), u)
+		tc.change(r, u)
+
+		if got := currentUser(r); (got != nil) != tc.valid {
+			t.Errorf("a %s session found the user %v", tc.name, got)
+		}
+	}
+
+	// An expired session is removed as well,
+	var count int
+	err := dbHandle.QueryRow("select count(*) from "+configuration.DBSessionsTable+
+		" where expires_at<=?", time.Now().Unix()).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("%d expired sessions are left", count)
+	}
+}
+
+func TestUsersOnlyRevokeTheirOwnSessions(t *testing.T) {
+
+	setupTest(t)
+
+	alice := createUser("alice@example.com", "", []byte(""))
+	bob := createUser("bob@example.com", "", []byte(""))
+
+	first := loggedIn(httptest.NewRequest("GET", "/account/sessions", nil), alice)
+	second := loggedIn(httptest.NewRequest("GET", "/account/sessions", nil), alice)
+	theirs := loggedIn(httptest.NewRequest("GET", "/account/sessions", nil), bob)
+
+	sessions := getUserSessions(first, alice.Id)
+	if len(sessions) != 2 {
+		t.Fatalf("alice has %d sessions", len(sessions))
+	}
+	for _, s := range sessions {
+		if s.Current != (s.Id == getSessionId(first)) {
+			t.Errorf("session %s is marked current %v", s.Id, s.Current)
+		}
+	}
+
+	revoke := func(form url.Values) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/account/sessions", nil)
+		r.Form = form
+		for _, c := range first.Cookies() {
+			r.AddCookie(c)
+		}
+		sessionsHandler(w, r)
+		if w.Code != 302 {
+			t.Fatalf("revoking answered %d", w.Code)
+		}
+	}
+
+	for _, tc := range []struct {
+		name  string
+		form  url.Values
+		alive map[*http.Request]bool
+	}{
+		{"bob's session", url.Values{"action": {"revoke"}, "session": {getSessionId(theirs)}},
+			map[*http.Request]bool{first: true, second: true, theirs: true}},
+		{"the second session", url.Values{"action": {"revoke"}, "session": {getSessionId(second)}},
+			map[*http.Request]bool{first: true, second: false, theirs: true}},
+		{"all sessions", url.Values{"action": {"revokeall"}},
+			map[*http.Request]bool{first: false, second: false, theirs: true}},
+	} {
+		revoke(tc.form)
+		for r, alive := range tc.alive {
+			if (currentUser(r) != nil) != alive {
+				t.Errorf("after revoking %s session %s is alive %v", tc.name, getSessionId(r), !alive)
+			}
+		}
+	}
+}
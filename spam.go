@@ -0,0 +1,577 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// What a spam filter decides about a submission,
+const (
+	spamAccept = "accept" // Let the paste through, skipping the other filters
+	spamReject = "reject" // Refuse the paste
+	spamScore  = "score"  // Add to the score, the paste is refused once it reaches the threshold
+)
+
+// Names of the spam filters, as used in the configuration,
+const (
+	spamFilterHoneypot = "honeypot"
+	spamFilterSize     = "size"
+	spamFilterLinks    = "links"
+	spamFilterWords    = "words"
+	spamFilterBayes    = "bayes"
+)
+
+// How long rejected submissions are kept in the spam log.
+const spamLogDays = 30
+
+// The classifier needs this many spam and ham pastes before it starts scoring.
+const bayesMinMessages = 10
+
+// How many of the most telling words of a paste the classifier looks at.
+const bayesInteresting = 15
+
+// From this probability on the classifier scores a paste as spam on its own.
+const bayesCertain = 0.99
+
+// The row counting the trained pastes, it can't clash with a word since words
+// have no spaces.
+const bayesMessagesToken = " messages"
+
+// Submission is a paste as seen by the spam filters.
+type Submission struct {
+	Title    string
+	Paste    string
+	Honeypot string
+	IP       string
+	UserId   int64
+}
+
+// SpamResult is what a spam filter decides about a submission.
+type SpamResult struct {
+	Verdict string  // accept, reject or score
+	Score   float64 // Added to the score of the submission
+	Reason  string  // Why, shown in the spam log
+}
+
+// SpamFilter checks pastes for spam before they are saved.
+type SpamFilter interface {
+	Name() string
+	Check(s *Submission) SpamResult
+}
+
+// SpamEntry is a rejected submission in the spam log.
+type SpamEntry struct {
+	Id        int64
+	CreatedAt int64
+	IP        string
+	User      string
+	Filter    string
+	Score     float64
+	Reason    string
+	Title     string
+	Paste     string
+}
+
+// CreatedAtStr returns when the submission was rejected in a human friendly
+// format.
+func (e SpamEntry) CreatedAtStr() string {
+	return time.Unix(e.CreatedAt, 0).Format("2006-01-02 15:04:05")
+}
+
+// Excerpt returns the start of the rejected paste.
+func (e SpamEntry) Excerpt() string {
+	if len(e.Paste) > 200 {
+		return e.Paste[:200] + "..."
+	}
+	return e.Paste
+}
+
+// The filters every paste goes through, in order, set up in main.
+var spamFilters []SpamFilter
+
+// newSpamFilters sets up the filters listed in the configuration.
+func newSpamFilters() []SpamFilter {
+
+	var filters []SpamFilter
+	for _, name := range configuration.SpamFilters {
+		switch name {
+		case spamFilterHoneypot:
+			filters = append(filters, honeypotFilter{})
+		case spamFilterSize:
+			filters = append(filters, sizeFilter{max: configuration.MaxPasteSize})
+		case spamFilterLinks:
+			filters = append(filters, linkFilter{max: configuration.SpamMaxLinks})
+		case spamFilterWords:
+			filters = append(filters, newWordFilter())
+		case spamFilterBayes:
+			loadBayes()
+			filters = append(filters, bayesFilter{})
+		default:
+			debugLogger.Println("   Config error : Specified spam filter (" + name +
+				") not supported.")
+			os.Exit(1)
+		}
+	}
+
+	if len(filters) > 0 {
+		loggy("Filtering spam with " + strings.Join(configuration.SpamFilters, ", "))
+	}
+	return filters
+}
+
+// checkSpam runs the submission through the spam filters and logs it if it's
+// rejected.
+// Returns true if the submission is spam.
+func checkSpam(s *Submission) bool {
+
+	var total float64
+	var reasons []string
+	for _, f := range spamFilters {
+		res := f.Check(s)
+		switch res.Verdict {
+		case spamAccept:
+			loggy(fmt.Sprintf("Spam filter %s accepted the paste : %s", f.Name(), res.Reason))
+			return false
+		case spamReject:
+			loggy(fmt.Sprintf("Spam filter %s rejected the paste : %s", f.Name(), res.Reason))
+			logSpam(s, f.Name(), total, res.Reason)
+			return true
+		}
+		if res.Score != 0 {
+			total += res.Score
+			reasons = append(reasons, fmt.Sprintf("%s %.1f : %s", f.Name(), res.Score, res.Reason))
+		}
+	}
+
+	if configuration.SpamThreshold > 0 && total >= configuration.SpamThreshold {
+		reason := strings.Join(reasons, ", ")
+		loggy(fmt.Sprintf("Paste scored %.1f as spam : %s", total, reason))
+		logSpam(s, spamScore, total, reason)
+		return true
+	}
+
+	return false
+}
+
+// honeypotFilter rejects pastes with the hidden field of the paste form filled
+// in, which only bots do.
+type honeypotFilter struct{}
+
+func (f honeypotFilter) Name() string { return spamFilterHoneypot }
+
+func (f honeypotFilter) Check(s *Submission) SpamResult {
+	if s.Honeypot != "" {
+		return SpamResult{Verdict: spamReject, Reason: "hidden field filled in"}
+	}
+	return SpamResult{Verdict: spamScore}
+}
+
+// sizeFilter rejects pastes larger than max bytes, 0 for no limit.
+type sizeFilter struct {
+	max int
+}
+
+func (f sizeFilter) Name() string { return spamFilterSize }
+
+func (f sizeFilter) Check(s *Submission) SpamResult {
+	if f.max > 0 && len(s.Paste) > f.max {
+		return SpamResult{Verdict: spamReject,
+			Reason: fmt.Sprintf("%d bytes, the limit is %d", len(s.Paste), f.max)}
+	}
+	return SpamResult{Verdict: spamScore}
+}
+
+var linkRegexp = regexp.MustCompile(`(?i)\b(https?://|www\.)`)
+
+// linkFilter rejects pastes with more than max links, 0 for no limit. Pastes
+// that are mostly links score a point for every link.
+type linkFilter struct {
+	max int
+}
+
+func (f linkFilter) Name() string { return spamFilterLinks }
+
+func (f linkFilter) Check(s *Submission) SpamResult {
+
+	links := len(linkRegexp.FindAllStringIndex(s.Paste, -1))
+	reason := fmt.Sprintf("%d links", links)
+	if f.max > 0 && links > f.max {
+		return SpamResult{Verdict: spamReject, Reason: reason + ", the limit is " +
+			strconv.Itoa(f.max)}
+	}
+
+	lines := 0
+	for _, line := range strings.Split(s.Paste, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines++
+		}
+	}
+
+	if links*2 > lines {
+		return SpamResult{Verdict: spamScore, Score: float64(links), Reason: reason}
+	}
+	return SpamResult{Verdict: spamScore}
+}
+
+// wordFilter scores the banned words found in the title and paste.
+type wordFilter struct {
+	words []*regexp.Regexp
+	score float64
+}
+
+// newWordFilter reads the banned words file, one word or phrase per line.
+// Empty lines and lines starting with # are skipped.
+func newWordFilter() wordFilter {
+
+	f := wordFilter{score: configuration.SpamWordScore}
+	if configuration.SpamWords == "" {
+		return f
+	}
+
+	file, err := os.Open(configuration.SpamWords)
+	if err != nil {
+		debugLogger.Println("   Config error : " + err.Error())
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		// Only match whole words, where the word starts and ends with a letter,
+		pattern := regexp.QuoteMeta(word)
+		if isWordChar(word[0]) {
+			pattern = `\b` + pattern
+		}
+		if isWordChar(word[len(word)-1]) {
+			pattern += `\b`
+		}
+		f.words = append(f.words, regexp.MustCompile(`(?i)`+pattern))
+	}
+	if err := scanner.Err(); err != nil {
+		debugLogger.Println("   Config error : " + configuration.SpamWords + " : " + err.Error())
+		os.Exit(1)
+	}
+
+	loggy(fmt.Sprintf("Loaded %d banned words from %s", len(f.words), configuration.SpamWords))
+	return f
+}
+
+// isWordChar returns true for the characters \b counts as part of a word.
+func isWordChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func (f wordFilter) Name() string { return spamFilterWords }
+
+func (f wordFilter) Check(s *Submission) SpamResult {
+
+	var found []string
+	hits := 0
+	text := s.Title + "\n" + s.Paste
+	for _, re := range f.words {
+		if n := len(re.FindAllStringIndex(text, -1)); n > 0 {
+			hits += n
+			found = append(found, strings.ToLower(re.FindString(text)))
+		}
+	}
+
+	if hits == 0 {
+		return SpamResult{Verdict: spamScore}
+	}
+	return SpamResult{Verdict: spamScore, Score: float64(hits) * f.score,
+		Reason: strings.Join(found, ", ")}
+}
+
+// bayesModel counts in how many spam and ham pastes each word was seen.
+type bayesModel struct {
+	sync.Mutex
+	spam         map[string]int
+	ham          map[string]int
+	spamMessages int
+	hamMessages  int
+}
+
+// The classifier, trained by the moderators.
+var spamModel = &bayesModel{spam: map[string]int{}, ham: map[string]int{}}
+
+// bayesTokens splits a text into the distinct lower case words the classifier
+// looks at.
+func bayesTokens(text string) []string {
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\'' && r != '$' && r != '-'
+	})
+
+	var tokens []string
+	seen := make(map[string]bool)
+	for _, w := range words {
+		if len(w) < 3 || len(w) > 32 || seen[w] {
+			continue
+		}
+		seen[w] = true
+		tokens = append(tokens, w)
+		if len(tokens) == 1000 {
+			break
+		}
+	}
+
+	return tokens
+}
+
+// loadBayes reads the word counts of the classifier from the database.
+func loadBayes() {
+
+	rows, err := dbHandle.Query("select token, spam, ham from " + configuration.DBBayesTable)
+	checkErr(err)
+	defer rows.Close()
+
+	spamModel.Lock()
+	defer spamModel.Unlock()
+
+	for rows.Next() {
+		var token string
+		var spam, ham int
+		err := rows.Scan(&token, &spam, &ham)
+		checkErr(err)
+
+		if token == bayesMessagesToken {
+			spamModel.spamMessages, spamModel.hamMessages = spam, ham
+			continue
+		}
+		spamModel.spam[token], spamModel.ham[token] = spam, ham
+	}
+
+	loggy(fmt.Sprintf("Loaded spam classifier trained on %d spam and %d ham pastes.",
+		spamModel.spamMessages, spamModel.hamMessages))
+}
+
+// trainBayes teaches the classifier that the text is spam or not.
+func trainBayes(text string, spam bool) {
+
+	column := "ham"
+	if spam {
+		column = "spam"
+	}
+
+	tx, err := dbHandle.Begin()
+	checkErr(err)
+
+	update, err := tx.Prepare("UPDATE " + configuration.DBBayesTable + " SET " + column +
+		"=" + column + "+1 WHERE token=" + configuration.DBPlaceHolder[0])
+	checkErr(err)
+	defer update.Close()
+
+	insert, err := tx.Prepare("INSERT INTO " + configuration.DBBayesTable +
+		" (token,spam,ham)values(" + dbPlaceHolders(3) + ")")
+	checkErr(err)
+	defer insert.Close()
+
+	spamModel.Lock()
+	defer spamModel.Unlock()
+
+	for _, token := range append(bayesTokens(text), bayesMessagesToken) {
+		res, err := update.Exec(token)
+		checkErr(err)
+
+		n, err := res.RowsAffected()
+		checkErr(err)
+		if n == 0 {
+			s, h := 0, 1
+			if spam {
+				s, h = 1, 0
+			}
+			_, err = insert.Exec(token, s, h)
+			checkErr(err)
+		}
+
+		switch {
+		case token == bayesMessagesToken && spam:
+			spamModel.spamMessages++
+		case token == bayesMessagesToken:
+			spamModel.hamMessages++
+		case spam:
+			spamModel.spam[token]++
+		default:
+			spamModel.ham[token]++
+		}
+	}
+
+	checkErr(tx.Commit())
+	loggy(fmt.Sprintf("Trained spam classifier with a %s paste.", column))
+}
+
+// classify combines the spam probabilities of the most telling words of the
+// text.
+// Returns the probability that the text is spam, and false if the classifier
+// hasn't been trained enough yet.
+func (m *bayesModel) classify(text string) (float64, bool) {
+
+	m.Lock()
+	defer m.Unlock()
+
+	if m.spamMessages < bayesMinMessages || m.hamMessages < bayesMinMessages {
+		return 0, false
+	}
+
+	var probs []float64
+	for _, token := range bayesTokens(text) {
+		s, h := m.spam[token], m.ham[token]
+		if s+h < 2 {
+			continue
+		}
+		ps := float64(s) / float64(m.spamMessages)
+		ph := float64(h) / float64(m.hamMessages)
+		probs = append(probs, math.Min(0.99, math.Max(0.01, ps/(ps+ph))))
+	}
+
+	sort.Slice(probs, func(i, j int) bool {
+		return math.Abs(probs[i]-0.5) > math.Abs(probs[j]-0.5)
+	})
+	if len(probs) > bayesInteresting {
+		probs = probs[:bayesInteresting]
+	}
+
+	// Add up logarithms to not underflow,
+	var lnSpam, lnHam float64
+	for _, p := range probs {
+		lnSpam += math.Log(p)
+		lnHam += math.Log(1 - p)
+	}
+
+	return 1 / (1 + math.Exp(lnHam-lnSpam)), true
+}
+
+// bayesFilter scores pastes the classifier thinks are spam, a paste it's
+// certain about reaches the threshold on its own.
+type bayesFilter struct{}
+
+func (f bayesFilter) Name() string { return spamFilterBayes }
+
+func (f bayesFilter) Check(s *Submission) SpamResult {
+
+	prob, ok := spamModel.classify(s.Title + "\n" + s.Paste)
+	if !ok || prob <= 0.5 {
+		return SpamResult{Verdict: spamScore}
+	}
+
+	return SpamResult{Verdict: spamScore,
+		Score:  math.Min(1, (prob-0.5)/(bayesCertain-0.5)) * configuration.SpamThreshold,
+		Reason: fmt.Sprintf("%.0f%% spam", prob*100)}
+}
+
+// trainedPastes returns how many spam and ham pastes the classifier was
+// trained with.
+func trainedPastes() (int, int) {
+
+	var spam, ham int
+	err := dbHandle.QueryRow("select spam, ham from "+configuration.DBBayesTable+
+		" where token="+configuration.DBPlaceHolder[0], bayesMessagesToken).Scan(&spam, &ham)
+	if err != nil && err != sql.ErrNoRows {
+		checkErr(err)
+	}
+
+	return spam, ham
+}
+
+// logSpam adds a rejected submission to the spam log and drops entries older
+// than spamLogDays.
+func logSpam(s *Submission, filter string, score float64, reason string) {
+
+	paste := s.Paste
+	if len(paste) > 4096 {
+		paste = paste[:4096]
+	}
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+	user := sql.NullInt64{Int64: s.UserId, Valid: s.UserId != 0}
+	now := time.Now().Unix()
+
+	stmt, err := dbHandle.Prepare("INSERT INTO " + configuration.DBSpamTable +
+		" (created_at,ip,userid,filter,score,reason,title,paste)values(" +
+		dbPlaceHolders(8) + ")")
+	checkErr(err)
+
+	_, err = stmt.Exec(now, s.IP, user, filter, score, reason, s.Title, paste)
+	checkErr(err)
+	stmt.Close()
+
+	stmt, err = dbHandle.Prepare("DELETE FROM " + configuration.DBSpamTable +
+		" WHERE created_at<" + configuration.DBPlaceHolder[0])
+	checkErr(err)
+
+	_, err = stmt.Exec(now - spamLogDays*24*60*60)
+	checkErr(err)
+	stmt.Close()
+}
+
+// getSpamLog lists the newest rejected submissions.
+func getSpamLog() []SpamEntry {
+
+	entries := []SpamEntry{}
+
+	rows, err := dbHandle.Query("select s.id, s.created_at, s.ip, u.email, s.filter, " +
+		"s.score, s.reason, s.title, s.paste from " + configuration.DBSpamTable +
+		" s left join " + configuration.DBUsersTable + " u on u.id=s.userid" +
+		" order by s.created_at desc, s.id desc limit " + strconv.Itoa(adminListLimit))
+	checkErr(err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var e SpamEntry
+		var user sql.NullString
+
+		err := rows.Scan(&e.Id, &e.CreatedAt, &e.IP, &user, &e.Filter, &e.Score,
+			&e.Reason, &e.Title, &e.Paste)
+		checkErr(err)
+
+		e.User = user.String
+		entries = append(entries, e)
+	}
+
+	return entries
+}
+
+// getSpamEntry looks up a rejected submission.
+// Returns nil if there is no such entry.
+func getSpamEntry(id int64) *SpamEntry {
+
+	e := SpamEntry{Id: id}
+	err := dbHandle.QueryRow("select title, paste from "+configuration.DBSpamTable+
+		" where id="+configuration.DBPlaceHolder[0], id).Scan(&e.Title, &e.Paste)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		checkErr(err)
+	}
+
+	return &e
+}
+
+// delSpamEntry removes a rejected submission from the spam log.
+func delSpamEntry(id int64) {
+
+	stmt, err := dbHandle.Prepare("DELETE FROM " + configuration.DBSpamTable +
+		" WHERE id=" + configuration.DBPlaceHolder[0])
+	checkErr(err)
+
+	_, err = stmt.Exec(id)
+	checkErr(err)
+	stmt.Close()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// stubFilter answers the same result for every submission.
+type stubFilter struct {
+	name string
+	res  SpamResult
+}
+
+func (f stubFilter) Name() string                   { return f.name }
+func (f stubFilter) Check(s *Submission) SpamResult { return f.res }
+
+func TestSpamFilters(t *testing.T) {
+
+	setupTest(t)
+
+	words := filepath.Join(t.TempDir(), "words.txt")
+	err := ioutil.WriteFile(words, []byte("# banned\n\nviagra\ncheap pills\n$$$\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configuration.SpamWords = words
+	configuration.SpamWordScore = 2
+
+	for _, tc := range []struct {
+		name    string
+		filter  SpamFilter
+		s       Submission
+		verdict string
+		score   float64
+	}{
+		{"honeypot empty", honeypotFilter{}, Submission{Paste: "hi"}, spamScore, 0},
+		{"honeypot filled", honeypotFilter{}, Submission{Paste: "hi", Honeypot: "x"}, spamReject, 0},
+		{"size below", sizeFilter{max: 4}, Submission{Paste: "four"}, spamScore, 0},
+		{"size above", sizeFilter{max: 4}, Submission{Paste: "fives"}, spamReject, 0},
+		{"size unlimited", sizeFilter{}, Submission{Paste: strings.Repeat("a", 1<<16)}, spamScore, 0},
+		{"links in code", linkFilter{max: 3}, Submission{Paste: "see https://a.example\nline\nline\nline"}, spamScore, 0},
+		{"mostly links", linkFilter{max: 3}, Submission{Paste: "http://a.example\nwww.b.example"}, spamScore, 2},
+		{"too many links", linkFilter{max: 3}, Submission{Paste: strings.Repeat("http://a.example ", 4)}, spamReject, 0},
+		{"no words", newWordFilter(), Submission{Paste: "a viagraish word"}, spamScore, 0},
+		{"words", newWordFilter(), Submission{Title: "VIAGRA", Paste: "cheap pills, viagra"}, spamScore, 6},
+		{"symbols", newWordFilter(), Submission{Paste: "win $$$ now"}, spamScore, 2},
+	} {
+		res := tc.filter.Check(&tc.s)
+		if res.Verdict != tc.verdict || res.Score != tc.score {
+			t.Errorf("%s answered %s with %.1f", tc.name, res.Verdict, res.Score)
+		}
+	}
+}
+
+func TestSpamChainStopsAtTheFirstVerdict(t *testing.T) {
+
+	setupTest(t)
+	configuration.SpamThreshold = 5
+
+	accept := stubFilter{"accept", SpamResult{Verdict: spamAccept}}
+	reject := stubFilter{"reject", SpamResult{Verdict: spamReject, Reason: "no"}}
+	three := stubFilter{"three", SpamResult{Verdict: spamScore, Score: 3, Reason: "some"}}
+
+	for _, tc := range []struct {
+		name    string
+		filters []SpamFilter
+		spam    bool
+		logged  string
+	}{
+		{"nothing", nil, false, ""},
+		{"accepted", []SpamFilter{accept, reject}, false, ""},
+		{"rejected", []SpamFilter{three, reject, accept}, true, "reject"},
+		{"below threshold", []SpamFilter{three}, false, ""},
+		{"threshold", []SpamFilter{three, three}, true, spamScore},
+		{"accepted after scoring", []SpamFilter{three, accept, three}, false, ""},
+	} {
+		spamFilters = tc.filters
+		before := len(getSpamLog())
+
+		if checkSpam(&Submission{Title: tc.name, Paste: "text", IP: "192.0.2.1"}) != tc.spam {
+			t.Errorf("%s isn't spam %v", tc.name, tc.spam)
+		}
+
+		log := getSpamLog()
+		switch {
+		case tc.logged == "" && len(log) != before:
+			t.Errorf("%s was logged", tc.name)
+		case tc.logged != "" && (len(log) != before+1 || log[0].Filter != tc.logged ||
+			log[0].Title != tc.name):
+			t.Errorf("%s wasn't logged as %s", tc.name, tc.logged)
+		}
+	}
+}
+
+func TestBayesLearnsFromModerators(t *testing.T) {
+
+	setupTest(t)
+	configuration.SpamThreshold = 10
+
+	for i := 0; i < bayesMinMessages; i++ {
+		if _, ok := spamModel.classify("anything"); ok {
+			t.Fatal("the classifier scored before it was trained enough")
+		}
+		trainBayes("cheap watches casino bonus", true)
+		trainBayes("func main panic goroutine", false)
+	}
+
+	// The counts survive a restart,
+	spamModel = &bayesModel{spam: map[string]int{}, ham: map[string]int{}}
+	loadBayes()
+	if spam, ham := trainedPastes(); spam != bayesMinMessages || ham != bayesMinMessages {
+		t.Fatalf("trained with %d spam and %d ham", spam, ham)
+	}
+
+	for _, tc := range []struct {
+		text  string
+		score float64
+	}{
+		{"casino bonus today", 10},
+		{"goroutine panic in main", 0},
+		{"unknown words only", 0},
+	} {
+		res := bayesFilter{}.Check(&Submission{Paste: tc.text})
+		if res.Score != tc.score {
+			t.Errorf("%q scored %.2f instead of %.2f", tc.text, res.Score, tc.score)
+		}
+	}
+}
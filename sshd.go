@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Timeouts of ssh connections,
+const (
+	sshIdleTimeout = 30 * time.Second
+	sshMaxTimeout  = 2 * time.Minute
+)
+
+// The help shown for unknown commands and interactive logins,
+const sshUsage = `Usage:
+  ssh %[1]s < file          create a paste from a file
+  ssh %[1]s put [title]     create a paste from stdin, with a title
+  ssh %[1]s get <id>        print a paste
+`
+
+// startSSHServer starts the ssh server, if sshlistenport is set. Every key is
+// let in, pastes sent with a key registered on an account are owned by the
+// user and the others are anonymous. Exits if the host key can't be loaded or
+// the address can't be listened on.
+func startSSHServer() {
+
+	if configuration.SSHListenPort == "" {
+		return
+	}
+
+	signer := loadSSHHostKey(configuration.SSHHostKey)
+
+	addr := configuration.SSHListenAddress + ":" + configuration.SSHListenPort
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		debugLogger.Println("   Config error : can't listen on " + addr + " : " + err.Error())
+		os.Exit(1)
+	}
+
+	srv := &ssh.Server{
+		Handler: serveSSH,
+		// The user is looked up from the key in serveSSH, once the client
+		// proved it has the key,
+		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
+			return true
+		},
+		IdleTimeout: sshIdleTimeout,
+		MaxTimeout:  sshMaxTimeout,
+	}
+	srv.AddHostKey(signer)
+
+	loggy("Listening for ssh pastes on " + addr + ", host key " +
+		gossh.FingerprintSHA256(signer.PublicKey()) + ".")
+
+	go func() {
+		err := srv.Serve(l)
+		debugLogger.Println("   Ssh server stopped : " + err.Error())
+	}()
+}
+
+// loadSSHHostKey reads the private host key of the ssh server, generating an
+// ed25519 key in the file if there is none yet. Exits if the key can't be read
+// or written.
+func loadSSHHostKey(file string) gossh.Signer {
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		checkErr(err)
+
+		block, err := gossh.MarshalPrivateKey(key, "")
+		checkErr(err)
+
+		data = pem.EncodeToMemory(block)
+		err = ioutil.WriteFile(file, data, 0600)
+		if err != nil {
+			debugLogger.Println("   Config error : can't write the ssh host key " + file + " : " + err.Error())
+			os.Exit(1)
+		}
+		loggy("Generated the ssh host key " + file + ".")
+	} else if err != nil {
+		debugLogger.Println("   Config error : can't read the ssh host key " + file + " : " + err.Error())
+		os.Exit(1)
+	}
+
+	signer, err := gossh.ParsePrivateKey(data)
+	if err != nil {
+		debugLogger.Println("   Config error : invalid ssh host key " + file + " : " + err.Error())
+		os.Exit(1)
+	}
+
+	return signer
+}
+
+// sshHost returns the arguments to reach the ssh server with, like
+// "-p 2222 paste.example.com", or an empty string if it isn't running.
+func sshHost() string {
+
+	if configuration.SSHListenPort == "" {
+		return ""
+	}
+
+	host := configuration.SSHListenAddress
+	if u, err := url.Parse(configuration.Address); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+
+	if configuration.SSHListenPort == "22" {
+		return host
+	}
+	return "-p " + configuration.SSHListenPort + " " + host
+}
+
+// serveSSH runs the command of an ssh session.
+func serveSSH(s ssh.Session) {
+
+	ip, _, err := net.SplitHostPort(s.RemoteAddr().String())
+	if err != nil {
+		ip = s.RemoteAddr().String()
+	}
+
+	locale := defaultLocale()
+
+	// Internal errors only end this session,
+	defer func() {
+		if rec := recover(); rec != nil {
+			debugLogger.Println(fmt.Sprintf("   Internal error on ssh session from %s : %v", ip, rec))
+			fmt.Fprintln(s.Stderr(), translate(locale, statusMessages[codeInternal]))
+			s.Exit(1)
+		}
+	}()
+
+	// The account of the key the client authenticated with,
+	var u *User
+	if key := s.PublicKey(); key != nil {
+		var keyId int64
+		if keyId, u = getSSHKeyUser(key); u != nil {
+			setSSHKeyUsed(keyId)
+		}
+	}
+
+	if u != nil && supportedLocale(u.Locale) {
+		locale = u.Locale
+	}
+
+	l := configuration.RateLimits[rateSSH]
+	if rateLimiter != nil && l.Rate > 0 {
+		key := "ip:" + ip
+		if u != nil {
+			key = fmt.Sprintf("user:%d", u.Id)
+		}
+		if ok, wait := rateLimiter.Take(rateSSH+":"+key, l); !ok {
+			retry := int(wait.Seconds()) + 1
+			loggy(fmt.Sprintf("Rate limit of %s reached by %s, retry in %ds.", rateSSH, key, retry))
+			fmt.Fprintln(s.Stderr(), translate(locale, statusMessages[codeRateLimited], retry))
+			s.Exit(1)
+			return
+		}
+	}
+
+	args := s.Command()
+	_, _, isPty := s.Pty()
+
+	switch {
+	case len(args) == 0 && !isPty, len(args) > 0 && args[0] == "put":
+		title := ""
+		if len(args) > 1 {
+			title = strings.Join(args[1:], " ")
+		}
+		err = sshPut(s, u, ip, locale, title)
+	case len(args) == 2 && args[0] == "get":
+		err = sshGet(s, u, args[1])
+	default:
+		fmt.Fprintf(s.Stderr(), sshUsage, sshHost())
+		s.Exit(1)
+		return
+	}
+
+	if err != nil {
+		loggy(fmt.Sprintf("Ssh command %v from %s refused : %s", args, ip, err.Error()))
+		fmt.Fprintln(s.Stderr(), errorText(locale, err))
+		s.Exit(1)
+		return
+	}
+	s.Exit(0)
+}
+
+// sshPut saves the paste sent on stdin of an ssh session and prints its url.
+// The delkey and warnings about secrets go to stderr.
+// Returns an error if the paste is refused.
+func sshPut(s ssh.Session, u *User, ip string, locale string, title string) error {
+
+	max := maxStreamSize()
+
+	var buf bytes.Buffer
+	_, err := io.Copy(&buf, io.LimitReader(s, int64(max)+1))
+	if err != nil {
+		return newError(http.StatusBadRequest, codeInvalidRequest, err.Error())
+	}
+	if buf.Len() > max {
+		return newError(http.StatusRequestEntityTooLarge, codePasteTooLarge, max)
+	}
+
+	var ownerId int64
+	if u != nil {
+		ownerId = u.Id
+	}
+
+	paste, code, names, err := checkPasteContent(ip, u, title, buf.String(), "")
+	if err != nil {
+		return err
+	}
+
+	p := savePaste(title, paste, 0, ownerId, 0, false)
+	loggy(fmt.Sprintf("Saved ssh paste '%s' from %s for user %d.", p.Id, ip, ownerId))
+
+	fmt.Fprintln(s, p.Url)
+	if p.Code == codePasteSaved && code != codePasteSaved {
+		fmt.Fprintln(s.Stderr(), translate(locale, statusMessages[code], names))
+	}
+	if p.DelKey != "" && u == nil {
+		fmt.Fprintln(s.Stderr(), translate(locale, "Delete key : %s", p.DelKey))
+	}
+
+	return nil
+}
+
+// sshGet prints a paste the user of the session can see.
+// Returns an error if there is no such paste.
+func sshGet(s ssh.Session, u *User, pasteId string) error {
+
+	p, err := getPaste(pasteId, u)
+	if err != nil {
+		return err
+	}
+	burnAfterReading(pasteId, p, u)
+
+	io.WriteString(s, p.Paste)
+	if !strings.HasSuffix(p.Paste, "\n") {
+		io.WriteString(s, "\n")
+	}
+	return nil
+}
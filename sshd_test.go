@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// startTestSSHServer serves ssh sessions on a local port like startSSHServer.
+// Returns the address of the server.
+func startTestSSHServer(t *testing.T) string {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &ssh.Server{
+		Handler: serveSSH,
+		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
+			return true
+		},
+	}
+	srv.AddHostKey(newTestSSHKey(t))
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	return l.Addr().String()
+}
+
+// newTestSSHKey generates an ed25519 key.
+func newTestSSHKey(t *testing.T) gossh.Signer {
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// sshPaste sends a paste to the server, offering the keys in order.
+// Returns the id of the paste.
+func sshPaste(t *testing.T, addr string, paste string, keys ...gossh.Signer) string {
+
+	client, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+		User:            "paste",
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(keys...)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	s, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Stdin = strings.NewReader(paste)
+	out, err := s.Output("put")
+	if err != nil {
+		t.Fatalf("ssh paste failed : %v", err)
+	}
+
+	url := strings.TrimSpace(string(out))
+	return url[strings.LastIndex(url, "/")+1:]
+}
+
+func TestSSHPastesBelongToTheKeyOwner(t *testing.T) {
+
+	setupTest(t)
+	addr := startTestSSHServer(t)
+
+	alice := createUser("alice@example.com", "", []byte(""))
+	aliceKey := newTestSSHKey(t)
+	if msg := addSSHKey(alice.Id, "laptop", string(gossh.MarshalAuthorizedKey(aliceKey.PublicKey()))); msg != "" {
+		t.Fatal(msg)
+	}
+
+	id := sshPaste(t, addr, "from alice", aliceKey)
+	if owner, _ := getPasteOwner(id); owner != alice.Id {
+		t.Errorf("the paste of alice belongs to %d", owner)
+	}
+	if keys := getUserSSHKeys(alice.Id); len(keys) != 1 || keys[0].LastUsed == 0 {
+		t.Error("the key of alice wasn't marked as used")
+	}
+
+	// Clients are let in with the first key they offer, so the key of alice
+	// offered after another one isn't used,
+	id = sshPaste(t, addr, "from someone", newTestSSHKey(t), aliceKey)
+	if owner, _ := getPasteOwner(id); owner != 0 {
+		t.Errorf("the paste of someone else belongs to %d", owner)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// SSHKey is a public key registered on an account. Pastes sent over ssh with
+// the key are owned by the user.
+type SSHKey struct {
+	Id          int64
+	UserId      int64
+	Name        string
+	Fingerprint string // SHA256 fingerprint, as shown by ssh-keygen -l
+	Type        string
+	CreatedAt   int64
+	LastUsed    int64
+}
+
+// KeysPage is used for generating the ssh keys page.
+type KeysPage struct {
+	Title   string
+	User    *User
+	Keys    []SSHKey
+	Message string
+	SSHHost string // How to reach the ssh server, empty if it's not running
+
+	CSRFToken string
+	CSPNonce  string
+	Theme     Theme
+}
+
+// CreatedAtStr returns when the key was added in a human friendly format.
+func (k SSHKey) CreatedAtStr() string {
+	return time.Unix(k.CreatedAt, 0).Format("2006-01-02 15:04:05")
+}
+
+// LastUsedStr returns when the key was last used in a human friendly format.
+func (k SSHKey) LastUsedStr() string {
+	if k.LastUsed == 0 {
+		return "Never"
+	}
+	return time.Unix(k.LastUsed, 0).Format("2006-01-02 15:04:05")
+}
+
+// addSSHKey registers a public key in the authorized_keys format on an
+// account, named after its comment if no name is given.
+// Returns the text of the problem if the key can't be parsed or is already
+// registered, an empty string otherwise.
+func addSSHKey(userId int64, name string, authorizedKey string) string {
+
+	key, comment, _, _, err := gossh.ParseAuthorizedKey([]byte(strings.TrimSpace(authorizedKey)))
+	if err != nil {
+		return "That is not a valid public key."
+	}
+
+	if name == "" {
+		name = comment
+	}
+	if name == "" {
+		name = key.Type()
+	}
+	if len(name) > 255 {
+		name = name[:255]
+	}
+
+	fingerprint := gossh.FingerprintSHA256(key)
+
+	var id int64
+	err = dbHandle.QueryRow("select id from "+configuration.DBKeysTable+
+		" where fingerprint="+configuration.DBPlaceHolder[0], fingerprint).Scan(&id)
+	switch {
+	case err == nil:
+		return "That key is already registered."
+	case err != sql.ErrNoRows:
+		checkErr(err)
+	}
+
+	stmt, err := dbHandle.Prepare("INSERT INTO " + configuration.DBKeysTable +
+		" (userid,name,fingerprint,keytype,publickey,created_at)values(" + dbPlaceHolders(6) + ")")
+	checkErr(err)
+
+	_, err = stmt.Exec(userId, html.EscapeString(name), fingerprint, key.Type(),
+		strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key))), time.Now().Unix())
+	checkErr(err)
+	stmt.Close()
+
+	loggy(fmt.Sprintf("Added ssh key %s for user %d.", fingerprint, userId))
+	return ""
+}
+
+// getUserSSHKeys lists the ssh keys of a user.
+func getUserSSHKeys(userId int64) []SSHKey {
+
+	keys := []SSHKey{}
+
+	rows, err := dbHandle.Query("select id, name, fingerprint, keytype, created_at, last_used from "+
+		configuration.DBKeysTable+" where userid="+configuration.DBPlaceHolder[0]+
+		" order by created_at desc", userId)
+	checkErr(err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var lastUsed sql.NullInt64
+		k := SSHKey{UserId: userId}
+
+		err := rows.Scan(&k.Id, &k.Name, &k.Fingerprint, &k.Type, &k.CreatedAt, &lastUsed)
+		checkErr(err)
+
+		k.LastUsed = lastUsed.Int64
+		keys = append(keys, k)
+	}
+
+	return keys
+}
+
+// delUserSSHKey removes an ssh key, but only if it belongs to the user.
+func delUserSSHKey(userId int64, keyId int64) {
+
+	stmt, err := dbHandle.Prepare("DELETE FROM " + configuration.DBKeysTable +
+		" WHERE id=" + configuration.DBPlaceHolder[0] + " and userid=" +
+		configuration.DBPlaceHolder[1])
+	checkErr(err)
+
+	_, err = stmt.Exec(keyId, userId)
+	checkErr(err)
+	stmt.Close()
+
+	loggy(fmt.Sprintf("Removed ssh key %d of user %d.", keyId, userId))
+}
+
+// getSSHKeyUser looks up the user a public key is registered on.
+// Returns the id of the key and the user, nil if the key isn't registered or
+// the user is disabled.
+func getSSHKeyUser(key gossh.PublicKey) (int64, *User) {
+
+	fingerprint := gossh.FingerprintSHA256(key)
+
+	var keyId, userId int64
+	err := dbHandle.QueryRow("select id, userid from "+configuration.DBKeysTable+
+		" where fingerprint="+configuration.DBPlaceHolder[0], fingerprint).Scan(&keyId, &userId)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, nil
+	case err != nil:
+		checkErr(err)
+	}
+
+	u := getUserById(userId)
+	if u == nil || u.Disabled {
+		return 0, nil
+	}
+
+	return keyId, u
+}
+
+// setSSHKeyUsed marks a key as used now.
+func setSSHKeyUsed(keyId int64) {
+
+	stmt, err := dbHandle.Prepare("UPDATE " + configuration.DBKeysTable +
+		" SET last_used=" + configuration.DBPlaceHolder[0] + " WHERE id=" +
+		configuration.DBPlaceHolder[1])
+	checkErr(err)
+	_, err = stmt.Exec(time.Now().Unix(), keyId)
+	checkErr(err)
+	stmt.Close()
+}
+
+// keysHandler lists the ssh keys of the logged in user and handles adding and
+// removing keys on POST.
+func keysHandler(w http.ResponseWriter, r *http.Request) {
+
+	u := currentUser(r)
+	if u == nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+
+	page := &KeysPage{
+		CSRFToken: csrfToken(w, r),
+		CSPNonce:  cspNonce(r),
+		Theme:     siteTheme,
+		Title:     tr(r, "SSH keys"),
+		User:      u,
+		SSHHost:   sshHost(),
+	}
+
+	if r.Method == "POST" {
+		r.ParseForm()
+		switch r.FormValue("action") {
+		case "add":
+			problem := addSSHKey(u.Id, strings.TrimSpace(r.FormValue("name")), r.FormValue("key"))
+			if problem == "" {
+				http.Redirect(w, r, "/account/keys", 302)
+				return
+			}
+			page.Message = tr(r, problem)
+		case "remove":
+			id, err := strconv.ParseInt(r.FormValue("key"), 10, 64)
+			if err == nil {
+				delUserSSHKey(u.Id, id)
+			}
+			http.Redirect(w, r, "/account/keys", 302)
+			return
+		}
+	}
+
+	page.Keys = getUserSSHKeys(u.Id)
+
+	renderPage(w, r, "keys.html", page)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Defaults of the netcat listener,
+const (
+	tcpDefaultTimeout = 2 // Seconds without data before the paste is saved
+	tcpMaxDuration    = time.Minute
+)
+
+// startTCPListener starts the netcat listener, if tcplistenport is set. A
+// paste is read from every connection until the client closes it or stops
+// sending, and the url of the paste is written back. Exits if the address
+// can't be listened on.
+func startTCPListener() {
+
+	if configuration.TCPListenPort == "" {
+		return
+	}
+
+	addr := configuration.TCPListenAddress + ":" + configuration.TCPListenPort
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		debugLogger.Println("   Config error : can't listen on " + addr + " : " + err.Error())
+		os.Exit(1)
+	}
+	loggy("Listening for netcat pastes on " + addr + ".")
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					loggy("Netcat listener accept error : " + err.Error())
+					time.Sleep(100 * time.Millisecond)
+					continue
+				}
+				debugLogger.Println("   Netcat listener stopped : " + err.Error())
+				return
+			}
+			go serveTCP(conn)
+		}
+	}()
+}
+
+// serveTCP reads a paste from a netcat connection, saves it and answers with
+// its url, or with the message of the error.
+func serveTCP(conn net.Conn) {
+
+	defer conn.Close()
+
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		ip = conn.RemoteAddr().String()
+	}
+
+	// Internal errors only end this connection,
+	defer func() {
+		if rec := recover(); rec != nil {
+			debugLogger.Println(fmt.Sprintf("   Internal error on netcat paste from %s : %v", ip, rec))
+			fmt.Fprintln(conn, translate(defaultLocale(), statusMessages[codeInternal]))
+		}
+	}()
+
+	l := configuration.RateLimits[rateTCP]
+	if rateLimiter != nil && l.Rate > 0 {
+		if ok, wait := rateLimiter.Take(rateTCP+":ip:"+ip, l); !ok {
+			retry := int(wait.Seconds()) + 1
+			loggy(fmt.Sprintf("Rate limit of %s reached by ip:%s, retry in %ds.", rateTCP, ip, retry))
+			fmt.Fprintln(conn, translate(defaultLocale(), statusMessages[codeRateLimited], retry))
+			return
+		}
+	}
+
+	paste, err := readTCPPaste(conn)
+	if err != nil {
+		loggy(fmt.Sprintf("Netcat paste from %s refused : %s", ip, err.Error()))
+		fmt.Fprintln(conn, errorText(defaultLocale(), err))
+		return
+	}
+
+	paste, _, _, err = checkPasteContent(ip, nil, "", paste, "")
+	if err != nil {
+		loggy(fmt.Sprintf("Netcat paste from %s refused : %s", ip, err.Error()))
+		fmt.Fprintln(conn, errorText(defaultLocale(), err))
+		return
+	}
+
+	p := savePaste("", paste, 0, 0, 0, false)
+	loggy(fmt.Sprintf("Saved netcat paste '%s' from %s.", p.Id, ip))
+
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintln(conn, p.Url)
+}
+
+// readTCPPaste reads a paste until the client closes the connection or sends
+// nothing for tcptimeout seconds.
+// Returns an error if the paste is larger than allowed.
+func readTCPPaste(conn net.Conn) (string, error) {
+
+	timeout := time.Duration(configuration.TCPTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = tcpDefaultTimeout * time.Second
+	}
+
+	max := maxStreamSize()
+
+	// Slow clients get cut off after tcpMaxDuration, however little they send,
+	end := time.Now().Add(tcpMaxDuration)
+
+	var buf bytes.Buffer
+	chunk := make([]byte, 32*1024)
+	for {
+		deadline := time.Now().Add(timeout)
+		if deadline.After(end) {
+			deadline = end
+		}
+		conn.SetReadDeadline(deadline)
+
+		n, err := conn.Read(chunk)
+		buf.Write(chunk[:n])
+		if buf.Len() > max {
+			return "", newError(http.StatusRequestEntityTooLarge, codePasteTooLarge, max)
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return buf.String(), nil
+}
+
+// maxStreamSize returns the largest paste read from netcat and ssh clients,
+// maxpastesize or 1 MiB if that doesn't limit pastes.
+func maxStreamSize() int {
+	if configuration.MaxPasteSize > 0 {
+		return configuration.MaxPasteSize
+	}
+	return 1 << 20
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Roles a member can have in a team,
+const (
+	teamViewer = "viewer" // Read the team pastes
+	teamEditor = "editor" // Create and delete team pastes
+	teamOwner  = "owner"  // Manage the members and the team itself
+)
+
+// teamRoles are all the available team roles, from least to most privileged.
+var teamRoles = []string{teamViewer, teamEditor, teamOwner}
+
+// teamRolePriority returns how privileged a team role is.
+// Returns -1 for unknown roles and for users that aren't members.
+func teamRolePriority(role string) int {
+	for i, r := range teamRoles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// Team is a shared workspace. Pastes saved into a team are only visible to
+// its members.
+type Team struct {
+	Id        int64
+	Name      string
+	CreatedAt int64
+	Role      string // The role of the user the team was looked up for
+}
+
+// Member is a user in a team.
+type Member struct {
+	UserId      int64
+	Email       string
+	DisplayName string
+	Role        string
+}
+
+// TeamsPage is used for generating the teams page.
+type TeamsPage struct {
+	Title   string
+	User    *User
+	Teams   []Team
+	Message string
+
+	CSRFToken string
+	CSPNonce  string
+	Theme     Theme
+}
+
+// TeamPage is used for generating the page of a single team.
+type TeamPage struct {
+	Title   string
+	User    *User
+	Team    *Team
+	Members []Member
+	Roles   []string
+	Pastes  Pastes
+	Message string
+
+	CSRFToken string
+	CSPNonce  string
+	Theme     Theme
+}
+
+// IsOwner returns true if the user the team was looked up for owns it.
+func (t *Team) IsOwner() bool {
+	return t.Role == teamOwner
+}
+
+// CanEdit returns true if the user the team was looked up for can create and
+// delete team pastes.
+func (t *Team) CanEdit() bool {
+	return teamRolePriority(t.Role) >= teamRolePriority(teamEditor)
+}
+
+// createTeam creates a team owned by the user.
+// Returns nil if the name is taken.
+func createTeam(name string, ownerId int64) *Team {
+
+	var id int64
+	err := dbHandle.QueryRow("select id from "+configuration.DBTeamsTable+
+		" where name="+configuration.DBPlaceHolder[0], name).Scan(&id)
+	switch {
+	case err == nil:
+		loggy(fmt.Sprintf("Team name '%s' is taken.", name))
+		return nil
+	case err != sql.ErrNoRows:
+		checkErr(err)
+	}
+
+	stmt, err := dbHandle.Prepare("INSERT INTO " + configuration.DBTeamsTable +
+		" (name,created_at)values(" + dbPlaceHolders(2) + ")")
+	checkErr(err)
+	_, err = stmt.Exec(name, time.Now().Unix())
+	checkErr(err)
+	stmt.Close()
+
+	// Not every driver supports LastInsertId, the name is unique,
+	err = dbHandle.QueryRow("select id from "+configuration.DBTeamsTable+
+		" where name="+configuration.DBPlaceHolder[0], name).Scan(&id)
+	checkErr(err)
+
+	setTeamMember(id, ownerId, teamOwner)
+	loggy(fmt.Sprintf("Created team '%s' with id %d for user %d.", name, id, ownerId))
+
+	return getUserTeam(id, ownerId)
+}
+
+// getUserTeam looks up a team together with the role the user has in it.
+// Returns nil if the team doesn't exist or the user isn't a member.
+func getUserTeam(teamId int64, userId int64) *Team {
+
+	var t Team
+	err := dbHandle.QueryRow("select t.id, t.name, t.created_at, m.role from "+
+		configuration.DBTeamsTable+" t join "+configuration.DBMembersTable+
+		" m on m.teamid=t.id where t.id="+configuration.DBPlaceHolder[0]+
+		" and m.userid="+configuration.DBPlaceHolder[1], teamId, userId).Scan(
+		&t.Id, &t.Name, &t.CreatedAt, &t.Role)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		checkErr(err)
+	}
+
+	return &t
+}
+
+// getUserTeams lists the teams a user is a member of.
+func getUserTeams(userId int64) []Team {
+
+	teams := []Team{}
+
+	rows, err := dbHandle.Query("select t.id, t.name, t.created_at, m.role from "+
+		configuration.DBTeamsTable+" t join "+configuration.DBMembersTable+
+		" m on m.teamid=t.id where m.userid="+configuration.DBPlaceHolder[0]+
+		" order by t.name", userId)
+	checkErr(err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var t Team
+		err := rows.Scan(&t.Id, &t.Name, &t.CreatedAt, &t.Role)
+		checkErr(err)
+		teams = append(teams, t)
+	}
+
+	return teams
+}
+
+// getTeamRole returns the role of a user in a team, or an empty string if the
+// user isn't a member.
+func getTeamRole(teamId int64, userId int64) string {
+
+	var role string
+	err := dbHandle.QueryRow("select role from "+configuration.DBMembersTable+
+		" where teamid="+configuration.DBPlaceHolder[0]+" and userid="+
+		configuration.DBPlaceHolder[1], teamId, userId).Scan(&role)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return ""
+	case err != nil:
+		checkErr(err)
+	}
+
+	return role
+}
+
+// hasTeamRole returns true if the user has at least the given role in the
+// team. Requests made with a team token are limited to the team of the token.
+func hasTeamRole(u *User, teamId int64, role string) bool {
+
+	if u == nil || teamId == 0 || (u.Team != 0 && u.Team != teamId) {
+		return false
+	}
+
+	return teamRolePriority(getTeamRole(teamId, u.Id)) >= teamRolePriority(role)
+}
+
+// getTeamMembers lists the members of a team.
+func getTeamMembers(teamId int64) []Member {
+
+	members := []Member{}
+
+	rows, err := dbHandle.Query("select u.id, u.email, u.displayname, m.role from "+
+		configuration.DBMembersTable+" m join "+configuration.DBUsersTable+
+		" u on u.id=m.userid where m.teamid="+configuration.DBPlaceHolder[0]+
+		" order by u.email", teamId)
+	checkErr(err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var m Member
+		var displayName sql.NullString
+		err := rows.Scan(&m.UserId, &m.Email, &displayName, &m.Role)
+		checkErr(err)
+		m.DisplayName = displayName.String
+		members = append(members, m)
+	}
+
+	return members
+}
+
+// countTeamOwners returns how many owners a team has.
+func countTeamOwners(teamId int64) int {
+
+	var count int
+	err := dbHandle.QueryRow("select count(*) from "+configuration.DBMembersTable+
+		" where teamid="+configuration.DBPlaceHolder[0]+" and role="+
+		configuration.DBPlaceHolder[1], teamId, teamOwner).Scan(&count)
+	checkErr(err)
+
+	return count
+}
+
+// setTeamMember adds a user to a team, or changes the role of a member.
+func setTeamMember(teamId int64, userId int64, role string) {
+
+	if getTeamRole(teamId, userId) != "" {
+		stmt, err := dbHandle.Prepare("UPDATE " + configuration.DBMembersTable +
+			" SET role=" + configuration.DBPlaceHolder[0] + " WHERE teamid=" +
+			configuration.DBPlaceHolder[1] + " and userid=" +
+			configuration.DBPlaceHolder[2])
+		checkErr(err)
+		_, err = stmt.Exec(role, teamId, userId)
+		checkErr(err)
+		stmt.Close()
+		return
+	}
+
+	stmt, err := dbHandle.Prepare("INSERT INTO " + configuration.DBMembersTable +
+		" (teamid,userid,role,created_at)values(" + dbPlaceHolders(4) + ")")
+	checkErr(err)
+	_, err = stmt.Exec(teamId, userId, role, time.Now().Unix())
+	checkErr(err)
+	stmt.Close()
+}
+
+// delTeamMember removes a user from a team, together with the team tokens of
+// the user.
+func delTeamMember(teamId int64, userId int64) {
+
+	for _, table := range []string{configuration.DBMembersTable,
+		configuration.DBTokensTable} {
+		stmt, err := dbHandle.Prepare("DELETE FROM " + table +
+			" WHERE teamid=" + configuration.DBPlaceHolder[0] + " and userid=" +
+			configuration.DBPlaceHolder[1])
+		checkErr(err)
+		_, err = stmt.Exec(teamId, userId)
+		checkErr(err)
+		stmt.Close()
+	}
+}
+
+// delUserMemberships removes a user from every team. Teams left without an
+// owner are deleted.
+func delUserMemberships(userId int64) {
+
+	for _, t := range getUserTeams(userId) {
+		if t.IsOwner() && countTeamOwners(t.Id) == 1 {
+			deleteTeam(t.Id)
+		}
+	}
+
+	stmt, err := dbHandle.Prepare("DELETE FROM " + configuration.DBMembersTable +
+		" WHERE userid=" + configuration.DBPlaceHolder[0])
+	checkErr(err)
+	_, err = stmt.Exec(userId)
+	checkErr(err)
+	stmt.Close()
+}
+
+// deleteTeam deletes a team with its pastes, members and tokens. The pastes are
+// deleted rather than orphaned since they were never meant to be public.
+func deleteTeam(teamId int64) {
+
+	stmt, err := dbHandle.Prepare("DELETE FROM " + configuration.DBRevisionsTable +
+		" WHERE pasteid IN (SELECT id FROM " + configuration.DBTable + " WHERE teamid=" +
+		configuration.DBPlaceHolder[0] + ")")
+	checkErr(err)
+	_, err = stmt.Exec(teamId)
+	checkErr(err)
+	stmt.Close()
+
+	for _, table := range []string{configuration.DBTable,
+		configuration.DBTokensTable, configuration.DBMembersTable} {
+		stmt, err := dbHandle.Prepare("DELETE FROM " + table +
+			" WHERE teamid=" + configuration.DBPlaceHolder[0])
+		checkErr(err)
+		_, err = stmt.Exec(teamId)
+		checkErr(err)
+		stmt.Close()
+	}
+
+	stmt, err = dbHandle.Prepare("DELETE FROM " + configuration.DBTeamsTable +
+		" WHERE id=" + configuration.DBPlaceHolder[0])
+	checkErr(err)
+	_, err = stmt.Exec(teamId)
+	checkErr(err)
+	stmt.Close()
+
+	loggy(fmt.Sprintf("Successfully deleted team %d.", teamId))
+}
+
+// getTeamPastes gets the pastes of a team from the database. The delete keys
+// are left out for viewers.
+// Returns the Pastes struct.
+func getTeamPastes(t *Team) Pastes {
+
+	b := Pastes{Response: []Response{}}
+
+	// Quarantined and expired pastes can't be read by the members,
+	rows, err := dbHandle.Query("select id, title, delkey, data from "+
+		configuration.DBTable+" where teamid="+configuration.DBPlaceHolder[0]+
+		" and quarantined=0 and (expiry is NULL or expiry=0 or expiry>"+
+		configuration.DBPlaceHolder[1]+")", t.Id, time.Now().Unix())
+	checkErr(err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, title, delKey, data string
+		rows.Scan(&id, &title, &delKey, &data)
+		if !t.CanEdit() {
+			delKey = ""
+		}
+		b.Response = append(b.Response, Response{
+			Id:     id,
+			Title:  title,
+			Url:    configuration.Address + "/p/" + id,
+			Size:   len(data),
+			DelKey: delKey})
+	}
+
+	return b
+}
+
+// teamsHandler lists the teams of the logged in user and creates a team on
+// POST.
+func teamsHandler(w http.ResponseWriter, r *http.Request) {
+
+	u := currentUser(r)
+	if u == nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+
+	page := &TeamsPage{
+		Title:     tr(r, "Teams"),
+		User:      u,
+		CSRFToken: csrfToken(w, r),
+		CSPNonce:  cspNonce(r),
+		Theme:     siteTheme,
+	}
+
+	if r.Method == "POST" {
+		name := html.EscapeString(r.FormValue("name"))
+		if name == "" || len(name) > 255 {
+			page.Message = tr(r, "Enter a name for the team.")
+		} else if !validName(name) {
+			page.Message = nameRule(r)
+		} else if t := createTeam(name, u.Id); t != nil {
+			http.Redirect(w, r, "/teams/"+strconv.FormatInt(t.Id, 10), 302)
+			return
+		} else {
+			page.Message = tr(r, "That name is taken.")
+		}
+	}
+
+	page.Teams = getUserTeams(u.Id)
+
+	renderPage(w, r, "teams.html", page)
+}
+
+// teamHandler shows a team with its members and pastes. Owners can invite
+// members, change their roles, remove them and delete the team on POST, any
+// member can leave.
+func teamHandler(w http.ResponseWriter, r *http.Request) {
+
+	u := currentUser(r)
+	if u == nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+
+	teamId, _ := strconv.ParseInt(mux.Vars(r)["teamId"], 10, 64)
+	t := getUserTeam(teamId, u.Id)
+	if t == nil {
+		notFoundHandler(w, r)
+		return
+	}
+
+	page := &TeamPage{
+		Title:     t.Name,
+		User:      u,
+		Team:      t,
+		Roles:     teamRoles,
+		CSRFToken: csrfToken(w, r),
+		CSPNonce:  cspNonce(r),
+		Theme:     siteTheme,
+	}
+	url := "/teams/" + strconv.FormatInt(t.Id, 10)
+
+	if r.Method == "POST" {
+		action := r.FormValue("action")
+		role := r.FormValue("role")
+		memberId, _ := strconv.ParseInt(r.FormValue("member"), 10, 64)
+
+		switch {
+		case action == "leave":
+			if t.IsOwner() && countTeamOwners(t.Id) == 1 {
+				page.Message = tr(r, "Make someone else an owner before leaving.")
+				break
+			}
+			delTeamMember(t.Id, u.Id)
+			loggy(fmt.Sprintf("User %d left team %d.", u.Id, t.Id))
+			http.Redirect(w, r, "/teams", 302)
+			return
+
+		case !t.IsOwner():
+			page.Message = tr(r, "Only owners can manage the team.")
+
+		case action == "invite":
+			m := getUserByEmail(html.EscapeString(r.FormValue("email")))
+			if m == nil || m.Disabled || teamRolePriority(role) < 0 {
+				page.Message = tr(r, "There is no account with that email.")
+				break
+			}
+			if getTeamRole(t.Id, m.Id) != "" {
+				page.Message = tr(r, "That account is already a member.")
+				break
+			}
+			setTeamMember(t.Id, m.Id, role)
+			loggy(fmt.Sprintf("User %d added user %d to team %d as %s.", u.Id,
+				m.Id, t.Id, role))
+			mailer.Send(html.UnescapeString(m.Email),
+				"You were added to "+html.UnescapeString(t.Name),
+				html.UnescapeString(u.Name())+" added you to the team '"+
+					html.UnescapeString(t.Name)+"' as "+role+".\n\n"+
+					configuration.Address+url+"\n")
+			http.Redirect(w, r, url, 302)
+			return
+
+		case action == "role":
+			if teamRolePriority(role) < 0 || getTeamRole(t.Id, memberId) == "" {
+				break
+			}
+			if memberId == u.Id && role != teamOwner && countTeamOwners(t.Id) == 1 {
+				page.Message = tr(r, "A team needs at least one owner.")
+				break
+			}
+			setTeamMember(t.Id, memberId, role)
+			loggy(fmt.Sprintf("User %d made user %d %s of team %d.", u.Id,
+				memberId, role, t.Id))
+			http.Redirect(w, r, url, 302)
+			return
+
+		case action == "remove":
+			if memberId == u.Id {
+				page.Message = tr(r, "Use leave to remove yourself.")
+				break
+			}
+			delTeamMember(t.Id, memberId)
+			loggy(fmt.Sprintf("User %d removed user %d from team %d.", u.Id,
+				memberId, t.Id))
+			http.Redirect(w, r, url, 302)
+			return
+
+		case action == "delete":
+			deleteTeam(t.Id)
+			http.Redirect(w, r, "/teams", 302)
+			return
+		}
+	}
+
+	page.Members = getTeamMembers(t.Id)
+	page.Pastes = getTeamPastes(t)
+
+	renderPage(w, r, "team.html", page)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTeamPasteChangeNeedsMembership(t *testing.T) {
+
+	setupTest(t)
+
+	owner := createUser("owner@example.com", "", []byte(""))
+	editor := createUser("editor@example.com", "", []byte(""))
+	team := createTeam("ops", owner.Id)
+	setTeamMember(team.Id, editor.Id, teamEditor)
+
+	p := savePaste("notes", "team notes", 0, editor.Id, team.Id, false)
+	r := httptest.NewRequest("DELETE", "/api/v2/pastes/"+p.Id, nil)
+
+	if err := checkPasteChange(r, editor, p.Id, "", "delete this paste"); err != nil {
+		t.Fatalf("the editor can't change the paste : %v", err)
+	}
+
+	// Former members lose their pastes to the team,
+	delTeamMember(team.Id, editor.Id)
+	if err := checkPasteChange(r, editor, p.Id, "", "delete this paste"); err == nil {
+		t.Fatal("a former member can still change the paste")
+	}
+
+	// and so do members who are only viewers now,
+	setTeamMember(team.Id, editor.Id, teamViewer)
+	if err := checkPasteChange(r, editor, p.Id, "", "delete this paste"); err == nil {
+		t.Fatal("a viewer can change the paste")
+	}
+
+	if err := checkPasteChange(r, owner, p.Id, "", "delete this paste"); err != nil {
+		t.Fatalf("the team owner can't change the paste : %v", err)
+	}
+}
+
+func TestTeamPastesHideQuarantinedAndExpired(t *testing.T) {
+
+	setupTest(t)
+
+	owner := createUser("owner@example.com", "", []byte(""))
+	team := createTeam("ops", owner.Id)
+
+	live := savePaste("live", "still here", 0, owner.Id, team.Id, false)
+	later := savePaste("later", "expires later", 3600, owner.Id, team.Id, false)
+	quarantined := savePaste("quarantined", "reported", 0, owner.Id, team.Id, false)
+	setPasteQuarantined(quarantined.Id, true)
+	expired := savePaste("expired", "gone", 3600, owner.Id, team.Id, false)
+	_, err := dbHandle.Exec("update "+configuration.DBTable+" set expiry=? where id=?",
+		time.Now().Unix()-1, expired.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listed := map[string]bool{}
+	for _, p := range getTeamPastes(getUserTeam(team.Id, owner.Id)).Response {
+		listed[p.Id] = true
+	}
+
+	if !listed[live.Id] || !listed[later.Id] {
+		t.Errorf("live pastes aren't listed : %v", listed)
+	}
+	if listed[quarantined.Id] {
+		t.Error("the quarantined paste is listed")
+	}
+	if listed[expired.Id] {
+		t.Error("the expired paste is listed")
+	}
+}
+
+func TestTeamNamesAreOneLine(t *testing.T) {
+
+	setupTest(t)
+
+	alice := createUser("alice@example.com", "", []byte(""))
+
+	for name, created := range map[string]bool{
+		"ops\r\nBcc: eve@example.com": false,
+		"ops\tteam":                   false,
+		"ops team":                    true,
+	} {
+		w := postForm(func(w http.ResponseWriter, r *http.Request) {
+			teamsHandler(w, loggedIn(r, alice))
+		}, "/teams", url.Values{"name": {name}})
+
+		if (w.Code == 302) != created {
+			t.Errorf("creating the team %q answered %d", name, w.Code)
+		}
+	}
+	if teams := getUserTeams(alice.Id); len(teams) != 1 {
+		t.Errorf("alice has %d teams", len(teams))
+	}
+}
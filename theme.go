@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// The highlight style of pastes without one, unless themestyle says otherwise,
+const defaultThemeStyle = "manni"
+
+// Colours replacing the ones of the material design theme, any css colour.
+type ThemeColors struct {
+	Primary    string `json:"primary"`    // Buttons and toggles
+	Navbar     string `json:"navbar"`     // Background of the navbar
+	Background string `json:"background"` // Background of the pages
+	Text       string `json:"text"`       // Text of the pages
+	Link       string `json:"link"`       // Links
+}
+
+// A link in the footer of the pages.
+type FooterLink struct {
+	Title string `json:"title"`
+	Url   string `json:"url"`
+}
+
+// This struct is handed to every template, as Theme of the page.
+type Theme struct {
+	Name        string
+	Logo        string
+	Colors      map[string]template.CSS
+	FooterLinks []FooterLink
+	CSS         string
+}
+
+// The theme of the pastebin, set up from the configuration at startup,
+var siteTheme Theme
+
+// Colours are limited to hex, names and rgb(a)/hsl(a) so they can't break out
+// of the stylesheet,
+var themeColorRegexp = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|[a-zA-Z]+|(rgb|hsl)a?\([0-9.,% ]+\))$`)
+
+// loadTheme checks the theme settings of the configuration and sets up the
+// theme of the pages. Exits if a setting is invalid.
+func loadTheme() {
+
+	colors := map[string]string{
+		"primary":    configuration.ThemeColors.Primary,
+		"navbar":     configuration.ThemeColors.Navbar,
+		"background": configuration.ThemeColors.Background,
+		"text":       configuration.ThemeColors.Text,
+		"link":       configuration.ThemeColors.Link,
+	}
+
+	// Checked colours are safe to put into the stylesheet of the pages,
+	safeColors := make(map[string]template.CSS)
+	for name, color := range colors {
+		if color == "" {
+			continue
+		}
+		if !themeColorRegexp.MatchString(color) {
+			debugLogger.Println("   Config error : invalid " + name + " colour " + color)
+			os.Exit(1)
+		}
+		safeColors[name] = template.CSS(color)
+	}
+
+	for _, asset := range []string{configuration.ThemeLogo, configuration.ThemeCSS} {
+		if asset != "" && assetHash(asset) == "" {
+			debugLogger.Println("   Config error : no asset " + asset + " in assetsdir")
+			os.Exit(1)
+		}
+	}
+
+	if configuration.ThemeStyle != "" && listOfStyles[configuration.ThemeStyle] == "" {
+		debugLogger.Println("   Config error : unknown highlight style " + configuration.ThemeStyle)
+		os.Exit(1)
+	}
+
+	for _, link := range configuration.ThemeFooterLinks {
+		if link.Title == "" || link.Url == "" {
+			debugLogger.Println("   Config error : footer links need a title and an url")
+			os.Exit(1)
+		}
+	}
+
+	siteTheme = Theme{
+		Name:        configuration.DisplayName,
+		Logo:        configuration.ThemeLogo,
+		Colors:      safeColors,
+		FooterLinks: configuration.ThemeFooterLinks,
+		CSS:         configuration.ThemeCSS,
+	}
+
+	if configuration.Theme != "" {
+		loggy(fmt.Sprintf("Using the %s theme", configuration.Theme))
+	}
+}
+
+// themeTemplates returns the pattern of the template set of the theme in
+// the assets. Returns an empty string for the built-in templates.
+func themeTemplates() string {
+
+	if configuration.Theme == "" {
+		return ""
+	}
+
+	if strings.ContainsAny(configuration.Theme, "/\\.") {
+		debugLogger.Println("   Config error : invalid theme name " + configuration.Theme)
+		os.Exit(1)
+	}
+
+	return "themes/" + configuration.Theme + "/*.html"
+}
+
+// defaultStyle returns the highlight style of pastes without one.
+func defaultStyle() string {
+	if configuration.ThemeStyle != "" {
+		return configuration.ThemeStyle
+	}
+	return defaultThemeStyle
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestThemeColorsCantBreakOutOfTheStylesheet(t *testing.T) {
+	for color, valid := range map[string]bool{
+		"#fff":                      true,
+		"#a1b2c3d4":                 true,
+		"rebeccapurple":             true,
+		"rgb(10, 20, 30)":           true,
+		"rgba(10,20,30,0.5)":        true,
+		"hsl(120, 50%, 50%)":        true,
+		"#ff":                       false,
+		"#ggg":                      false,
+		"red; } body { color: blue": false,
+		"red}":                      false,
+		"url(evil.png)":             false,
+		"expression(alert(1))":      false,
+		"rgb(1,2,3);":               false,
+		"</style><script>":          false,
+		"":                          false,
+	} {
+		if themeColorRegexp.MatchString(color) != valid {
+			t.Errorf("the colour %q isn't valid %v", color, valid)
+		}
+	}
+}
+
+func TestThemeIsRenderedOnThePages(t *testing.T) {
+
+	setupTest(t)
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"logo.png":               "png",
+		"brand.css":              "body {}",
+		"themes/dark/theme.html": `{{ define "theme-footer" }}<footer>dark footer</footer>{{ end }}`,
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		setup    func()
+		want     []string
+		unwanted []string
+	}{
+		{"built-in", func() {}, []string{">Home</a>"}, []string{`class="container theme-footer"`, `class="theme-logo"`}},
+		{"colours", func() {
+			configuration.ThemeColors = ThemeColors{Primary: "#123456", Background: "rgb(1, 2, 3)"}
+		}, []string{"color: #123456;", "body { background-color: rgb(1, 2, 3); }"}, []string{".navbar, .navbar.navbar-default"}},
+		{"branding", func() {
+			configuration.ThemeLogo = "logo.png"
+			configuration.ThemeCSS = "brand.css"
+			configuration.ThemeFooterLinks = []FooterLink{{Title: "Imprint", Url: "https://example.com/imprint"}}
+		}, []string{`src="/assets/logo.png?v=`, `href="/assets/brand.css?v=`,
+			`<a href="https://example.com/imprint">Imprint</a>`}, []string{">Home</a>"}},
+		{"template set", func() {
+			configuration.Theme = "dark"
+			configuration.ThemeFooterLinks = []FooterLink{{Title: "Imprint", Url: "https://example.com/imprint"}}
+		}, []string{"<footer>dark footer</footer>"}, []string{"Imprint"}},
+	} {
+		configuration.AssetsDir = dir
+		configuration.Theme = ""
+		configuration.ThemeColors = ThemeColors{}
+		configuration.ThemeLogo, configuration.ThemeCSS = "", ""
+		configuration.ThemeFooterLinks = nil
+		tc.setup()
+		loadTheme()
+		templates = loadTemplates()
+
+		w := httptest.NewRecorder()
+		loginHandler(w, httptest.NewRequest("GET", "/login", nil))
+		body := w.Body.String()
+
+		for _, s := range tc.want {
+			if !strings.Contains(body, s) {
+				t.Errorf("the %s theme doesn't show %q", tc.name, s)
+			}
+		}
+		for _, s := range tc.unwanted {
+			if strings.Contains(body, s) {
+				t.Errorf("the %s theme shows %q", tc.name, s)
+			}
+		}
+	}
+}
+
+func TestThemeStyleIsTheDefaultStyle(t *testing.T) {
+
+	setupTest(t)
+
+	for style, want := range map[string]string{
+		"":      defaultThemeStyle,
+		"manni": "manni",
+	} {
+		configuration.ThemeStyle = style
+		if got := defaultStyle(); got != want {
+			t.Errorf("the theme style %q gives %q", style, got)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+)
+
+// Scopes an api token can be given,
+const (
+	scopeRead   = "read"   // List and read the pastes of the user
+	scopeWrite  = "write"  // Create pastes owned by the user
+	scopeDelete = "delete" // Delete pastes owned by the user
+	scopeTokens = "tokens" // Manage the api tokens of the user
+)
+
+// tokenScopes are all the available scopes, in the order they are shown.
+var tokenScopes = []string{scopeRead, scopeWrite, scopeDelete, scopeTokens}
+
+// Token is a personal api token. Only the sha256 of the token is stored, the
+// token itself is shown once when it's created. A token given a team only
+// acts on the pastes of that team.
+type Token struct {
+	Id        int64
+	UserId    int64
+	TeamId    int64
+	TeamName  string
+	Name      string
+	Scopes    []string
+	CreatedAt int64
+	LastUsed  int64
+}
+
+// TokensPage is used for generating the tokens page.
+type TokensPage struct {
+	Title    string
+	User     *User
+	Tokens   []Token
+	Scopes   []string
+	Teams    []Team
+	NewToken string
+
+	CSRFToken string
+	CSPNonce  string
+	Theme     Theme
+}
+
+// HasScope returns true if the token has been given the scope.
+func (t Token) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ScopesStr returns the scopes of the token as a comma separated string.
+func (t Token) ScopesStr() string {
+	return strings.Join(t.Scopes, ", ")
+}
+
+// CreatedAtStr returns when the token was created in a human friendly format.
+func (t Token) CreatedAtStr() string {
+	return time.Unix(t.CreatedAt, 0).Format("2006-01-02 15:04:05")
+}
+
+// LastUsedStr returns when the token was last used in a human friendly format.
+func (t Token) LastUsedStr() string {
+	if t.LastUsed == 0 {
+		return "Never"
+	}
+	return time.Unix(t.LastUsed, 0).Format("2006-01-02 15:04:05")
+}
+
+// hashToken hashes a raw token for storing and looking it up in the database.
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseScopes filters the given scopes down to the known ones.
+func parseScopes(scopes []string) []string {
+
+	var parsed []string
+	for _, s := range tokenScopes {
+		for _, given := range scopes {
+			if given == s {
+				parsed = append(parsed, s)
+				break
+			}
+		}
+	}
+
+	return parsed
+}
+
+// createToken creates a new api token for the user, limited to a team if
+// teamId isn't 0.
+// Returns the raw token, which is not stored anywhere.
+func createToken(userId int64, name string, scopes []string, teamId int64) string {
+
+	raw := uniuri.NewLen(40)
+	team := sql.NullInt64{Int64: teamId, Valid: teamId != 0}
+
+	stmt, err := dbHandle.Prepare("INSERT INTO " + configuration.DBTokensTable +
+		" (userid,teamid,name,hash,scopes,created_at)values(" + dbPlaceHolders(6) + ")")
+	checkErr(err)
+
+	_, err = stmt.Exec(userId, team, name, hashToken(raw), strings.Join(scopes, ","),
+		time.Now().Unix())
+	checkErr(err)
+	stmt.Close()
+
+	loggy(fmt.Sprintf("Created token '%s' with scopes '%v' and team %d for user %d.",
+		name, scopes, teamId, userId))
+	return raw
+}
+
+// getUserTokens lists the api tokens of a user.
+func getUserTokens(userId int64) []Token {
+
+	tokens := []Token{}
+
+	rows, err := dbHandle.Query("select k.id, k.teamid, t.name, k.name, k.scopes, k.created_at, k.last_used from "+
+		configuration.DBTokensTable+" k left join "+configuration.DBTeamsTable+
+		" t on t.id=k.teamid where k.userid="+
+		configuration.DBPlaceHolder[0]+" order by k.created_at desc", userId)
+	checkErr(err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var scopes string
+		var teamId, lastUsed sql.NullInt64
+		var teamName sql.NullString
+		t := Token{UserId: userId}
+
+		err := rows.Scan(&t.Id, &teamId, &teamName, &t.Name, &scopes,
+			&t.CreatedAt, &lastUsed)
+		checkErr(err)
+
+		t.Scopes = strings.Split(scopes, ",")
+		t.TeamId = teamId.Int64
+		t.TeamName = teamName.String
+		t.LastUsed = lastUsed.Int64
+		tokens = append(tokens, t)
+	}
+
+	return tokens
+}
+
+// delUserToken revokes a token, but only if it belongs to the user.
+// Returns false if the user has no such token.
+func delUserToken(userId int64, tokenId int64) bool {
+
+	stmt, err := dbHandle.Prepare("DELETE FROM " + configuration.DBTokensTable +
+		" WHERE id=" + configuration.DBPlaceHolder[0] + " and userid=" +
+		configuration.DBPlaceHolder[1])
+	checkErr(err)
+
+	res, err := stmt.Exec(tokenId, userId)
+	checkErr(err)
+	stmt.Close()
+
+	n, err := res.RowsAffected()
+	checkErr(err)
+
+	return n > 0
+}
+
+// getBearerToken returns the token from the Authorization header of the
+// request, or an empty string if there is none.
+func getBearerToken(r *http.Request) string {
+
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+
+	return strings.TrimSpace(auth[7:])
+}
+
+// getToken looks up a raw token and marks it as used.
+// Returns nil if the token doesn't exist.
+func getToken(raw string) *Token {
+
+	var t Token
+	var scopes string
+	var teamId, lastUsed sql.NullInt64
+
+	err := dbHandle.QueryRow("select id, userid, teamid, name, scopes, created_at, last_used from "+
+		configuration.DBTokensTable+" where hash="+configuration.DBPlaceHolder[0],
+		hashToken(raw)).Scan(&t.Id, &t.UserId, &teamId, &t.Name, &scopes,
+		&t.CreatedAt, &lastUsed)
+
+	switch {
+	case err == sql.ErrNoRows:
+		loggy("Token does not exist.")
+		return nil
+	case err != nil:
+		checkErr(err)
+	}
+
+	t.Scopes = strings.Split(scopes, ",")
+	t.TeamId = teamId.Int64
+	t.LastUsed = time.Now().Unix()
+
+	stmt, err := dbHandle.Prepare("UPDATE " + configuration.DBTokensTable +
+		" SET last_used=" + configuration.DBPlaceHolder[0] + " WHERE id=" +
+		configuration.DBPlaceHolder[1])
+	checkErr(err)
+	_, err = stmt.Exec(t.LastUsed, t.Id)
+	checkErr(err)
+	stmt.Close()
+
+	return &t
+}
+
+// requestUser authenticates an api request. Requests with a bearer token must
+// have a valid token with the given scope, requests without a token fall back
+// to the session cookie.
+// Returns the user, which is nil for anonymous requests, and the token, which
+// is nil for requests without one. For team tokens the Team of the user is set
+// to the team of the token.
+func requestUser(r *http.Request, scope string) (*User, *Token, error) {
+
+	raw := getBearerToken(r)
+	if raw == "" {
+		return currentUser(r), nil, nil
+	}
+
+	t := getToken(raw)
+	if t == nil {
+		return nil, nil, newError(http.StatusUnauthorized, codeInvalidToken)
+	}
+
+	u := getUserById(t.UserId)
+	if u == nil || u.Disabled {
+		return nil, nil, newError(http.StatusUnauthorized, codeInvalidToken)
+	}
+
+	if !t.HasScope(scope) {
+		loggy(fmt.Sprintf("Token %d is missing the '%s' scope.", t.Id, scope))
+		return nil, nil, newError(http.StatusForbidden, codeMissingScope, scope)
+	}
+
+	u.Team = t.TeamId
+
+	return u, t, nil
+}
+
+// apiUser authenticates an api request like requestUser, writing the error
+// and returning false if it fails.
+func apiUser(w http.ResponseWriter, r *http.Request, scope string) (*User, bool) {
+
+	u, _, err := requestUser(r, scope)
+	if err != nil {
+		sendError(w, r, err)
+		return nil, false
+	}
+
+	return u, true
+}
+
+// tokensHandler lists the api tokens of the logged in user and handles
+// creating and revoking tokens on POST.
+func tokensHandler(w http.ResponseWriter, r *http.Request) {
+
+	u := currentUser(r)
+	if u == nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+
+	page := &TokensPage{
+		CSRFToken: csrfToken(w, r),
+		CSPNonce:  cspNonce(r),
+		Theme:     siteTheme,
+		Title:     tr(r, "API tokens"),
+		User:      u,
+		Scopes:    tokenScopes,
+		Teams:     getUserTeams(u.Id),
+	}
+
+	if r.Method == "POST" {
+		r.ParseForm()
+		switch r.FormValue("action") {
+		case "create":
+			name := html.EscapeString(r.FormValue("name"))
+			scopes := parseScopes(r.Form["scope"])
+			teamId, _ := strconv.ParseInt(r.FormValue("team"), 10, 64)
+			if name == "" || len(scopes) == 0 ||
+				(teamId != 0 && getTeamRole(teamId, u.Id) == "") {
+				http.Redirect(w, r, "/account/tokens", 302)
+				return
+			}
+			page.NewToken = createToken(u.Id, name, scopes, teamId)
+		case "revoke":
+			id, err := strconv.ParseInt(r.FormValue("token"), 10, 64)
+			if err == nil {
+				delUserToken(u.Id, id)
+				loggy(fmt.Sprintf("Revoked token %d of user %d.", id, u.Id))
+			}
+			http.Redirect(w, r, "/account/tokens", 302)
+			return
+		}
+	}
+
+	page.Tokens = getUserTokens(u.Id)
+
+	renderPage(w, r, "tokens.html", page)
+}
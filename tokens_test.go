@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseScopesKeepsKnownScopesInOrder(t *testing.T) {
+	for _, tc := range []struct {
+		given []string
+		want  string
+	}{
+		{nil, ""},
+		{[]string{"admin"}, ""},
+		{[]string{"write", "read"}, "read,write"},
+		{[]string{"tokens", "tokens", "nope", "delete"}, "delete,tokens"},
+		{[]string{"READ"}, ""},
+	} {
+		got := ""
+		for i, s := range parseScopes(tc.given) {
+			if i > 0 {
+				got += ","
+			}
+			got += s
+		}
+		if got != tc.want {
+			t.Errorf("parseScopes(%q) is %q instead of %q", tc.given, got, tc.want)
+		}
+	}
+}
+
+func TestBearerTokensNeedTheirScope(t *testing.T) {
+
+	setupTest(t)
+
+	alice := createUser("alice@example.com", "", []byte(""))
+	bob := createUser("bob@example.com", "", []byte(""))
+	team := createTeam("ops", alice.Id)
+
+	reader := createToken(alice.Id, "reader", []string{scopeRead}, 0)
+	writer := createToken(alice.Id, "writer", []string{scopeRead, scopeWrite}, team.Id)
+	revoked := createToken(alice.Id, "revoked", []string{scopeRead}, 0)
+	disabled := createToken(bob.Id, "disabled", []string{scopeRead}, 0)
+
+	tokens := getUserTokens(alice.Id)
+	for _, k := range tokens {
+		if k.Name == "revoked" && !delUserToken(alice.Id, k.Id) {
+			t.Fatal("alice couldn't revoke the token")
+		}
+		if delUserToken(bob.Id, k.Id) {
+			t.Errorf("bob revoked the token %s of alice", k.Name)
+		}
+	}
+	setUserDisabled(bob.Id, true)
+
+	for _, tc := range []struct {
+		name   string
+		header string
+		scope  string
+		user   int64
+		team   int64
+		status int
+	}{
+		{"no token", "", scopeRead, 0, 0, 0},
+		{"reader", "Bearer " + reader, scopeRead, alice.Id, 0, 0},
+		{"lower case bearer", "bearer " + reader, scopeRead, alice.Id, 0, 0},
+		{"reader writing", "Bearer " + reader, scopeWrite, 0, 0, http.StatusForbidden},
+		{"team writer", "Bearer " + writer, scopeWrite, alice.Id, team.Id, 0},
+		{"writer deleting", "Bearer " + writer, scopeDelete, 0, 0, http.StatusForbidden},
+		{"revoked", "Bearer " + revoked, scopeRead, 0, 0, http.StatusUnauthorized},
+		{"disabled user", "Bearer " + disabled, scopeRead, 0, 0, http.StatusUnauthorized},
+		{"unknown", "Bearer unknown", scopeRead, 0, 0, http.StatusUnauthorized},
+		{"basic auth", "Basic " + reader, scopeRead, 0, 0, 0},
+	} {
+		r := httptest.NewRequest("GET", "/api/v2/pastes", nil)
+		if tc.header != "" {
+			r.Header.Set("Authorization", tc.header)
+		}
+
+		u, _, err := requestUser(r, tc.scope)
+		status := 0
+		if e, ok := err.(*RequestError); ok {
+			status = e.Status
+		} else if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		if status != tc.status {
+			t.Errorf("%s answered %d instead of %d", tc.name, status, tc.status)
+		}
+		if u != nil && (u.Id != tc.user || u.Team != tc.team) {
+			t.Errorf("%s found user %d of team %d", tc.name, u.Id, u.Team)
+		}
+		if u == nil && tc.user != 0 {
+			t.Errorf("%s found no user", tc.name)
+		}
+	}
+
+	// Using a token is recorded,
+	for _, k := range getUserTokens(alice.Id) {
+		if k.LastUsed == 0 {
+			t.Errorf("the use of token %s wasn't recorded", k.Name)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"html/template"
+	"image/png"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gorilla/securecookie"
+	"github.com/pquerna/otp/totp"
+)
+
+// The number of recovery codes generated when 2fa is enabled.
+const recoveryCodeCount = 10
+
+// How long the second login step may take in seconds.
+const loginStepLifetime = 5 * 60
+
+// TwoFactorPage is used for generating the 2fa settings page.
+type TwoFactorPage struct {
+	Title         string
+	User          *User
+	Enabled       bool
+	Secret        string
+	SignedSecret  string
+	QRCode        template.URL
+	URI           string
+	RecoveryCodes []string
+	CodesLeft     int
+	Message       string
+	CSRFToken     string
+	CSPNonce      string
+	Theme         Theme
+}
+
+// getUserTOTP returns the totp secret of the user and the last time step that
+// was used to log in. The secret is empty if 2fa isn't enabled.
+func getUserTOTP(id int64) (string, int64) {
+
+	var secret sql.NullString
+	var last sql.NullInt64
+
+	err := dbHandle.QueryRow("select totp_secret, totp_last from "+
+		configuration.DBUsersTable+" where id="+configuration.DBPlaceHolder[0],
+		id).Scan(&secret, &last)
+	checkErr(err)
+
+	return secret.String, last.Int64
+}
+
+// setUserTOTP enables 2fa for a user with the given secret, or disables it if
+// the secret is empty. The recovery codes are removed either way. The last used
+// time step is kept so the code used to enable 2fa can't be replayed.
+func setUserTOTP(id int64, secret string) {
+
+	value := sql.NullString{String: secret, Valid: secret != ""}
+
+	stmt, err := dbHandle.Prepare("UPDATE " + configuration.DBUsersTable +
+		" SET totp_secret=" + configuration.DBPlaceHolder[0] +
+		" WHERE id=" + configuration.DBPlaceHolder[1])
+	checkErr(err)
+
+	_, err = stmt.Exec(value, id)
+	checkErr(err)
+	stmt.Close()
+
+	delRecoveryCodes(id)
+}
+
+// resetUserTOTP disables 2fa for a user that lost their device and recovery
+// codes.
+func resetUserTOTP(id int64) {
+	setUserTOTP(id, "")
+	loggy(fmt.Sprintf("Reset 2fa of user %d.", id))
+}
+
+// checkTOTP checks a code against the secret, allowing one time step of clock
+// drift. A time step can only be used once.
+// Returns true if the code is valid.
+func checkTOTP(id int64, secret string, code string) bool {
+
+	code = strings.Replace(code, " ", "", -1)
+	_, last := getUserTOTP(id)
+	now := time.Now()
+
+	for skew := int64(-1); skew <= 1; skew++ {
+		t := now.Add(time.Duration(skew*30) * time.Second)
+		step := t.Unix() / 30
+		if step <= last {
+			continue
+		}
+
+		expected, err := totp.GenerateCode(secret, t)
+		if err != nil {
+			return false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			stmt, err := dbHandle.Prepare("UPDATE " + configuration.DBUsersTable +
+				" SET totp_last=" + configuration.DBPlaceHolder[0] +
+				" WHERE id=" + configuration.DBPlaceHolder[1])
+			checkErr(err)
+			_, err = stmt.Exec(step, id)
+			checkErr(err)
+			stmt.Close()
+			return true
+		}
+	}
+
+	return false
+}
+
+// newRecoveryCodes replaces the recovery codes of a user.
+// Returns the new codes, only their hashes are stored.
+func newRecoveryCodes(id int64) []string {
+
+	delRecoveryCodes(id)
+
+	stmt, err := dbHandle.Prepare("INSERT INTO " + configuration.DBRecoveryTable +
+		" (userid,hash)values(" + dbPlaceHolders(2) + ")")
+	checkErr(err)
+	defer stmt.Close()
+
+	var codes []string
+	for i := 0; i < recoveryCodeCount; i++ {
+		code := strings.ToLower(uniuri.NewLen(10))
+		_, err = stmt.Exec(id, hashToken(code))
+		checkErr(err)
+		codes = append(codes, code)
+	}
+
+	return codes
+}
+
+// countRecoveryCodes returns how many unused recovery codes a user has left.
+func countRecoveryCodes(id int64) int {
+
+	var count int
+	err := dbHandle.QueryRow("select count(*) from "+configuration.DBRecoveryTable+
+		" where userid="+configuration.DBPlaceHolder[0], id).Scan(&count)
+	checkErr(err)
+
+	return count
+}
+
+// useRecoveryCode consumes a recovery code of a user.
+// Returns true if the code was valid.
+func useRecoveryCode(id int64, code string) bool {
+
+	code = strings.ToLower(strings.TrimSpace(code))
+
+	stmt, err := dbHandle.Prepare("DELETE FROM " + configuration.DBRecoveryTable +
+		" WHERE userid=" + configuration.DBPlaceHolder[0] + " and hash=" +
+		configuration.DBPlaceHolder[1])
+	checkErr(err)
+	defer stmt.Close()
+
+	res, err := stmt.Exec(id, hashToken(code))
+	checkErr(err)
+
+	n, err := res.RowsAffected()
+	checkErr(err)
+
+	if n == 1 {
+		loggy(fmt.Sprintf("User %d used a recovery code.", id))
+	}
+	return n == 1
+}
+
+// delRecoveryCodes removes every recovery code of a user.
+func delRecoveryCodes(id int64) {
+
+	stmt, err := dbHandle.Prepare("DELETE FROM " + configuration.DBRecoveryTable +
+		" WHERE userid=" + configuration.DBPlaceHolder[0])
+	checkErr(err)
+
+	_, err = stmt.Exec(id)
+	checkErr(err)
+	stmt.Close()
+}
+
+// startSecondStep remembers that the user passed the password check and
+// redirects to the 2fa code form.
+func startSecondStep(w http.ResponseWriter, r *http.Request, u *User) {
+
+	value := map[string]string{
+		"user":    strconv.FormatInt(u.Id, 10),
+		"expires": strconv.FormatInt(time.Now().Unix()+loginStepLifetime, 10),
+	}
+	encoded, err := securecookie.EncodeMulti("login", value, cookieCodecs...)
+	checkErr(err)
+
+	http.SetCookie(w, newCookie("login", encoded, "/login", loginStepLifetime))
+	http.Redirect(w, r, "/login/2fa", 302)
+}
+
+// secondStepUser returns the user that passed the password check.
+// Returns nil if there is no valid login cookie.
+func secondStepUser(r *http.Request) *User {
+
+	cookie, err := r.Cookie("login")
+	if err != nil {
+		return nil
+	}
+
+	value := make(map[string]string)
+	err = securecookie.DecodeMulti("login", cookie.Value, &value, cookieCodecs...)
+	if err != nil {
+		return nil
+	}
+
+	expires, _ := strconv.ParseInt(value["expires"], 10, 64)
+	if time.Now().Unix() >= expires {
+		return nil
+	}
+
+	id, _ := strconv.ParseInt(value["user"], 10, 64)
+	u := getUserById(id)
+	if u == nil || u.Disabled {
+		return nil
+	}
+
+	return u
+}
+
+// loginTwoFactorHandler handles the second login step, where the user enters
+// a code from their authenticator app or a recovery code.
+func loginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+
+	u := secondStepUser(r)
+	if u == nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+
+	page := &Page{Title: tr(r, "Two-factor authentication"), CSRFToken: csrfToken(w, r), CSPNonce: cspNonce(r), Theme: siteTheme}
+
+	if r.Method == "POST" {
+		secret, _ := getUserTOTP(u.Id)
+		code := r.FormValue("code")
+		email := html.UnescapeString(u.Email)
+		ip := remoteIP(r)
+
+		// Codes are guessed like passwords,
+		if wait := loginWait(email, ip); wait > 0 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			page.Message = tr(r, "Too many failed logins, try again in %d seconds.", wait)
+			renderPage(w, r, "login2fa.html", page)
+			return
+		}
+
+		// 2fa might have been reset in the meantime,
+		if secret == "" || checkTOTP(u.Id, secret, code) ||
+			useRecoveryCode(u.Id, code) {
+			clearLoginFailures(accountSubject(email))
+			http.SetCookie(w, newCookie("login", "", "/login", -1))
+			newSession(w, r, u)
+			loggy(fmt.Sprintf("Successfully logged account '%s' in with 2fa.", u.Email))
+			http.Redirect(w, r, "/", 302)
+			return
+		}
+
+		loggy(fmt.Sprintf("Wrong 2fa code for account '%s'.", u.Email))
+		addLoginFailure(email, ip)
+		page.Message = tr(r, "The code is not valid.")
+	}
+
+	renderPage(w, r, "login2fa.html", page)
+}
+
+// twoFactorHandler shows the 2fa settings of the logged in user and handles
+// enabling, disabling and regenerating recovery codes on POST.
+func twoFactorHandler(w http.ResponseWriter, r *http.Request) {
+
+	u := currentUser(r)
+	if u == nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+
+	page := &TwoFactorPage{
+		CSRFToken: csrfToken(w, r),
+		CSPNonce:  cspNonce(r),
+		Theme:     siteTheme,
+		Title:     tr(r, "Two-factor authentication"),
+		User:      u,
+	}
+
+	secret, _ := getUserTOTP(u.Id)
+
+	if r.Method == "POST" {
+		switch r.FormValue("action") {
+		case "enable":
+			// The pending secret is signed so it can't be swapped,
+			err := securecookie.DecodeMulti("totp", r.FormValue("secret"),
+				&secret, cookieCodecs...)
+			if err != nil || !checkTOTP(u.Id, secret, r.FormValue("code")) {
+				page.Message = tr(r, "The code is not valid, try again.")
+				secret = ""
+				break
+			}
+			setUserTOTP(u.Id, secret)
+			page.RecoveryCodes = newRecoveryCodes(u.Id)
+			loggy(fmt.Sprintf("Enabled 2fa for user %d.", u.Id))
+		case "disable":
+			if u.AuthSource == authOIDC && !oidcReauthenticated(r, u) {
+				http.Redirect(w, r, "/login/oidc?reauth=/account/2fa", 302)
+				return
+			}
+			if !confirmPassword(r, u, r.FormValue("password")) {
+				page.Message = tr(r, "Wrong password.")
+				break
+			}
+			setUserTOTP(u.Id, "")
+			secret = ""
+			loggy(fmt.Sprintf("Disabled 2fa for user %d.", u.Id))
+		case "recovery":
+			if secret == "" || !checkTOTP(u.Id, secret, r.FormValue("code")) {
+				page.Message = tr(r, "The code is not valid.")
+				break
+			}
+			page.RecoveryCodes = newRecoveryCodes(u.Id)
+		}
+	}
+
+	page.Enabled = secret != ""
+
+	if page.Enabled {
+		page.CodesLeft = countRecoveryCodes(u.Id)
+	} else {
+		// Generate a new secret to enroll with,
+		key, err := totp.Generate(totp.GenerateOpts{
+			Issuer:      configuration.DisplayName,
+			AccountName: html.UnescapeString(u.Email),
+		})
+		checkErr(err)
+
+		page.Secret = key.Secret()
+		page.URI = key.URL()
+		page.SignedSecret, err = securecookie.EncodeMulti("totp", key.Secret(),
+			cookieCodecs...)
+		checkErr(err)
+
+		img, err := key.Image(200, 200)
+		checkErr(err)
+		var buf bytes.Buffer
+		err = png.Encode(&buf, img)
+		checkErr(err)
+		page.QRCode = template.URL("data:image/png;base64," +
+			base64.StdEncoding.EncodeToString(buf.Bytes()))
+	}
+
+	renderPage(w, r, "2fa.html", page)
+}
+
+// resetTwoFactor disables 2fa for the user with the given email. It's run from
+// the command line by an admin when a user has lost their device.
+func resetTwoFactor(email string) {
+
+	u := getUserByEmail(html.EscapeString(email))
+	if u == nil {
+		debugLogger.Println("   No account with email '" + email + "'.")
+		os.Exit(1)
+	}
+
+	resetUserTOTP(u.Id)
+	debugLogger.Println("   Reset 2fa of '" + email + "'.")
+}
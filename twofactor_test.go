@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+const testSecret = "JBSWY3DPEHPK3PXP"
+
+// codeAt returns the totp code of the test secret for a time offset from now.
+func codeAt(t *testing.T, offset time.Duration) string {
+	code, err := totp.GenerateCode(testSecret, time.Now().Add(offset))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestTOTPCodesAllowOneStepOfDrift(t *testing.T) {
+
+	setupTest(t)
+
+	// Don't let the time step change in the middle of a case,
+	if time.Now().Unix()%30 >= 28 {
+		time.Sleep(3 * time.Second)
+	}
+
+	for i, tc := range []struct {
+		name  string
+		code  func() string
+		valid bool
+	}{
+		{"current", func() string { return codeAt(t, 0) }, true},
+		{"spaced", func() string { c := codeAt(t, 0); return c[:3] + " " + c[3:] }, true},
+		{"previous step", func() string { return codeAt(t, -30*time.Second) }, true},
+		{"next step", func() string { return codeAt(t, 30*time.Second) }, true},
+		{"two steps old", func() string { return codeAt(t, -60*time.Second) }, false},
+		{"two steps ahead", func() string { return codeAt(t, 60*time.Second) }, false},
+		{"empty", func() string { return "" }, false},
+		{"wrong", func() string { return strings.Repeat("0", 7) }, false},
+	} {
+		u := createUser(fmt.Sprintf("user%d@example.com", i), "", []byte(""))
+		setUserTOTP(u.Id, testSecret)
+
+		if checkTOTP(u.Id, testSecret, tc.code()) != tc.valid {
+			t.Errorf("the %s code isn't valid %v", tc.name, tc.valid)
+		}
+	}
+}
+
+func TestTOTPCodesCantBeReplayed(t *testing.T) {
+
+	setupTest(t)
+
+	if time.Now().Unix()%30 >= 28 {
+		time.Sleep(3 * time.Second)
+	}
+
+	u := createUser("alice@example.com", "", []byte(""))
+	setUserTOTP(u.Id, testSecret)
+
+	for _, tc := range []struct {
+		name   string
+		offset time.Duration
+		valid  bool
+	}{
+		{"current", 0, true},
+		{"current again", 0, false},
+		{"older", -30 * time.Second, false},
+		{"newer", 30 * time.Second, true},
+		{"newer again", 30 * time.Second, false},
+	} {
+		if checkTOTP(u.Id, testSecret, codeAt(t, tc.offset)) != tc.valid {
+			t.Errorf("the %s code isn't valid %v", tc.name, tc.valid)
+		}
+	}
+
+	// Enabling 2fa again doesn't forget the used steps,
+	setUserTOTP(u.Id, "")
+	setUserTOTP(u.Id, testSecret)
+	if checkTOTP(u.Id, testSecret, codeAt(t, 0)) {
+		t.Error("the code was replayed after enabling 2fa again")
+	}
+}
+
+func TestRecoveryCodesAreUsedOnce(t *testing.T) {
+
+	setupTest(t)
+
+	alice := createUser("alice@example.com", "", []byte(""))
+	bob := createUser("bob@example.com", "", []byte(""))
+
+	old := newRecoveryCodes(alice.Id)
+	codes := newRecoveryCodes(alice.Id)
+	theirs := newRecoveryCodes(bob.Id)
+	if len(codes) != recoveryCodeCount || countRecoveryCodes(alice.Id) != recoveryCodeCount {
+		t.Fatalf("alice got %d codes", countRecoveryCodes(alice.Id))
+	}
+
+	for _, tc := range []struct {
+		name  string
+		code  string
+		valid bool
+	}{
+		{"replaced", old[0], false},
+		{"bob's", theirs[0], false},
+		{"empty", "", false},
+		{"new", codes[0], true},
+		{"used", codes[0], false},
+		{"upper case", strings.ToUpper(codes[1]), true},
+		{"padded", " " + codes[2] + "\n", true},
+	} {
+		if useRecoveryCode(alice.Id, tc.code) != tc.valid {
+			t.Errorf("the %s code isn't valid %v", tc.name, tc.valid)
+		}
+	}
+
+	if n := countRecoveryCodes(alice.Id); n != recoveryCodeCount-3 {
+		t.Errorf("alice has %d codes left", n)
+	}
+	if n := countRecoveryCodes(bob.Id); n != recoveryCodeCount {
+		t.Errorf("bob has %d codes left", n)
+	}
+
+	// Disabling 2fa removes them,
+	setUserTOTP(alice.Id, "")
+	if useRecoveryCode(alice.Id, codes[3]) {
+		t.Error("a code was used after disabling 2fa")
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Largest part of a multipart paste kept in memory, the rest goes to disk,
+const multipartMemory = 8 << 20
+
+// The multipart fields a paste can be uploaded as, in the order they're read,
+var uploadFields = []string{"paste", "file"}
+
+// maxRequestSize returns the largest body read for a paste, twice the largest
+// paste to leave room for the escaping of json and forms.
+func maxRequestSize() int64 {
+	return 2 * int64(maxStreamSize())
+}
+
+// limitBody limits the body of every request to maxRequestSize, before the
+// csrf check or a handler reads the form.
+func limitBody(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize())
+		h.ServeHTTP(w, r)
+	})
+}
+
+// bodyError returns the error of a request body that couldn't be read, paste
+// too large if it went over maxRequestSize.
+func bodyError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return newError(http.StatusRequestEntityTooLarge, codePasteTooLarge, maxStreamSize())
+	}
+	return newError(http.StatusBadRequest, codeInvalidRequest, err.Error())
+}
+
+// parseSaveRequest reads a paste sent to the api, as json, as a form or as the
+// raw body. Only application/json is read as json. Forms carry the paste in
+// the paste field, multipart forms as a value or as an uploaded paste or file,
+// and raw bodies take the other fields from the query string. The body is
+// limited by limitBody.
+// Returns the paste and true if it was sent as json, or an error if the
+// request can't be read.
+func parseSaveRequest(r *http.Request) (Request, bool, error) {
+
+	var inData Request
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = ""
+	}
+
+	switch mediaType {
+	case "application/json":
+		err := json.NewDecoder(r.Body).Decode(&inData)
+		if err != nil {
+			return inData, true, bodyError(err)
+		}
+		return inData, true, nil
+
+	case "multipart/form-data":
+		err := r.ParseMultipartForm(multipartMemory)
+		if err != nil {
+			return inData, false, bodyError(err)
+		}
+		inData, err = formRequest(r.FormValue)
+		if err != nil {
+			return inData, false, err
+		}
+
+		// The paste can also be uploaded, named after the file unless there's
+		// a title,
+		for _, field := range uploadFields {
+			files := r.MultipartForm.File[field]
+			if inData.Paste != "" || len(files) == 0 {
+				continue
+			}
+
+			f, err := files[0].Open()
+			if err != nil {
+				return inData, false, internalError(err)
+			}
+			data, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				return inData, false, bodyError(err)
+			}
+
+			inData.Paste = string(data)
+			if inData.Title == "" && len(files[0].Filename) <= 50 && validName(files[0].Filename) {
+				inData.Title = files[0].Filename
+			}
+		}
+		return inData, false, nil
+	}
+
+	// The csrf check may have read the form already,
+	if r.PostForm != nil && mediaType == "application/x-www-form-urlencoded" {
+		inData, err := formRequest(r.FormValue)
+		return inData, false, err
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return inData, false, bodyError(err)
+	}
+
+	query := r.URL.Query()
+
+	// a form with a paste field,
+	if mediaType == "application/x-www-form-urlencoded" {
+		form, err := url.ParseQuery(string(body))
+		if err == nil && (form.Get("paste") != "" || form.Get("content") != "") {
+			for k, v := range query {
+				if _, ok := form[k]; !ok {
+					form[k] = v
+				}
+			}
+			inData, err := formRequest(form.Get)
+			return inData, false, err
+		}
+	}
+
+	// and everything else is the paste itself,
+	inData, err = formRequest(query.Get)
+	inData.Paste = string(body)
+	return inData, false, err
+}
+
+// formRequest sets up a Request from the fields of a form or query string.
+// The paste can be given as paste or content, like in the v2 api, and burn is
+// true for anything strconv.ParseBool takes as true.
+// Returns an error if the expiry or team aren't valid.
+func formRequest(get func(string) string) (Request, error) {
+
+	inData := Request{
+		Title:   get("title"),
+		Paste:   get("paste"),
+		Lang:    get("lang"),
+		Style:   get("style"),
+		Website: get("website"),
+	}
+	inData.Burn, _ = strconv.ParseBool(get("burn"))
+	if inData.Paste == "" {
+		inData.Paste = get("content")
+	}
+
+	expiry, err := parseExpiry(get("expiry"))
+	if err != nil {
+		return inData, newError(http.StatusBadRequest, codeInvalidField, "expiry")
+	}
+	inData.Expiry = expiry
+
+	if team := get("team"); team != "" {
+		inData.Team, err = strconv.ParseInt(team, 10, 64)
+		if err != nil {
+			return inData, newError(http.StatusBadRequest, codeInvalidField, "team")
+		}
+	}
+
+	return inData, nil
+}
+
+// parseExpiry parses an expiry given in seconds or as a duration like 90m, an
+// empty string never expires.
+// Returns the expiry in seconds.
+func parseExpiry(s string) (int64, error) {
+
+	if s == "" {
+		return 0, nil
+	}
+
+	seconds, err := strconv.ParseInt(s, 10, 64)
+	if err == nil && seconds >= 0 {
+		return seconds, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid expiry '%s'", s)
+	}
+
+	return int64(d.Seconds()), nil
+}
+
+// wantsPlainURL returns true if the paste should be answered with just its
+// url, when text/plain is asked for or when the paste wasn't sent as json by
+// a client that doesn't ask for json.
+func wantsPlainURL(r *http.Request, isJSON bool) bool {
+
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "application/json") {
+		return false
+	}
+
+	return strings.Contains(accept, "text/plain") || !isJSON
+}
+
+// knownLang returns true if lang is one of the lexers of the highlighter.
+func knownLang(lang string) bool {
+	for _, l := range listOfLangsFirst {
+		if l == lang {
+			return true
+		}
+	}
+	for _, l := range listOfLangsLast {
+		if l == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// sendPlainURL answers a saved paste with its url as plain text, in the
+// language asked for. The delkey is sent in a header, and so is the warning
+// about secrets found in the paste.
+func sendPlainURL(w http.ResponseWriter, p Response, lang string) {
+
+	link := p.Url
+	if knownLang(lang) {
+		link += "/" + lang
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if p.DelKey != "" {
+		w.Header().Set(deleteKeyHeader, p.DelKey)
+	}
+	if p.Code == codeSecretsFound || p.Code == codeSecretsRedacted {
+		w.Header().Set("Warning", "299 - "+strconv.Quote(p.Status))
+	}
+	fmt.Fprintln(w, link)
+}
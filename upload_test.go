@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// parseUpload reads a save request with the body and content type.
+func parseUpload(t *testing.T, target, contentType, body string) (Request, bool, error) {
+	r := httptest.NewRequest("POST", target, strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	var in Request
+	var isJSON bool
+	var err error
+	limitBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		in, isJSON, err = parseSaveRequest(r)
+	})).ServeHTTP(w, r)
+	return in, isJSON, err
+}
+
+// multipartUpload returns the body and content type of a multipart form with
+// the files, given as field, file name and content.
+func multipartUpload(t *testing.T, files ...[3]string) (string, string) {
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, f := range files {
+		w, err := mw.CreateFormFile(f[0], f[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(f[2]))
+	}
+	mw.Close()
+
+	return buf.String(), mw.FormDataContentType()
+}
+
+func TestUploadOnlyReadsJSONContent(t *testing.T) {
+
+	setupTest(t)
+
+	in, isJSON, err := parseUpload(t, "/api", "application/json", `{"paste": "json paste", "title": "t"}`)
+	if err != nil || !isJSON || in.Paste != "json paste" || in.Title != "t" {
+		t.Fatalf("json was read as %+v, %v, %v", in, isJSON, err)
+	}
+
+	// curl --data-binary sends a form, but json there is just a paste,
+	body := `{"paste": "not json"}`
+	in, isJSON, err = parseUpload(t, "/api?title=raw", "application/x-www-form-urlencoded", body)
+	if err != nil || isJSON || in.Paste != body || in.Title != "raw" {
+		t.Fatalf("the raw body was read as %+v, %v, %v", in, isJSON, err)
+	}
+
+	in, isJSON, err = parseUpload(t, "/api", "text/plain", body)
+	if err != nil || isJSON || in.Paste != body {
+		t.Fatalf("the text body was read as %+v, %v, %v", in, isJSON, err)
+	}
+
+	in, _, err = parseUpload(t, "/api?title=query", "application/x-www-form-urlencoded", "paste=form+paste&title=form")
+	if err != nil || in.Paste != "form paste" || in.Title != "form" {
+		t.Fatalf("the form was read as %+v, %v", in, err)
+	}
+}
+
+func TestUploadReadsPasteOrFileField(t *testing.T) {
+
+	setupTest(t)
+
+	// Other uploads are ignored,
+	body, contentType := multipartUpload(t,
+		[3]string{"attachment", "other.txt", "not the paste"},
+		[3]string{"file", "notes.txt", "the file"})
+	in, _, err := parseUpload(t, "/api", contentType, body)
+	if err != nil || in.Paste != "the file" || in.Title != "notes.txt" {
+		t.Fatalf("read %+v, %v instead of the file field", in, err)
+	}
+
+	// and paste comes before file,
+	body, contentType = multipartUpload(t,
+		[3]string{"file", "notes.txt", "the file"},
+		[3]string{"paste", "paste.txt", "the paste"})
+	in, _, err = parseUpload(t, "/api", contentType, body)
+	if err != nil || in.Paste != "the paste" || in.Title != "paste.txt" {
+		t.Fatalf("read %+v, %v instead of the paste field", in, err)
+	}
+
+	body, contentType = multipartUpload(t, [3]string{"attachment", "other.txt", "not the paste"})
+	in, _, err = parseUpload(t, "/api", contentType, body)
+	if err != nil || in.Paste != "" {
+		t.Fatalf("read %+v, %v from an unknown field", in, err)
+	}
+}
+
+func TestUploadLimitsTheBody(t *testing.T) {
+
+	setupTest(t)
+	configuration.MaxPasteSize = 1000
+
+	huge := strings.Repeat("a", 3000)
+	multipartBody, multipartType := multipartUpload(t, [3]string{"file", "huge.txt", huge})
+
+	for contentType, body := range map[string]string{
+		"text/plain":       huge,
+		"application/json": `{"paste": "` + huge + `"}`,
+		multipartType:      multipartBody,
+	} {
+		_, _, err := parseUpload(t, "/api", contentType, body)
+		if e, ok := err.(*RequestError); !ok || e.Status != http.StatusRequestEntityTooLarge || e.Code != codePasteTooLarge {
+			t.Errorf("a body of %d bytes sent as %s answered %v", len(body), contentType, err)
+		}
+	}
+
+	if in, _, err := parseUpload(t, "/api", "text/plain", huge[:1500]); err != nil || len(in.Paste) != 1500 {
+		t.Errorf("a body within the limit answered %v", err)
+	}
+}
+
+// countingReader counts the bytes read from it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestBodyLimitComesBeforeTheCSRFCheck(t *testing.T) {
+
+	setupTest(t)
+	configuration.MaxPasteSize = 1000
+
+	for _, contentType := range []string{"application/x-www-form-urlencoded", "multipart/form-data; boundary=x"} {
+		body := &countingReader{r: strings.NewReader("csrf_token=x&paste=" + strings.Repeat("a", 1<<20))}
+		r := httptest.NewRequest("POST", "/api", body)
+		r.Header.Set("Content-Type", contentType)
+		r.AddCookie(&http.Cookie{Name: "session", Value: "x"})
+
+		called := false
+		w := httptest.NewRecorder()
+		limitBody(csrfProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		}))).ServeHTTP(w, r)
+
+		if called {
+			t.Errorf("the %s request went through", contentType)
+		}
+		if body.n > int(maxRequestSize())+4096 {
+			t.Errorf("the csrf check read %d bytes of the %s body", body.n, contentType)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/dchest/uniuri"
+)
+
+// Roles a user can have,
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+)
+
+// Where accounts log in, only local accounts have a password of their own,
+const (
+	authLocal = "local"
+	authOIDC  = "oidc"
+	authLDAP  = "ldap"
+)
+
+// roles are all the available roles, from least to most privileged.
+var roles = []string{roleUser, roleAdmin}
+
+// rolePriority returns how privileged a role is.
+// Returns -1 for unknown roles.
+func rolePriority(role string) int {
+	for i, r := range roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// User is an account in the users table. Pastes reference users by their
+// numeric id, which never changes, so the email and display name are free to
+// change.
+type User struct {
+	Id          int64
+	Email       string
+	DisplayName string
+	ApiKey      string
+	CreatedAt   int64
+	Disabled    bool
+	Verified    bool
+	Role        string
+	Locale      string // Chosen on the account page, empty to follow the browser
+	AuthSource  string // Where the account logs in, one of authLocal, authOIDC and authLDAP
+	Team        int64  // Set when authenticated with a team token, limits the request to that team
+}
+
+// Name returns the display name of the user, falling back to the email.
+func (u *User) Name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Email
+}
+
+// userColumns are the columns scanned by scanUser, in order.
+const userColumns = "id, email, displayname, apikey, created_at, disabled, verified, role, locale, auth_source"
+
+// scanUser scans a row selected with userColumns into a User.
+// Returns nil if the row doesn't exist.
+func scanUser(row *sql.Row) *User {
+
+	var u User
+	var displayName, locale sql.NullString
+	var disabled, verified int
+
+	err := row.Scan(&u.Id, &u.Email, &displayName, &u.ApiKey, &u.CreatedAt,
+		&disabled, &verified, &u.Role, &locale, &u.AuthSource)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		checkErr(err)
+	}
+
+	u.DisplayName = displayName.String
+	u.Locale = locale.String
+	u.Disabled = disabled != 0
+	u.Verified = verified != 0
+	return &u
+}
+
+// getUserById looks up a user by its id.
+// Returns nil if the user doesn't exist.
+func getUserById(id int64) *User {
+	return scanUser(dbHandle.QueryRow("select "+userColumns+" from "+
+		configuration.DBUsersTable+" where id="+
+		configuration.DBPlaceHolder[0], id))
+}
+
+// getUserByEmail looks up a user by its email.
+// Returns nil if the user doesn't exist.
+func getUserByEmail(email string) *User {
+	return scanUser(dbHandle.QueryRow("select "+userColumns+" from "+
+		configuration.DBUsersTable+" where email="+
+		configuration.DBPlaceHolder[0], email))
+}
+
+// getUserByKey looks up a user by its api key.
+// Returns nil if the user doesn't exist.
+func getUserByKey(key string) *User {
+	if key == "" {
+		return nil
+	}
+	return scanUser(dbHandle.QueryRow("select "+userColumns+" from "+
+		configuration.DBUsersTable+" where apikey="+
+		configuration.DBPlaceHolder[0], key))
+}
+
+// getUserBySubject looks up a user by the subject given by the identity
+// provider.
+// Returns nil if the user doesn't exist.
+func getUserBySubject(subject string) *User {
+	if subject == "" {
+		return nil
+	}
+	return scanUser(dbHandle.QueryRow("select "+userColumns+" from "+
+		configuration.DBUsersTable+" where oidc_subject="+
+		configuration.DBPlaceHolder[0], subject))
+}
+
+// getUserPassword returns the bcrypt hash of the users password.
+func getUserPassword(id int64) []byte {
+
+	var hashedPassword []byte
+	err := dbHandle.QueryRow("select password from "+configuration.DBUsersTable+
+		" where id="+configuration.DBPlaceHolder[0], id).
+		Scan(&hashedPassword)
+	checkErr(err)
+
+	return hashedPassword
+}
+
+// generateApiKey generates a random api key for a new user.
+// The function calls itself recursively until a key that doesn't exist is
+// found.
+// Returns the key
+func generateApiKey() string {
+
+	// Use uniuri to generate random string
+	key := uniuri.NewLen(20)
+	loggy(fmt.Sprintf("Generated key is '%s', checking if it's already taken in the database",
+		key))
+
+	if u := getUserByKey(key); u != nil {
+		loggy(fmt.Sprintf("Key '%s' is taken, generating new key.", key))
+		return generateApiKey()
+	}
+
+	loggy(fmt.Sprintf("Key '%s' is not taken, will use it.", key))
+	return key
+}
+
+// Passwords need at least minPasswordLength characters, and bcrypt only takes
+// maxPasswordLength bytes,
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
+// validPassword returns true if the password can be set on an account.
+func validPassword(password string) bool {
+	return utf8.RuneCountInString(password) >= minPasswordLength && len(password) <= maxPasswordLength
+}
+
+// passwordRule returns the text telling the rule of validPassword.
+func passwordRule(r *http.Request) string {
+	return tr(r, "Passwords need between %d and %d characters.", minPasswordLength, maxPasswordLength)
+}
+
+// validName returns true if a title or name fits on one line, without control
+// characters. They end up in the headers of emails.
+func validName(name string) bool {
+
+	if !utf8.ValidString(name) {
+		return false
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) || unicode.In(c, unicode.Zl, unicode.Zp) {
+			return false
+		}
+	}
+	return true
+}
+
+// nameRule returns the text telling the rule of validName.
+func nameRule(r *http.Request) string {
+	return tr(r, "Names can't have line breaks or control characters.")
+}
+
+// createUser inserts a new user into the database.
+// Returns the created user.
+func createUser(email string, displayName string, hashedPassword []byte) *User {
+
+	stmt, err := dbHandle.Prepare("INSERT INTO " + configuration.DBUsersTable +
+		" (email,password,displayname,apikey,created_at,disabled,verified,role)values(" +
+		dbPlaceHolders(8) + ")")
+	checkErr(err)
+
+	_, err = stmt.Exec(email, hashedPassword, displayName, generateApiKey(),
+		time.Now().Unix(), 0, 0, roleUser)
+	checkErr(err)
+	stmt.Close()
+
+	// Not every driver supports LastInsertId, so read the row back,
+	return getUserByEmail(email)
+}
+
+// renameUser changes the display name of a user.
+func renameUser(id int64, displayName string) {
+
+	stmt, err := dbHandle.Prepare("UPDATE " + configuration.DBUsersTable +
+		" SET displayname=" + configuration.DBPlaceHolder[0] +
+		" WHERE id=" + configuration.DBPlaceHolder[1])
+	checkErr(err)
+
+	_, err = stmt.Exec(displayName, id)
+	checkErr(err)
+	stmt.Close()
+}
+
+// setUserLocale changes the locale chosen by the user, empty to follow the
+// browser.
+func setUserLocale(id int64, locale string) {
+
+	stmt, err := dbHandle.Prepare("UPDATE " + configuration.DBUsersTable +
+		" SET locale=" + configuration.DBPlaceHolder[0] +
+		" WHERE id=" + configuration.DBPlaceHolder[1])
+	checkErr(err)
+
+	_, err = stmt.Exec(sql.NullString{String: locale, Valid: locale != ""}, id)
+	checkErr(err)
+	stmt.Close()
+}
+
+// setUserPassword changes the bcrypt hash of the users password.
+func setUserPassword(id int64, hashedPassword []byte) {
+
+	stmt, err := dbHandle.Prepare("UPDATE " + configuration.DBUsersTable +
+		" SET password=" + configuration.DBPlaceHolder[0] +
+		" WHERE id=" + configuration.DBPlaceHolder[1])
+	checkErr(err)
+
+	_, err = stmt.Exec(hashedPassword, id)
+	checkErr(err)
+	stmt.Close()
+}
+
+// setUserAuthSource sets where the user logs in.
+func setUserAuthSource(id int64, source string) {
+
+	stmt, err := dbHandle.Prepare("UPDATE " + configuration.DBUsersTable +
+		" SET auth_source=" + configuration.DBPlaceHolder[0] +
+		" WHERE id=" + configuration.DBPlaceHolder[1])
+	checkErr(err)
+
+	_, err = stmt.Exec(source, id)
+	checkErr(err)
+	stmt.Close()
+}
+
+// setUserVerified marks the email of a user as verified.
+func setUserVerified(id int64) {
+
+	stmt, err := dbHandle.Prepare("UPDATE " + configuration.DBUsersTable +
+		" SET verified=1 WHERE id=" + configuration.DBPlaceHolder[0])
+	checkErr(err)
+
+	_, err = stmt.Exec(id)
+	checkErr(err)
+	stmt.Close()
+}
+
+// setUserSubject links a user to a subject of the identity provider.
+func setUserSubject(id int64, subject string) {
+
+	stmt, err := dbHandle.Prepare("UPDATE " + configuration.DBUsersTable +
+		" SET oidc_subject=" + configuration.DBPlaceHolder[0] +
+		" WHERE id=" + configuration.DBPlaceHolder[1])
+	checkErr(err)
+
+	_, err = stmt.Exec(subject, id)
+	checkErr(err)
+	stmt.Close()
+}
+
+// setUserRole changes the role of a user.
+func setUserRole(id int64, role string) {
+
+	stmt, err := dbHandle.Prepare("UPDATE " + configuration.DBUsersTable +
+		" SET role=" + configuration.DBPlaceHolder[0] +
+		" WHERE id=" + configuration.DBPlaceHolder[1])
+	checkErr(err)
+
+	_, err = stmt.Exec(role, id)
+	checkErr(err)
+	stmt.Close()
+}
+
+// setUserDisabled disables or enables a user. Disabled users can't log in and
+// their sessions are removed, but their pastes are kept.
+func setUserDisabled(id int64, disabled bool) {
+
+	value := 0
+	if disabled {
+		value = 1
+	}
+
+	stmt, err := dbHandle.Prepare("UPDATE " + configuration.DBUsersTable +
+		" SET disabled=" + configuration.DBPlaceHolder[0] +
+		" WHERE id=" + configuration.DBPlaceHolder[1])
+	checkErr(err)
+
+	_, err = stmt.Exec(value, id)
+	checkErr(err)
+	stmt.Close()
+
+	if disabled {
+		delUserSessions(id)
+	}
+}
+
+// deleteUser removes a user and its sessions. The pastes of the user are kept
+// but no longer have an owner.
+func deleteUser(id int64) {
+
+	delUserSessions(id)
+	delUserMemberships(id)
+
+	stmt, err := dbHandle.Prepare("UPDATE " + configuration.DBTable +
+		" SET ownerid=NULL WHERE ownerid=" + configuration.DBPlaceHolder[0])
+	checkErr(err)
+	_, err = stmt.Exec(id)
+	checkErr(err)
+	stmt.Close()
+
+	stmt, err = dbHandle.Prepare("DELETE FROM " + configuration.DBUsersTable +
+		" WHERE id=" + configuration.DBPlaceHolder[0])
+	checkErr(err)
+	_, err = stmt.Exec(id)
+	checkErr(err)
+	stmt.Close()
+
+	loggy(fmt.Sprintf("Successfully deleted user %d.", id))
+}
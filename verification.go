@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Lifetimes of the emailed tokens in seconds,
+const (
+	verifyTokenLifetime = 24 * 60 * 60
+	resetTokenLifetime  = 60 * 60
+)
+
+// Purposes of the emailed tokens, a token is only valid for its own purpose,
+const (
+	purposeVerify = "verify"
+	purposeReset  = "reset"
+)
+
+// tokenState returns a fingerprint of the user state the token depends on.
+// Verification tokens stop working when the email changes and reset tokens
+// stop working once the password has been changed, which makes them single
+// use.
+func tokenState(purpose string, u *User) string {
+
+	var state []byte
+	switch purpose {
+	case purposeVerify:
+		state = []byte(u.Email)
+	case purposeReset:
+		state = getUserPassword(u.Id)
+	}
+
+	sum := sha256.Sum256(state)
+	return hex.EncodeToString(sum[:8])
+}
+
+// signToken creates a signed token for the user that expires after lifetime
+// seconds.
+func signToken(purpose string, u *User, lifetime int64) string {
+
+	value := map[string]string{
+		"user":    strconv.FormatInt(u.Id, 10),
+		"expires": strconv.FormatInt(time.Now().Unix()+lifetime, 10),
+		"state":   tokenState(purpose, u),
+	}
+
+	encoded, err := securecookie.EncodeMulti(purpose, value, cookieCodecs...)
+	checkErr(err)
+
+	return encoded
+}
+
+// checkToken verifies a signed token.
+// Returns the user of the token, or nil if the token isn't valid.
+func checkToken(purpose string, token string) *User {
+
+	value := make(map[string]string)
+	err := securecookie.DecodeMulti(purpose, token, &value, cookieCodecs...)
+	if err != nil {
+		loggy(fmt.Sprintf("Invalid %s token : %s", purpose, err))
+		return nil
+	}
+
+	expires, _ := strconv.ParseInt(value["expires"], 10, 64)
+	if time.Now().Unix() >= expires {
+		loggy(fmt.Sprintf("The %s token has expired.", purpose))
+		return nil
+	}
+
+	id, _ := strconv.ParseInt(value["user"], 10, 64)
+	u := getUserById(id)
+	if u == nil || u.Disabled {
+		return nil
+	}
+
+	if value["state"] != tokenState(purpose, u) {
+		loggy(fmt.Sprintf("The %s token has already been used.", purpose))
+		return nil
+	}
+
+	return u
+}
+
+// sendVerification emails a verification link to the user.
+func sendVerification(u *User) {
+
+	link := configuration.Address + "/verify?token=" +
+		url.QueryEscape(signToken(purposeVerify, u, verifyTokenLifetime))
+
+	body := "Hi " + html.UnescapeString(u.Name()) + ",\n\n" +
+		"Please verify your email address for " + configuration.DisplayName +
+		" by opening the link below.\n\n" + link + "\n\n" +
+		"The link is valid for 24 hours.\n"
+
+	err := mailer.Send(html.UnescapeString(u.Email), "Verify your email address", body)
+	if err != nil {
+		debugLogger.Println("   Mail error : " + err.Error())
+	}
+}
+
+// sendPasswordReset emails a password reset link to the user.
+func sendPasswordReset(u *User) {
+
+	link := configuration.Address + "/reset/confirm?token=" +
+		url.QueryEscape(signToken(purposeReset, u, resetTokenLifetime))
+
+	body := "Hi " + html.UnescapeString(u.Name()) + ",\n\n" +
+		"Someone asked to reset the password of your " +
+		configuration.DisplayName + " account. If it was you, open the link " +
+		"below to choose a new password.\n\n" + link + "\n\n" +
+		"The link is valid for one hour. If you didn't ask for this you can " +
+		"ignore this email.\n"
+
+	err := mailer.Send(html.UnescapeString(u.Email), "Reset your password", body)
+	if err != nil {
+		debugLogger.Println("   Mail error : " + err.Error())
+	}
+}
+
+// verifyHandler verifies the email of a user when given a token, shows a form
+// to resend the verification email otherwise.
+func verifyHandler(w http.ResponseWriter, r *http.Request) {
+
+	page := &Page{Title: tr(r, "Verify email"), CSRFToken: csrfToken(w, r), CSPNonce: cspNonce(r), Theme: siteTheme}
+
+	switch r.Method {
+	case "GET":
+		if token := r.FormValue("token"); token != "" {
+			u := checkToken(purposeVerify, token)
+			if u == nil {
+				page.Message = tr(r, "The verification link is invalid or has expired.")
+				break
+			}
+
+			setUserVerified(u.Id)
+			loggy(fmt.Sprintf("Verified the email of user %d.", u.Id))
+			http.Redirect(w, r, "/login", 302)
+			return
+		}
+	case "POST":
+		email := html.EscapeString(r.FormValue("email"))
+		if u := getUserByEmail(email); u != nil && !u.Verified && !u.Disabled {
+			sendVerification(u)
+		}
+		page.Message = tr(r, "If the account exists and isn't verified yet, a new verification email has been sent.")
+	}
+
+	renderPage(w, r, "verify.html", page)
+}
+
+// resetHandler shows the forgot password form and emails a reset link on POST.
+func resetHandler(w http.ResponseWriter, r *http.Request) {
+
+	page := &Page{Title: tr(r, "Reset password"), CSRFToken: csrfToken(w, r), CSPNonce: cspNonce(r), Theme: siteTheme}
+
+	if r.Method == "POST" {
+		email := html.EscapeString(r.FormValue("email"))
+		// Accounts of the identity provider and the directory change their
+		// password there,
+		u := getUserByEmail(email)
+		if u != nil && !u.Disabled && u.AuthSource == authLocal {
+			sendPasswordReset(u)
+		} else if u != nil {
+			loggy(fmt.Sprintf("Not resetting the password of the %s account %d.", u.AuthSource, u.Id))
+		}
+		page.Message = tr(r, "If the account exists, an email with a reset link has been sent.")
+	}
+
+	renderPage(w, r, "reset.html", page)
+}
+
+// resetConfirmHandler shows the new password form for a reset token and sets
+// the new password on POST. Every session of the user is removed.
+func resetConfirmHandler(w http.ResponseWriter, r *http.Request) {
+
+	token := r.FormValue("token")
+	page := &Page{Title: tr(r, "Reset password"), FormToken: token, CSRFToken: csrfToken(w, r), CSPNonce: cspNonce(r), Theme: siteTheme}
+
+	u := checkToken(purposeReset, token)
+	if u == nil || u.AuthSource != authLocal {
+		page.FormToken = ""
+		page.Message = tr(r, "The reset link is invalid or has expired.")
+	} else if r.Method == "POST" && !validPassword(r.FormValue("password")) {
+		loggy(fmt.Sprintf("Refused an invalid password to reset the password of user %d.", u.Id))
+		page.Message = passwordRule(r)
+	} else if r.Method == "POST" {
+		hashedPassword, err := bcrypt.GenerateFromPassword(
+			[]byte(r.FormValue("password")), bcrypt.DefaultCost)
+		checkErr(err)
+
+		setUserPassword(u.Id, hashedPassword)
+		delUserSessions(u.Id)
+
+		// Receiving the link proves the email works,
+		setUserVerified(u.Id)
+
+		loggy(fmt.Sprintf("Reset the password of user %d.", u.Id))
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+
+	renderPage(w, r, "reset.html", page)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// postForm runs a handler with a POST of the form.
+func postForm(h func(w http.ResponseWriter, r *http.Request), target string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestPasswordRule(t *testing.T) {
+	for password, valid := range map[string]bool{
+		"":                      false,
+		"short":                 false,
+		"1234567":               false,
+		"12345678":              true,
+		"pässwörd":              true,
+		strings.Repeat("a", 72): true,
+		strings.Repeat("a", 73): false,
+		strings.Repeat("ä", 40): false,
+		"correct horse battery": true,
+	} {
+		if validPassword(password) != valid {
+			t.Errorf("validPassword(%q) isn't %v", password, valid)
+		}
+	}
+}
+
+func TestRegisterRefusesShortPasswords(t *testing.T) {
+
+	setupTest(t)
+
+	w := postForm(registerHandler, "/register", url.Values{
+		"email":    {"alice@example.com"},
+		"password": {""},
+	})
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "Passwords need between") {
+		t.Fatalf("an empty password answered %d", w.Code)
+	}
+	if getUserByEmail("alice@example.com") != nil {
+		t.Fatal("an account was created with an empty password")
+	}
+
+	w = postForm(registerHandler, "/register", url.Values{
+		"email":    {"alice@example.com"},
+		"password": {"long enough"},
+	})
+	if w.Code != 302 || getUserByEmail("alice@example.com") == nil {
+		t.Fatalf("registering answered %d", w.Code)
+	}
+}
+
+func TestResetRefusesShortPasswords(t *testing.T) {
+
+	setupTest(t)
+
+	u := createUser("alice@example.com", "", []byte("old"))
+	token := signToken(purposeReset, u, resetTokenLifetime)
+
+	w := postForm(resetConfirmHandler, "/reset/confirm", url.Values{
+		"token":    {token},
+		"password": {""},
+	})
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "Passwords need between") {
+		t.Fatalf("an empty password answered %d", w.Code)
+	}
+	if string(getUserPassword(u.Id)) != "old" {
+		t.Fatal("the password was reset to an empty one")
+	}
+
+	// The form is shown again with the token,
+	if !strings.Contains(w.Body.String(), `name="token"`) {
+		t.Error("the form isn't shown again")
+	}
+
+	w = postForm(resetConfirmHandler, "/reset/confirm", url.Values{
+		"token":    {token},
+		"password": {"long enough"},
+	})
+	if w.Code != 302 || string(getUserPassword(u.Id)) == "old" {
+		t.Fatalf("resetting answered %d", w.Code)
+	}
+}
+
+// recordingMailer keeps the subjects of the emails sent to each address.
+type recordingMailer map[string][]string
+
+func (m recordingMailer) Send(to string, subject string, body string) error {
+	m[to] = append(m[to], subject)
+	return nil
+}
+
+func TestResetRefusesExternalAccounts(t *testing.T) {
+
+	setupTest(t)
+	sent := recordingMailer{}
+	mailer = sent
+
+	for source, resets := range map[string]bool{
+		authLocal: true,
+		authOIDC:  false,
+		authLDAP:  false,
+	} {
+		u := createUser(source+"@example.com", "", []byte(""))
+		setUserAuthSource(u.Id, source)
+
+		postForm(resetHandler, "/reset", url.Values{"email": {u.Email}})
+		if (len(sent[u.Email]) == 1) != resets {
+			t.Errorf("the %s account got the emails %v", source, sent[u.Email])
+		}
+
+		// and a link sent before isn't taken either,
+		w := postForm(resetConfirmHandler, "/reset/confirm", url.Values{
+			"token":    {signToken(purposeReset, u, resetTokenLifetime)},
+			"password": {"long enough"},
+		})
+		if (len(getUserPassword(u.Id)) != 0) != resets {
+			t.Errorf("resetting the %s account answered %d", source, w.Code)
+		}
+	}
+}